@@ -0,0 +1,40 @@
+// tracediff compares two instruction traces written by `pdp -trace`, or saved
+// from the SimH "SHOW CPU HISTORY" command, and reports the first difference.
+//
+//	tracediff [-context n] emulator.trace reference.trace
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pdp/trace"
+)
+
+func main() {
+	context := flag.Int("context", 20, "Number of instructions shown before the difference")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tracediff [-context n] emulator.trace reference.trace")
+		os.Exit(2)
+	}
+
+	got, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer got.Close()
+	ref, err := os.Open(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ref.Close()
+
+	n, err := trace.Compare(got, ref, *context)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("traces match, %d instructions compared\n", n)
+}
@@ -0,0 +1,242 @@
+package config
+
+/*
+Machine configuration.
+
+The configuration is kept in a simple INI file:
+
+	; comment
+	[machine]
+	model  = 11/40
+	memory = 248K
+
+	[rk11]
+	; unit = image path, access mode (rw or ro)
+	rk0 = /home/pdp/images/rk0, rw
+	rk1 = images/src.rk05, ro
+
+	[rl11]
+	; unit = image path, access mode, drive type
+	rl0 = images/v7.rl02, rw, rl02
+
+The [machine] section selects the CPU model (11/20, 11/40, 11/45 or 11/70) and the memory size.
+11/70 accepts up to 4088K of memory, 11/40 and 11/45 up to 248K, 11/20 up to 56K.
+Every other section declares a device attached to the Unibus.
+Keys ending with a unit number attach an image to that unit of the device.
+Relative image paths are resolved against the directory of the configuration file.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultModel is used if the configuration doesn't say otherwise
+const DefaultModel = "11/40"
+
+// DefaultMemory - 248K, everything below the 18 bit I/O page.
+const DefaultMemory = 0760000
+
+// Config - machine configuration
+type Config struct {
+	// Model - CPU model, i.e. "11/40"
+	Model string
+
+	// Memory - size of the memory in bytes
+	Memory int
+
+	// Devices declared in the configuration, in the order of appearance
+	Devices []Device
+}
+
+// Device - peripheral declared in the configuration
+type Device struct {
+	Name  string
+	Units []Unit
+}
+
+// Unit - image attached to the device unit
+type Unit struct {
+	Number   int
+	Path     string
+	ReadOnly bool
+
+	// Type - optional drive type, for controllers supporting more than one
+	Type string
+}
+
+// Default returns the configuration of the machine without any optional devices
+func Default() *Config {
+	return &Config{Model: DefaultModel, Memory: DefaultMemory}
+}
+
+// Load reads and parses the configuration file
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf, err := Parse(f, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// Parse parses the configuration. baseDir is used to resolve relative image paths.
+func Parse(r io.Reader, baseDir string) (*Config, error) {
+	conf := Default()
+	var device *Device
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: invalid section header %q", lineNo, line)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			device = nil
+			if section != "machine" {
+				if conf.Device(section) != nil {
+					return nil, fmt.Errorf("line %d: device %s declared twice", lineNo, section)
+				}
+				conf.Devices = append(conf.Devices, Device{Name: section})
+				device = &conf.Devices[len(conf.Devices)-1]
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key = value, got %q", lineNo, line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch {
+		case section == "machine":
+			err = conf.setMachine(key, value)
+		case device != nil:
+			err = device.addUnit(key, value, baseDir)
+		default:
+			err = fmt.Errorf("key %s outside of any section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Device returns the device with the given name, or nil if not declared
+func (c *Config) Device(name string) *Device {
+	for i := range c.Devices {
+		if c.Devices[i].Name == name {
+			return &c.Devices[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) setMachine(key, value string) error {
+	switch key {
+	case "model":
+		c.Model = NormalizeModel(value)
+	case "memory":
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		c.Memory = size
+	default:
+		return fmt.Errorf("unknown machine setting %s", key)
+	}
+	return nil
+}
+
+// NormalizeModel turns "PDP-11/40", "pdp11/40" or "11/40" into "11/40"
+func NormalizeModel(model string) string {
+	model = strings.ToLower(strings.TrimSpace(model))
+	model = strings.TrimPrefix(model, "pdp")
+	return strings.TrimPrefix(model, "-")
+}
+
+// parseSize parses memory size with an optional K or M suffix
+func parseSize(value string) (int, error) {
+	multiplier := 1
+	v := strings.ToUpper(value)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		multiplier = 1024
+		v = v[:len(v)-1]
+	case strings.HasSuffix(v, "M"):
+		multiplier = 1024 * 1024
+		v = v[:len(v)-1]
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// addUnit parses "<name><number> = path[, rw|ro[, type]]"
+func (d *Device) addUnit(key, value, baseDir string) error {
+	digits := strings.TrimLeft(key, "abcdefghijklmnopqrstuvwxyz")
+	number, err := strconv.Atoi(digits)
+	if digits == "" || err != nil {
+		return fmt.Errorf("invalid unit %s in device %s", key, d.Name)
+	}
+	for _, u := range d.Units {
+		if u.Number == number {
+			return fmt.Errorf("unit %d of device %s attached twice", number, d.Name)
+		}
+	}
+
+	fields := strings.Split(value, ",")
+	unit := Unit{Number: number, Path: strings.TrimSpace(fields[0])}
+	if unit.Path == "" {
+		return fmt.Errorf("missing image path for unit %s", key)
+	}
+	if !filepath.IsAbs(unit.Path) {
+		unit.Path = filepath.Join(baseDir, unit.Path)
+	}
+
+	if len(fields) > 1 {
+		switch mode := strings.ToLower(strings.TrimSpace(fields[1])); mode {
+		case "rw", "":
+		case "ro":
+			unit.ReadOnly = true
+		default:
+			return fmt.Errorf("invalid access mode %q for unit %s", mode, key)
+		}
+	}
+	if len(fields) > 2 {
+		unit.Type = strings.ToLower(strings.TrimSpace(fields[2]))
+	}
+	if len(fields) > 3 {
+		return fmt.Errorf("too many fields for unit %s", key)
+	}
+
+	d.Units = append(d.Units, unit)
+	return nil
+}
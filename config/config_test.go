@@ -0,0 +1,70 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	input := `
+; test machine
+[machine]
+model = PDP-11/40
+memory = 128K
+
+[rk11]
+rk0 = /images/rk0, rw
+rk1 = src.rk05, ro
+`
+	conf, err := Parse(strings.NewReader(input), "/home/pdp")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if conf.Model != "11/40" {
+		t.Errorf("expected model 11/40, got %s", conf.Model)
+	}
+	if conf.Memory != 128*1024 {
+		t.Errorf("expected memory size of 128K, got %d", conf.Memory)
+	}
+
+	rk := conf.Device("rk11")
+	if rk == nil {
+		t.Fatalf("expected rk11 device to be declared")
+	}
+	want := []Unit{
+		{Number: 0, Path: "/images/rk0"},
+		{Number: 1, Path: filepath.Join("/home/pdp", "src.rk05"), ReadOnly: true},
+	}
+	if len(rk.Units) != len(want) {
+		t.Fatalf("expected %d units, got %d", len(want), len(rk.Units))
+	}
+	for i, u := range want {
+		if rk.Units[i] != u {
+			t.Errorf("unit %d: expected %+v, got %+v", i, u, rk.Units[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"key outside of section", "model = 11/40"},
+		{"unknown machine setting", "[machine]\ncpu = 11/40"},
+		{"invalid memory size", "[machine]\nmemory = lots"},
+		{"invalid access mode", "[rk11]\nrk0 = rk0, rx"},
+		{"unit without number", "[rk11]\nrk = rk0"},
+		{"unit attached twice", "[rk11]\nrk0 = a\nrk0 = b"},
+		{"device declared twice", "[rk11]\n[rk11]"},
+		{"broken section", "[rk11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(tt.input), "."); err == nil {
+				t.Errorf("expected error for %q", tt.input)
+			}
+		})
+	}
+}
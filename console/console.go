@@ -1,7 +1,16 @@
 package console
 
+// PromptSymbol is displayed by the console when it waits for the operator command
+const PromptSymbol = ". "
+
 // Console interface to allow easy debugging
 // gui less operations
 type Console interface {
 	WriteConsole(msg string) (err error)
+
+	// Prompt displays the prompt symbol, without moving to the next line
+	Prompt() (err error)
+
+	// Commands returns the channel of the command lines entered by the operator
+	Commands() <-chan string
 }
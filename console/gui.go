@@ -2,6 +2,7 @@ package console
 
 import (
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/jroimartin/gocui"
@@ -35,6 +36,7 @@ var consoleOut chan string
 // Gui type definition
 type Gui struct {
 	consoleOut  chan string // string channel, to which the console data is sent to
+	commands    chan string // command lines entered by the operator
 	g           *gocui.Gui  // main gocui GUI object
 	v           *gocui.View // gocui view of the control console
 	currentLine int         // counter to keep the position of the cursor
@@ -44,6 +46,7 @@ type Gui struct {
 func NewGui(g *gocui.Gui) *Gui {
 	c := new(Gui)
 	c.consoleOut = make(chan string)
+	c.commands = make(chan string, 1)
 	c.g = g
 	c.v, _ = g.View("status")
 	c.initGui()
@@ -58,12 +61,49 @@ func (c *Gui) initGui() {
 			s := <-c.consoleOut
 			c.g.Update(func(g *gocui.Gui) error {
 				fmt.Fprintf(c.v, "%s", s)
-
-				// TODO: needed here?
+				c.cursorToEnd()
 				return nil
 			})
 		}
 	}()
+
+	if err := c.g.SetKeybinding("status", gocui.KeyEnter, gocui.ModNone, c.enter); err != nil {
+		log.Panicln(err)
+	}
+}
+
+// enter sends the last line of the status view to the command interpreter.
+// Called by gocui, so it must not wait for the console output.
+func (c *Gui) enter(_ *gocui.Gui, v *gocui.View) error {
+	lines := v.BufferLines()
+	line := ""
+	if len(lines) > 0 {
+		line = strings.TrimPrefix(lines[len(lines)-1], PromptSymbol)
+	}
+	fmt.Fprint(v, "\n")
+	c.cursorToEnd()
+
+	select {
+	case c.commands <- line:
+	default:
+		// previous command still running, drop the line
+	}
+	return nil
+}
+
+// cursorToEnd moves the cursor behind the last character in the view,
+// where the autoscroll is going to display it.
+func (c *Gui) cursorToEnd() {
+	lines := c.v.BufferLines()
+	if len(lines) == 0 {
+		return
+	}
+	_, maxY := c.v.Size()
+	y := len(lines) - 1
+	if y >= maxY {
+		y = maxY - 1
+	}
+	_ = c.v.SetCursor(len(lines[len(lines)-1]), y)
 }
 
 // WriteConsole displays a string on the console
@@ -71,7 +111,6 @@ func (c *Gui) WriteConsole(msg string) error {
 	for _, line := range strings.Split(msg, "\n") {
 		if line != "" {
 			c.consoleOut <- line + "\n"
-			c.v.MoveCursor(0, 1, true)
 			c.currentLine++
 		}
 	}
@@ -79,3 +118,14 @@ func (c *Gui) WriteConsole(msg string) error {
 	// TODO: really needed here?
 	return nil
 }
+
+// Prompt displays the prompt symbol
+func (c *Gui) Prompt() error {
+	c.consoleOut <- PromptSymbol
+	return nil
+}
+
+// Commands returns the channel of the command lines entered by the operator
+func (c *Gui) Commands() <-chan string {
+	return c.commands
+}
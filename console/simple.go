@@ -31,12 +31,20 @@ requested functionlity:
 type Simple struct {
 	consoleOut  chan string // string channel, to which the console data is sent to
 	currentLine int         // counter to keep the position of the cursor
+
+	// the simple console shares the standard input with the teletype:
+	// the teletype forwards the keystrokes to the input channel after the operator
+	// switches to the console, and complete lines are sent to the commands channel.
+	input    chan uint8
+	commands chan string
 }
 
 // NewSimple returns a pointer to the new console and runs the initialization procedure:
 func NewSimple() *Simple {
 	c := new(Simple)
 	c.consoleOut = make(chan string)
+	c.input = make(chan uint8)
+	c.commands = make(chan string, 1)
 	c.initSimple()
 	return c
 }
@@ -50,6 +58,37 @@ func (c *Simple) initSimple() {
 			os.Stdout.Write([]byte(s))
 		}
 	}()
+
+	go func() {
+		var line []byte
+		for b := range c.input {
+			switch b {
+			case '\r':
+				// skip
+			case '\n':
+				c.commands <- string(line)
+				line = line[:0]
+			default:
+				line = append(line, b)
+			}
+		}
+	}()
+}
+
+// Input returns the channel accepting keystrokes typed on the console
+func (c *Simple) Input() chan<- uint8 {
+	return c.input
+}
+
+// Commands returns the channel of the command lines entered by the operator
+func (c *Simple) Commands() <-chan string {
+	return c.commands
+}
+
+// Prompt displays the prompt symbol
+func (c *Simple) Prompt() error {
+	c.consoleOut <- PromptSymbol
+	return nil
 }
 
 // WriteConsole displays a string on the console
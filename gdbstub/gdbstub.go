@@ -0,0 +1,419 @@
+// Package gdbstub implements the GDB remote serial protocol server,
+// allowing gdb (or any other RSP front-end) to debug the guest code.
+//
+// The stub listens on a TCP address ("localhost:1234") or on a Unix socket ("unix:/tmp/pdp11.sock"),
+// and serves one debugger at a time. The register set follows the gdb pdp11 target:
+// r0 - r5, sp, pc and ps, 16 bits each, little endian.
+// Supported packets: ? g G p P m M c s Z0 z0 D k, and Ctrl-C to interrupt the running machine.
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// number of registers exposed to gdb: R0 - R7 and PS
+const numRegisters = 9
+
+// Target is the machine being debugged
+type Target interface {
+	// Halt stops the CPU, Continue resumes it,
+	// StepInstruction executes a single instruction on the halted CPU
+	Halt()
+	Continue() error
+	StepInstruction() error
+
+	// Halts is notified every time the CPU halts
+	Halts() <-chan struct{}
+
+	// Registers returns R0 - R7 and PS, SetRegister sets one of them
+	Registers() []uint16
+	SetRegister(n int, value uint16) error
+
+	// ReadMemory and WriteMemory access the virtual memory through the current MMU mapping
+	ReadMemory(addr uint16) (byte, error)
+	WriteMemory(addr uint16, value byte) error
+
+	SetBreakpoint(addr uint16)
+	ClearBreakpoint(addr uint16)
+}
+
+// Server - gdb remote protocol server
+type Server struct {
+	target   Target
+	listener net.Listener
+	log      *log.Logger
+}
+
+// Listen opens the TCP or Unix socket for the debugger
+func Listen(address string, target Target, log *log.Logger) (*Server, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{target: target, listener: l, log: log}, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts debugger connections, until the server is closed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.log.Printf("gdb: debugger connected from %s", conn.RemoteAddr())
+		if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+			s.log.Printf("gdb: %v", err)
+		}
+		_ = conn.Close()
+		s.log.Printf("gdb: debugger disconnected")
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// event read from the debugger connection: either packet, or interrupt request
+type event struct {
+	packet    string
+	interrupt bool
+	err       error
+}
+
+// session keeps the state of a single debugger connection
+type session struct {
+	target Target
+	conn   io.ReadWriter
+	events chan event
+	done   chan struct{}
+
+	// CPU is running, debugger waits for the stop reply
+	running     bool
+	interrupted bool
+}
+
+// serveConn serves a single debugger connection. The target is halted on connect.
+func (s *Server) serveConn(conn io.ReadWriter) error {
+	ss := &session{target: s.target, conn: conn, events: make(chan event), done: make(chan struct{})}
+	defer close(ss.done)
+	go ss.read()
+
+	ss.target.Halt()
+	ss.drainHalts()
+
+	for {
+		var halts <-chan struct{}
+		if ss.running {
+			halts = ss.target.Halts()
+		}
+
+		select {
+		case ev := <-ss.events:
+			if ev.err != nil {
+				return ev.err
+			}
+			if ev.interrupt {
+				if ss.running {
+					ss.interrupted = true
+					ss.target.Halt()
+				}
+				continue
+			}
+			reply, done := ss.handle(ev.packet)
+			if ss.running {
+				// stop reply is sent after the CPU halts
+				continue
+			}
+			if err := ss.send(reply); err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		case <-halts:
+			ss.running = false
+			signal := "S05"
+			if ss.interrupted {
+				signal = "S02"
+				ss.interrupted = false
+			}
+			if err := ss.send(signal); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// read parses the incoming stream into packets, acknowledging every valid packet
+func (ss *session) read() {
+	r := bufio.NewReader(ss.conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			ss.emit(event{err: err})
+			return
+		}
+		switch b {
+		case 0x03:
+			if !ss.emit(event{interrupt: true}) {
+				return
+			}
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				ss.emit(event{err: err})
+				return
+			}
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				ss.emit(event{err: err})
+				return
+			}
+			data = data[:len(data)-1]
+			if fmt.Sprintf("%02x", checksum(data)) != strings.ToLower(string(sum)) {
+				_, _ = ss.conn.Write([]byte("-"))
+				continue
+			}
+			_, _ = ss.conn.Write([]byte("+"))
+			if !ss.emit(event{packet: data}) {
+				return
+			}
+		default:
+			// acks and noise
+		}
+	}
+}
+
+// emit passes the event to the session, unless the session is already over
+func (ss *session) emit(ev event) bool {
+	select {
+	case ss.events <- ev:
+		return true
+	case <-ss.done:
+		return false
+	}
+}
+
+// drainHalts drops the stale halt notification
+func (ss *session) drainHalts() {
+	select {
+	case <-ss.target.Halts():
+	default:
+	}
+}
+
+// send sends the packet to the debugger. Acks from gdb are read and ignored by read.
+func (ss *session) send(data string) error {
+	_, err := fmt.Fprintf(ss.conn, "$%s#%02x", data, checksum(data))
+	return err
+}
+
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// handle executes the packet and returns the reply.
+// done is set if the debugger is leaving.
+func (ss *session) handle(packet string) (reply string, done bool) {
+	if packet == "" {
+		return "", false
+	}
+
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return "S05", false
+	case 'g':
+		var sb strings.Builder
+		for _, r := range ss.target.Registers() {
+			sb.WriteString(hexWord(r))
+		}
+		return sb.String(), false
+	case 'G':
+		if len(args) != numRegisters*4 {
+			return "E01", false
+		}
+		for i := 0; i < numRegisters; i++ {
+			v, err := parseHexWord(args[i*4 : i*4+4])
+			if err != nil {
+				return "E01", false
+			}
+			if err := ss.target.SetRegister(i, v); err != nil {
+				return "E01", false
+			}
+		}
+		return "OK", false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n >= numRegisters {
+			return "E01", false
+		}
+		return hexWord(ss.target.Registers()[n]), false
+	case 'P':
+		reg, val, ok := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(reg, 16, 8)
+		if !ok || err != nil || n >= numRegisters {
+			return "E01", false
+		}
+		v, err := parseHexWord(val)
+		if err != nil || ss.target.SetRegister(int(n), v) != nil {
+			return "E01", false
+		}
+		return "OK", false
+	case 'm':
+		return ss.readMemory(args), false
+	case 'M':
+		return ss.writeMemory(args), false
+	case 'c':
+		if args != "" {
+			return "E01", false
+		}
+		ss.drainHalts()
+		if err := ss.target.Continue(); err != nil {
+			return "E01", false
+		}
+		ss.running = true
+		return "", false
+	case 's':
+		if args != "" {
+			return "E01", false
+		}
+		if err := ss.target.StepInstruction(); err != nil {
+			return "E01", false
+		}
+		return "S05", false
+	case 'Z', 'z':
+		return ss.breakpoint(packet[0] == 'Z', args), false
+	case 'H':
+		return "OK", false
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return "PacketSize=1000", false
+		case args == "Attached":
+			return "1", false
+		}
+		return "", false
+	case 'D':
+		_ = ss.target.Continue()
+		return "OK", true
+	case 'k':
+		// the machine can't be killed, keep it running without the debugger
+		_ = ss.target.Continue()
+		return "", true
+	}
+	return "", false
+}
+
+// readMemory handles "m addr,length"
+func (ss *session) readMemory(args string) string {
+	addr, length, err := parseAddrLength(args)
+	if err != nil {
+		return "E01"
+	}
+	buf := make([]byte, length)
+	for i := range buf {
+		if buf[i], err = ss.target.ReadMemory(addr + uint16(i)); err != nil {
+			if i == 0 {
+				return "E14"
+			}
+			buf = buf[:i]
+			break
+		}
+	}
+	return hex.EncodeToString(buf)
+}
+
+// writeMemory handles "M addr,length:XX..."
+func (ss *session) writeMemory(args string) string {
+	header, data, ok := strings.Cut(args, ":")
+	if !ok {
+		return "E01"
+	}
+	addr, length, err := parseAddrLength(header)
+	if err != nil {
+		return "E01"
+	}
+	buf, err := hex.DecodeString(data)
+	if err != nil || len(buf) != length {
+		return "E01"
+	}
+	for i, b := range buf {
+		if err := ss.target.WriteMemory(addr+uint16(i), b); err != nil {
+			return "E14"
+		}
+	}
+	return "OK"
+}
+
+// breakpoint handles "Z0,addr,kind" and "z0,addr,kind". Only software breakpoints are supported.
+func (ss *session) breakpoint(set bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 || parts[0] != "0" {
+		return ""
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	if set {
+		ss.target.SetBreakpoint(uint16(addr))
+	} else {
+		ss.target.ClearBreakpoint(uint16(addr))
+	}
+	return "OK"
+}
+
+func parseAddrLength(args string) (uint16, int, error) {
+	a, l, ok := strings.Cut(args, ",")
+	if !ok {
+		return 0, 0, errors.New("missing length")
+	}
+	addr, err := strconv.ParseUint(a, 16, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := strconv.ParseUint(l, 16, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(addr), int(length), nil
+}
+
+// hexWord encodes the register value in the target (little endian) byte order
+func hexWord(v uint16) string {
+	return hex.EncodeToString([]byte{byte(v), byte(v >> 8)})
+}
+
+func parseHexWord(s string) (uint16, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 2 {
+		return 0, errors.New("invalid register value")
+	}
+	return uint16(b[0]) | uint16(b[1])<<8, nil
+}
@@ -0,0 +1,166 @@
+package gdbstub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeTarget - 64K of memory and registers, no CPU
+type fakeTarget struct {
+	regs        [numRegisters]uint16
+	memory      [0x10000]byte
+	breakpoints map[uint16]bool
+	halted      bool
+	halts       chan struct{}
+}
+
+func newFakeTarget() *fakeTarget {
+	return &fakeTarget{breakpoints: map[uint16]bool{}, halts: make(chan struct{}, 1)}
+}
+
+func (f *fakeTarget) notify() {
+	select {
+	case f.halts <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakeTarget) Halt() {
+	f.halted = true
+	f.notify()
+}
+
+func (f *fakeTarget) Continue() error {
+	f.halted = false
+	return nil
+}
+
+func (f *fakeTarget) StepInstruction() error {
+	if !f.halted {
+		return errors.New("running")
+	}
+	f.regs[7] += 2
+	return nil
+}
+
+func (f *fakeTarget) Halts() <-chan struct{} { return f.halts }
+func (f *fakeTarget) Registers() []uint16    { return append([]uint16{}, f.regs[:]...) }
+
+func (f *fakeTarget) SetRegister(n int, value uint16) error {
+	f.regs[n] = value
+	return nil
+}
+
+func (f *fakeTarget) ReadMemory(addr uint16) (byte, error) {
+	if addr >= 0160000 {
+		return 0, errors.New("abort")
+	}
+	return f.memory[addr], nil
+}
+
+func (f *fakeTarget) WriteMemory(addr uint16, value byte) error {
+	f.memory[addr] = value
+	return nil
+}
+
+func (f *fakeTarget) SetBreakpoint(addr uint16)   { f.breakpoints[addr] = true }
+func (f *fakeTarget) ClearBreakpoint(addr uint16) { delete(f.breakpoints, addr) }
+
+// client - minimal gdb side of the protocol
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) send(packet string) {
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum(packet)); err != nil {
+		c.t.Fatal(err)
+	}
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("expected ack for %s, got %q (%v)", packet, b, err)
+	}
+}
+
+func (c *client) receive() string {
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sum := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, sum); err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(data, "#")
+}
+
+func (c *client) exchange(packet, want string) {
+	c.t.Helper()
+	c.send(packet)
+	if got := c.receive(); got != want {
+		c.t.Errorf("%s: expected %q, got %q", packet, want, got)
+	}
+}
+
+func TestSession(t *testing.T) {
+	target := newFakeTarget()
+	target.regs = [numRegisters]uint16{1, 2, 3, 4, 5, 6, 01000, 02000, 0340}
+	target.memory[01000] = 0xAB
+	target.memory[01001] = 0xCD
+
+	s := &Server{target: target, log: log.New(io.Discard, "", 0)}
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go func() {
+		_ = s.serveConn(server)
+		_ = server.Close()
+	}()
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.exchange("?", "S05")
+	c.exchange("g", "01000200030004000500060000020004e000")
+	c.exchange("p7", "0004")
+	c.exchange("P0=3412", "OK")
+	if target.regs[0] != 0x1234 {
+		t.Errorf("expected R0 to be set to 0x1234, got %x", target.regs[0])
+	}
+
+	c.exchange("m200,2", "abcd")
+	c.exchange("M300,3:010203", "OK")
+	if target.memory[0x301] != 2 {
+		t.Errorf("expected memory write")
+	}
+	c.exchange("mfffe,2", "E14")
+
+	c.exchange("Z0,400,2", "OK")
+	if !target.breakpoints[0x400] {
+		t.Errorf("expected breakpoint at 0x400")
+	}
+	c.exchange("z0,400,2", "OK")
+	c.exchange("Z1,400,2", "")
+
+	c.exchange("s", "S05")
+	if target.regs[7] != 02002 {
+		t.Errorf("expected step to advance PC, got %06o", target.regs[7])
+	}
+
+	// continue, and interrupt the running target
+	c.send("c")
+	if _, err := conn.Write([]byte{0x03}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.receive(); got != "S02" {
+		t.Errorf("expected S02 after interrupt, got %q", got)
+	}
+
+	c.exchange("D", "OK")
+}
@@ -36,7 +36,7 @@ const TTYin = 0060
 // IntBUS internal bus error?
 const IntBUS = 04
 
-// IntINVAL  - invalid (?)
+// IntINVAL - reserved instruction trap
 const IntINVAL = 010
 
 // IntDEBUG - debug trap
@@ -45,6 +45,9 @@ const TrapBRKPT = 014
 // IntIOT - IO trap (?)
 const IntIOT = 020
 
+// IntFP - floating point error trap
+const IntFP = 0244
+
 // IntFAULT - fault trap
 const IntFAULT = 0250
 
@@ -54,6 +57,15 @@ const IntCLOCK = 0100
 // IntRK - RK disk drive (?) interrupt
 const IntRK = 0220
 
+// IntRL - RL11 disk controller interrupt
+const IntRL = 0160
+
+// IntRP - RH11 massbus controller with RP drives interrupt
+const IntRP = 0254
+
+// IntTM - TM11 magnetic tape controller interrupt
+const IntTM = 0224
+
 // InterruptQueue - to avoid keeping the insert to the queue login in unibus:
 type InterruptQueue [8]Interrupt
 
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"pdp/config"
 	"pdp/console"
+	"pdp/gdbstub"
 	"pdp/logger"
 	"pdp/system"
 	"time"
@@ -14,15 +16,31 @@ import (
 	"github.com/jroimartin/gocui"
 )
 
-var debugMode *bool
+var (
+	debugMode   *bool
+	configPath  *string
+	model       *string
+	gdbAddress  *string
+	snapshot    *string
+	tracePath   *string
+	comparePath *string
+)
 
 func main() {
 	plainMode := flag.Bool("gui", false, "Run program in gui mode")
 	debugMode = flag.Bool("debug", false, "Run with CPU debug information")
+	configPath = flag.String("config", "pdp11.ini", "Machine configuration file")
+	model = flag.String("model", "", "CPU model (11/20, 11/40, 11/45 or 11/70), overrides the configuration file")
+	snapshot = flag.String("restore", "", "Restore the machine from the snapshot file instead of booting")
+	tracePath = flag.String("trace", "", "Write the instruction trace to the file")
+	comparePath = flag.String("compare", "", "Compare the execution with the reference trace file, halt at the first difference")
+	gdbAddress = flag.String("gdb", "", "Listen for gdb on the TCP address (localhost:1234) or unix:/path socket")
 	flag.Parse()
 
 	if !*plainMode {
-		startPdp(nil)
+		if err := startPdp(nil); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		g, err := gocui.NewGui(gocui.OutputNormal)
 		if err != nil {
@@ -114,18 +132,76 @@ func startPdp(g *gocui.Gui) error {
 
 	log := logger.New("pdp11.log")
 
-	c.WriteConsole("Starting PDP-11/40 emulator.")
-	pdp := system.InitializeSystem(c, terminalView, regView, g, *debugMode, log)
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if *model != "" {
+		conf.Model = config.NormalizeModel(*model)
+	}
+
+	c.WriteConsole(fmt.Sprintf("Starting PDP-%s emulator.", conf.Model))
+	pdp, err := system.InitializeSystem(conf, c, terminalView, regView, g, *debugMode, log)
+	if err != nil {
+		return err
+	}
+
+	start := pdp.Boot
+	if *snapshot != "" {
+		if err := pdp.LoadSnapshot(*snapshot); err != nil {
+			return err
+		}
+		c.WriteConsole(fmt.Sprintf("Restored from %s", *snapshot))
+		start = func() error {
+			pdp.Run()
+			return nil
+		}
+	}
+
+	switch {
+	case *tracePath != "" && *comparePath != "":
+		return errors.New("-trace and -compare can't be used together")
+	case *tracePath != "":
+		err = pdp.StartTrace(*tracePath)
+	case *comparePath != "":
+		err = pdp.StartCompare(*comparePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *gdbAddress != "" {
+		stub, err := gdbstub.Listen(*gdbAddress, pdp, log)
+		if err != nil {
+			return err
+		}
+		c.WriteConsole(fmt.Sprintf("gdb stub listening on %s", stub.Addr()))
+		go func() {
+			if err := stub.Serve(); err != nil {
+				log.Printf("gdb stub: %v", err)
+			}
+		}()
+	}
 
 	// update registers:
 	if g != nil {
 		updateRegisters(pdp, g)
+
+		// gocui main loop has to keep running for the console to work,
+		// so the emulation gets its own goroutine
+		go func() {
+			defer pdp.Shutdown()
+			log.Printf("Booting pdp..")
+			if err := start(); err != nil {
+				_ = c.WriteConsole(err.Error())
+			}
+		}()
+		return nil
 	}
-	pdp.Boot()
-	log.Printf("Booting pdp..")
+	defer pdp.Shutdown()
 
-	// default return value -> no errors encountered
-	return nil
+	log.Printf("Booting pdp..")
+	return start()
 }
 
 // update registers display
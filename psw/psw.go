@@ -1,5 +1,7 @@
 package psw
 
+import "strings"
+
 /**
 Processor status word package
 */
@@ -15,9 +17,15 @@ const tFlag = 4
 // KernelMode - processor mode
 const KernelMode = 0
 
+// SupervisorMode - processor mode, 11/45 and 11/70 only
+const SupervisorMode = 1
+
 // UserMode - processor mode
 const UserMode = 3
 
+// modeNames - flags of the kernel, supervisor, undefined and user mode
+var modeNames = [4]string{"K", "S", "?", "U"}
+
 // PSW keeps processor status word
 type PSW uint16
 
@@ -36,7 +44,7 @@ func (psw *PSW) Priority() uint16 {
 	return uint16((*psw >> 5) & 7)
 }
 
-// GetMode returns 3 for user and 0 for kernel
+// GetMode returns 3 for user, 1 for supervisor and 0 for kernel
 func (psw *PSW) GetMode() uint16 {
 	return uint16(*psw >> 14)
 }
@@ -111,17 +119,7 @@ func (psw *PSW) setFlag(flag uint, status bool) {
 
 // GetFlags returns set flags
 func (psw *PSW) GetFlags() string {
-	var flags string
-	if psw.GetPreviousMode() > 0 {
-		flags = "u"
-	} else {
-		flags = "k"
-	}
-	if psw.GetMode() > 0 {
-		flags += "U"
-	} else {
-		flags += "K"
-	}
+	flags := strings.ToLower(modeNames[psw.GetPreviousMode()]) + modeNames[psw.GetMode()]
 
 	if psw.N() {
 		flags += "N"
@@ -1,6 +1,8 @@
 package system
 
 import (
+	"errors"
+	"fmt"
 	"pdp/unibus"
 )
 
@@ -11,6 +13,9 @@ import (
 const (
 	// BOOTBASE is a base bootstrap address
 	BOOTBASE = 02000
+
+	// TAPEBOOTBASE - the tape bootstrap reads the boot record to 0, it stays out of its way
+	TAPEBOOTBASE = 016000
 )
 
 var bootcode = [...]uint16{
@@ -38,21 +43,86 @@ var bootcode = [...]uint16{
 	0105011, /* CLRB (R1) */
 	0005007} /* CLR PC */
 
+// tapeBootcode skips the first record of the tape and reads the second one to 0, like the DEC ROM bootstrap
+var tapeBootcode = [...]uint16{
+	0046524,               /* "TM" */
+	0012706, TAPEBOOTBASE, /* MOV #boot_start, SP */
+	0012700, 0000000, /* MOV #unit, R0        ; unit number */
+	0012701, 0172526, /* MOV #MTCMA, R1 */
+	0005011,          /* CLR (R1)             ; clear ba */
+	0012741, 0177777, /* MOV #-1, -(R1)       ; one record */
+	0010002,          /* MOV R0, R2 */
+	0000302,          /* SWAB R2 */
+	0062702, 0060011, /* ADD #60011, R2       ; 800 bpi, space forward & go */
+	0010241,          /* MOV R2, -(R1) */
+	0105711,          /* TSTB (R1)            (wait for ready) */
+	0100376,          /* BPL .-2 */
+	0010002,          /* MOV R0, R2 */
+	0000302,          /* SWAB R2 */
+	0062702, 0060003, /* ADD #60003, R2       ; 800 bpi, read & go */
+	0010211,                     /* MOV R2, (R1) */
+	0105711,                     /* TSTB (R1)            (wait for ready) */
+	0100376,                     /* BPL .-2 */
+	0005002,                     /* CLR R2 */
+	0005003,                     /* CLR R3 */
+	0012704, TAPEBOOTBASE + 020, /* MOV #START+20, R4 */
+	0005005, /* CLR R5 */
+	0005007} /* CLR PC */
+
 // Boot loads bootstrap code and start emulation
-func (sys *System) Boot() {
-	memPointer := uint16(BOOTBASE)
+func (sys *System) Boot() error {
+	if err := sys.loadBootstrap("rk", 0); err != nil {
+		return err
+	}
+	sys.Run()
+	return nil
+}
 
-	for _, c := range bootcode {
+// loadBootstrap copies the bootstrap for the device ("rk" or "mt") and the unit to memory,
+// and sets PC to the starting address
+func (sys *System) loadBootstrap(device string, unit int) error {
+	var (
+		code []uint16
+		base uint16
+	)
+	switch device {
+	case "rk":
+		if sys.unibus.Rk01 == nil {
+			return errors.New("can't boot: no RK11 disk controller configured")
+		}
+		if unit < 0 || unit > 7 {
+			return fmt.Errorf("can't boot: invalid RK unit %d", unit)
+		}
+		code, base = bootcode[:], BOOTBASE
+	case "mt":
+		if sys.unibus.Tm == nil {
+			return errors.New("can't boot: no TM11 tape controller configured")
+		}
+		// the bootstrap expects the tape at the load point
+		if err := sys.unibus.Tm.Rewind(unit); err != nil {
+			return fmt.Errorf("can't boot: %w", err)
+		}
+		code, base = tapeBootcode[:], TAPEBOOTBASE
+	default:
+		return fmt.Errorf("can't boot from %s%d", device, unit)
+	}
+	memPointer := base
+
+	for i, c := range code {
+		// MOV #unit, R0
+		if i == 4 {
+			c = uint16(unit)
+		}
 		sys.unibus.WriteIO(unibus.Uint18(memPointer), c)
 		memPointer += 2
 	}
 
 	// set PC to the starting address:
-	sys.CPU.Registers[7] = BOOTBASE + 2
+	sys.CPU.Registers[7] = base + 2
 
 	// start execution
 	if sys.CPU.State != unibus.CPURUN {
 		sys.CPU.State = unibus.CPURUN
 	}
-	sys.Run()
+	return nil
 }
@@ -0,0 +1,346 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"pdp/unibus"
+	"strconv"
+	"strings"
+)
+
+/*
+	System Control Console command interpreter.
+	Commands are read line by line from the console. Every access to the machine
+	goes through sys.Do, so the command never interferes with the instruction in progress.
+	Addresses and values are octal, addresses are physical (18 bit, or 22 bit on the 11/70).
+	Commands can be abbreviated, the first matching command in the table wins.
+*/
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	exec  func(sys *System, args []string) (string, error)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"EXAMINE", "EXAMINE <addr>[-<addr>]|Rn|SP|PC|PSW", "display memory or register", (*System).examine},
+		{"DEPOSIT", "DEPOSIT <addr>|Rn|SP|PC|PSW <value>", "write memory or register", (*System).deposit},
+		{"CONTINUE", "CONTINUE", "continue from the halted PC, switch keyboard to the terminal", (*System).cont},
+		{"STEP", "STEP [n]", "execute n instructions on the halted CPU", (*System).stepCmd},
+		{"HALT", "HALT", "halt the CPU, keep memory and registers intact", (*System).halt},
+		{"BOOT", "BOOT [rk<n>|mt<n>]", "initialize and boot from the disk or tape", (*System).boot},
+		{"START", "START [addr]", "initialize and start at the address", (*System).start},
+		{"RESET", "RESET", "initialize the CPU and devices, and halt", (*System).reset},
+		{"SHOW", "SHOW DEVICES", "list devices attached to the unibus", (*System).show},
+		{"SAVE", "SAVE <file>", "save the machine state to the snapshot file", (*System).save},
+		{"RESTORE", "RESTORE <file>", "restore the machine state from the snapshot file", (*System).restore},
+		{"TRACE", "TRACE <file>|OFF", "write the instruction trace to the file", (*System).traceCmd},
+		{"COMPARE", "COMPARE <file>", "compare the execution with the reference trace", (*System).compare},
+		{"HELP", "HELP", "list console commands", (*System).help},
+	}
+}
+
+// commandLoop executes commands entered on the console
+func (sys *System) commandLoop() {
+	for line := range sys.console.Commands() {
+		if out := sys.Command(line); out != "" {
+			_ = sys.console.WriteConsole(out)
+		}
+		_ = sys.console.Prompt()
+	}
+}
+
+// Command executes single console command line and returns its output
+func (sys *System) Command(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	name := strings.ToUpper(fields[0])
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd.name, name) {
+			out, err := cmd.exec(sys, fields[1:])
+			if err != nil {
+				return fmt.Sprintf("?%s: %v", cmd.name, err)
+			}
+			return out
+		}
+	}
+	return fmt.Sprintf("?unknown command %s, type HELP for the list of commands", fields[0])
+}
+
+func (sys *System) examine(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected address or register name")
+	}
+
+	var (
+		out strings.Builder
+		err error
+	)
+	sys.Do(func() {
+		if reg := sys.register(args[0]); reg != nil {
+			fmt.Fprintf(&out, "%s %06o", strings.ToUpper(args[0]), *reg)
+			return
+		}
+		if strings.EqualFold(args[0], "PSW") {
+			fmt.Fprintf(&out, "PSW %06o %s", sys.psw.Get(), sys.psw.GetFlags())
+			return
+		}
+
+		var begin, end unibus.Uint18
+		if begin, end, err = parseRange(args[0]); err != nil {
+			return
+		}
+		for addr := begin; addr <= end; addr += 2 {
+			var val uint16
+			if err = sys.guarded(func() { val = sys.unibus.ReadIO(addr) }); err != nil {
+				return
+			}
+			fmt.Fprintf(&out, "%06o: %06o\n", addr, val)
+		}
+	})
+	return out.String(), err
+}
+
+func (sys *System) deposit(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("expected address or register name and value")
+	}
+	val, err := strconv.ParseUint(args[1], 8, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid value %s", args[1])
+	}
+
+	sys.Do(func() {
+		if reg := sys.register(args[0]); reg != nil {
+			*reg = uint16(val)
+			return
+		}
+		if strings.EqualFold(args[0], "PSW") {
+			args[0] = strconv.FormatUint(uint64(sys.unibus.IOAddress(unibus.PSWAddr)), 8)
+		}
+
+		var addr unibus.Uint18
+		if addr, _, err = parseRange(args[0]); err != nil {
+			return
+		}
+		err = sys.guarded(func() { sys.unibus.WriteIO(addr, uint16(val)) })
+	})
+	return "", err
+}
+
+// cont also gives the keyboard back to the terminal of the running machine
+func (sys *System) cont(_ []string) (string, error) {
+	_ = sys.Continue()
+	sys.unibus.TermEmulator.ReleaseKeyboard()
+	return "", nil
+}
+
+func (sys *System) stepCmd(args []string) (string, error) {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return "", fmt.Errorf("invalid step count %s", args[0])
+		}
+	}
+
+	var (
+		out string
+		err error
+	)
+	sys.Do(func() {
+		if err = sys.stepHalted(n); err == nil {
+			out = sys.state()
+		}
+	})
+	return out, err
+}
+
+func (sys *System) halt(_ []string) (string, error) {
+	var out string
+	sys.Halt()
+	sys.Do(func() {
+		out = "HALTED\n" + sys.state()
+	})
+	return out, nil
+}
+
+func (sys *System) boot(args []string) (string, error) {
+	device, unit := "rk", 0
+	if len(args) > 0 {
+		dev := strings.ToLower(args[0])
+		var err error
+		if !strings.HasPrefix(dev, "rk") && !strings.HasPrefix(dev, "mt") {
+			return "", fmt.Errorf("can't boot from %s", args[0])
+		}
+		device = dev[:2]
+		if unit, err = strconv.Atoi(dev[2:]); err != nil {
+			return "", fmt.Errorf("invalid unit %s", args[0])
+		}
+	}
+
+	var err error
+	sys.Do(func() {
+		sys.initialize()
+		err = sys.loadBootstrap(device, unit)
+	})
+	if err == nil {
+		sys.unibus.TermEmulator.ReleaseKeyboard()
+	}
+	return "", err
+}
+
+func (sys *System) start(args []string) (string, error) {
+	var (
+		addr uint64
+		err  error
+	)
+	if len(args) > 0 {
+		if addr, err = strconv.ParseUint(args[0], 8, 16); err != nil || addr&1 != 0 {
+			return "", fmt.Errorf("invalid start address %s", args[0])
+		}
+	}
+
+	sys.Do(func() {
+		sys.initialize()
+		if len(args) > 0 {
+			sys.CPU.Registers[7] = uint16(addr)
+		}
+		sys.CPU.State = unibus.CPURUN
+	})
+	sys.unibus.TermEmulator.ReleaseKeyboard()
+	return "", nil
+}
+
+func (sys *System) reset(_ []string) (string, error) {
+	sys.Do(func() {
+		sys.initialize()
+		sys.CPU.State = unibus.HALT
+		sys.stopped = true
+	})
+	return "", nil
+}
+
+func (sys *System) show(args []string) (string, error) {
+	if len(args) != 1 || !strings.HasPrefix("DEVICES", strings.ToUpper(args[0])) {
+		return "", errors.New("expected SHOW DEVICES")
+	}
+
+	var out strings.Builder
+	sys.Do(func() {
+		for _, d := range sys.unibus.Devices() {
+			begin, end := d.AddressRange()
+			fmt.Fprintf(&out, "%-16s %06o-%06o", d.Name(), begin, end)
+			if vector, priority := d.Vector(); vector != 0 {
+				fmt.Fprintf(&out, "  vector %03o BR%d", vector, priority)
+			}
+			out.WriteString("\n")
+		}
+	})
+	return out.String(), nil
+}
+
+func (sys *System) save(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected file name")
+	}
+	if err := sys.SaveSnapshot(args[0]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("saved to %s", args[0]), nil
+}
+
+func (sys *System) restore(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected file name")
+	}
+	if err := sys.LoadSnapshot(args[0]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("restored from %s", args[0]), nil
+}
+
+func (sys *System) traceCmd(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected file name or OFF")
+	}
+	if strings.EqualFold(args[0], "OFF") {
+		return "", sys.StopTrace()
+	}
+	return "", sys.StartTrace(args[0])
+}
+
+func (sys *System) compare(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected reference trace file name")
+	}
+	return "", sys.StartCompare(args[0])
+}
+
+func (sys *System) help(_ []string) (string, error) {
+	var out strings.Builder
+	for _, cmd := range commands {
+		fmt.Fprintf(&out, "%-40s %s\n", cmd.usage, cmd.help)
+	}
+	out.WriteString("Ctrl-E switches the keyboard from the terminal to the console\n")
+	return out.String(), nil
+}
+
+// register returns pointer to the general register named by the console argument, or nil
+func (sys *System) register(name string) *uint16 {
+	name = strings.ToUpper(name)
+	switch name {
+	case "SP":
+		return &sys.CPU.Registers[6]
+	case "PC":
+		return &sys.CPU.Registers[7]
+	}
+	if len(name) == 2 && name[0] == 'R' && name[1] >= '0' && name[1] <= '7' {
+		return &sys.CPU.Registers[name[1]-'0']
+	}
+	return nil
+}
+
+// state describes the CPU registers and the instruction at PC
+func (sys *System) state() string {
+	out := fmt.Sprintf("%s\nPSW %06o %s\n", sys.CPU.DumpRegisters(), sys.psw.Get(), sys.psw.GetFlags())
+
+	pc := sys.CPU.Registers[7]
+	instr, disasm, err := sys.disassemble()
+	if err != nil {
+		return out + fmt.Sprintf("%06o: %v", pc, err)
+	}
+	return out + fmt.Sprintf("%06o: %06o %s", pc, instr, disasm)
+}
+
+// parseRange parses an octal physical address or the address range
+func parseRange(arg string) (begin, end unibus.Uint18, err error) {
+	first, last, isRange := strings.Cut(arg, "-")
+	b, err := strconv.ParseUint(first, 8, 22)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid address %s", first)
+	}
+	e := b
+	if isRange {
+		if e, err = strconv.ParseUint(last, 8, 22); err != nil || e < b {
+			return 0, 0, fmt.Errorf("invalid address %s", last)
+		}
+	}
+	return unibus.Uint18(b), unibus.Uint18(e), nil
+}
+
+// guarded runs f, and returns the trap raised by the bus or MMU as an error
+func (sys *System) guarded(f func()) error {
+	f()
+	if t, ok := sys.unibus.TakeTrap(); ok {
+		return fmt.Errorf("trap %03o: %s", t.Vector, t.Msg)
+	}
+	return nil
+}
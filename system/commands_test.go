@@ -0,0 +1,107 @@
+package system
+
+import (
+	"pdp/unibus"
+	"strings"
+	"testing"
+)
+
+func TestCommandExamineDeposit(t *testing.T) {
+	tests := []struct {
+		name    string
+		deposit string
+		examine string
+		want    string
+	}{
+		{"memory", "DEPOSIT 1000 123", "EXAMINE 1000", "001000: 000123"},
+		{"abbreviated", "d 1002 177777", "e 1002", "001002: 177777"},
+		{"register", "DEPOSIT R3 4711", "EXAMINE r3", "R3 004711"},
+		{"stack pointer", "DEPOSIT SP 1000", "EXAMINE SP", "SP 001000"},
+		{"psw", "DEPOSIT PSW 17", "EXAMINE PSW", "PSW 000017"},
+		{"io page", "DEPOSIT 777546 100", "EXAMINE 777546", "777546: 000100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := sys.Command(tt.deposit); out != "" {
+				t.Fatalf("unexpected deposit output: %s", out)
+			}
+			if out := sys.Command(tt.examine); !strings.HasPrefix(out, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, out)
+			}
+		})
+	}
+	sys.psw.Set(0)
+}
+
+func TestCommandExamineRange(t *testing.T) {
+	sys.unibus.Memory[02000>>1] = 1
+	sys.unibus.Memory[02002>>1] = 2
+	sys.unibus.Memory[02004>>1] = 3
+
+	want := "002000: 000001\n002002: 000002\n002004: 000003\n"
+	if out := sys.Command("EXAMINE 2000-2004"); out != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	for _, line := range []string{
+		"FOO",
+		"EXAMINE",
+		"EXAMINE 1001",
+		"EXAMINE 770000",
+		"EXAMINE 9",
+		"DEPOSIT 1000 8",
+		"BOOT rl0",
+		"BOOT mt0",
+		"SHOW MEMORY",
+	} {
+		if out := sys.Command(line); !strings.HasPrefix(out, "?") {
+			t.Errorf("%s: expected error, got %q", line, out)
+		}
+	}
+}
+
+func TestCommandStep(t *testing.T) {
+	// MOV #5, R0; INC R0
+	sys.unibus.Memory[01000>>1] = 012700
+	sys.unibus.Memory[01002>>1] = 5
+	sys.unibus.Memory[01004>>1] = 005200
+	sys.CPU.Registers[7] = 01000
+	sys.CPU.State = unibus.CPURUN
+	defer func() { sys.CPU.State = unibus.CPURUN }()
+
+	if out := sys.Command("STEP"); !strings.HasPrefix(out, "?") {
+		t.Errorf("expected STEP to fail on running CPU, got %q", out)
+	}
+
+	if out := sys.Command("HALT"); !strings.HasPrefix(out, "HALTED") {
+		t.Errorf("expected HALTED, got %q", out)
+	}
+	out := sys.Command("STEP 2")
+	if sys.CPU.Registers[0] != 6 || sys.CPU.Registers[7] != 01006 {
+		t.Errorf("expected R0 = 6 and PC = 001006, got R0 = %06o and PC = %06o",
+			sys.CPU.Registers[0], sys.CPU.Registers[7])
+	}
+	if sys.CPU.State != unibus.HALT {
+		t.Errorf("expected CPU to stay halted after STEP")
+	}
+	if !strings.Contains(out, "001006:") {
+		t.Errorf("expected next instruction in the output, got %q", out)
+	}
+
+	sys.Command("CONTINUE")
+	if sys.CPU.State != unibus.CPURUN {
+		t.Errorf("expected CPU to run after CONTINUE")
+	}
+}
+
+func TestCommandShowDevices(t *testing.T) {
+	out := sys.Command("SHOW DEVICES")
+	for _, name := range []string{"RK11", "KW11", "DL11", "PSW"} {
+		if !strings.Contains(out, name) {
+			t.Errorf("expected %s in the device list, got:\n%s", name, out)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package system
+
+import (
+	"errors"
+	"pdp/unibus"
+)
+
+// Debugger access to the machine, used by the gdb stub.
+// Memory is accessed through the current MMU mapping,
+// registers are R0 - R7 followed by the PSW.
+
+// Halts returns the channel notified every time the CPU halts
+func (sys *System) Halts() <-chan struct{} {
+	return sys.halts
+}
+
+// notifyHalt notifies the debugger, without waiting for it
+func (sys *System) notifyHalt() {
+	select {
+	case sys.halts <- struct{}{}:
+	default:
+	}
+}
+
+// StepInstruction executes a single instruction on the halted CPU
+func (sys *System) StepInstruction() error {
+	var err error
+	sys.Do(func() {
+		err = sys.stepHalted(1)
+	})
+	return err
+}
+
+// stepHalted runs n instructions on the halted CPU, one at a time.
+// HALT instruction ends the stepping.
+func (sys *System) stepHalted(n int) error {
+	if sys.CPU.State != unibus.HALT {
+		return errors.New("CPU is running, HALT it first")
+	}
+	for i := 0; i < n; i++ {
+		sys.CPU.State = unibus.CPURUN
+		sys.step()
+		if sys.CPU.State == unibus.HALT {
+			break
+		}
+	}
+	sys.CPU.State = unibus.HALT
+	return nil
+}
+
+// Registers returns R0 - R7 and the PSW
+func (sys *System) Registers() []uint16 {
+	regs := make([]uint16, 9)
+	sys.Do(func() {
+		copy(regs, sys.CPU.Registers[:])
+		regs[8] = sys.psw.Get()
+	})
+	return regs
+}
+
+// SetRegister sets R0 - R7, or the PSW for n == 8
+func (sys *System) SetRegister(n int, value uint16) error {
+	if n < 0 || n > 8 {
+		return errors.New("invalid register number")
+	}
+	var err error
+	sys.Do(func() {
+		if n < 8 {
+			sys.CPU.Registers[n] = value
+			return
+		}
+		err = sys.guarded(func() { sys.unibus.WriteIO(sys.unibus.IOAddress(unibus.PSWAddr), value) })
+	})
+	return err
+}
+
+// ReadMemory reads a byte from the virtual address
+func (sys *System) ReadMemory(addr uint16) (byte, error) {
+	var (
+		val byte
+		err error
+	)
+	sys.Do(func() {
+		err = sys.debugAccess(func() { val = sys.unibus.Mmu.ReadMemoryByte(addr) })
+	})
+	return val, err
+}
+
+// WriteMemory writes a byte to the virtual address
+func (sys *System) WriteMemory(addr uint16, value byte) error {
+	var err error
+	sys.Do(func() {
+		err = sys.debugAccess(func() { sys.unibus.Mmu.WriteMemoryByte(addr, value) })
+	})
+	return err
+}
+
+// SetBreakpoint sets the breakpoint at the virtual address
+func (sys *System) SetBreakpoint(addr uint16) {
+	sys.Do(func() {
+		if sys.breakpoints == nil {
+			sys.breakpoints = make(map[uint16]bool)
+		}
+		sys.breakpoints[addr] = true
+	})
+}
+
+// ClearBreakpoint removes the breakpoint at the virtual address
+func (sys *System) ClearBreakpoint(addr uint16) {
+	sys.Do(func() {
+		delete(sys.breakpoints, addr)
+	})
+}
+
+// checkBreakpoint halts the CPU before it executes the instruction at the breakpoint.
+// The first instruction after continue doesn't stop, or the CPU would never leave the breakpoint.
+func (sys *System) checkBreakpoint() {
+	if sys.CPU.State == unibus.CPURUN && !sys.resumed && sys.breakpoints[sys.CPU.Registers[7]] {
+		sys.CPU.State = unibus.HALT
+	}
+	sys.resumed = false
+}
+
+// disassemble reads and disassembles the instruction at PC
+func (sys *System) disassemble() (instr uint16, text string, err error) {
+	pc := sys.CPU.Registers[7]
+	err = sys.debugAccess(func() {
+		instr = sys.unibus.ReadIO(sys.unibus.Mmu.Decode(pc, false, sys.psw.GetMode()))
+		// Disasm expects PC pointing behind the instruction
+		sys.CPU.Registers[7] += 2
+		defer func() { sys.CPU.Registers[7] = pc }()
+		text = sys.unibus.Disasm(instr)
+	})
+	return instr, text, err
+}
+
+// debugAccess runs f accessing memory through the MMU. The MMU aborts are returned
+// as the error, and are not recorded in SR0 - SR2, as the guest didn't cause them.
+func (sys *System) debugAccess(f func()) error {
+	mmu := sys.unibus.Mmu
+	sr0, sr1, sr2 := mmu.GetSR0(), mmu.GetSR1(), mmu.GetSR2()
+	defer func() {
+		mmu.SetSR0(sr0)
+		mmu.SetSR1(sr1)
+		mmu.SetSR2(sr2)
+	}()
+	return sys.guarded(f)
+}
@@ -0,0 +1,109 @@
+package system
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"pdp/config"
+	"pdp/interrupts"
+	"pdp/unibus"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakpoint(t *testing.T) {
+	l := log.New(os.Stdout, "PDP: ", log.LstdFlags)
+	s, err := InitializeSystem(config.Default(), c, nil, nil, nil, false, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// loop: INC R0; BR loop
+	s.unibus.Memory[01000>>1] = 005200
+	s.unibus.Memory[01002>>1] = 000776
+	s.CPU.Registers[7] = 01000
+	s.SetBreakpoint(01002)
+	go s.Run()
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case <-s.Halts():
+		case <-time.After(5 * time.Second):
+			t.Fatal("CPU didn't stop at the breakpoint")
+		}
+		regs := s.Registers()
+		if regs[7] != 01002 || regs[0] != uint16(i) {
+			t.Errorf("expected stop at 001002 with R0 = %d, got PC = %06o, R0 = %d", i, regs[7], regs[0])
+		}
+		if err := s.Continue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.ClearBreakpoint(01002)
+	s.Halt()
+	<-s.Halts()
+	if err := s.StepInstruction(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.ReadMemory(01003); err != nil || b != 01 {
+		t.Errorf("expected high byte of BR, got %03o (%v)", b, err)
+	}
+}
+
+func TestTraceCompare(t *testing.T) {
+	dir := t.TempDir()
+	tracePath := filepath.Join(dir, "run.trace")
+	refPath := filepath.Join(dir, "ref.trace")
+
+	// MOV #5, R0; INC R0; INC R0; HALT
+	code := []uint16{012700, 5, 005200, 005200, 0}
+	run := func() {
+		for i, c := range code {
+			sys.unibus.Memory[01000>>1+i] = c
+		}
+		sys.CPU.Registers[0] = 0
+		sys.CPU.Registers[7] = 01000
+		sys.CPU.State = unibus.CPURUN
+		for sys.CPU.State == unibus.CPURUN {
+			sys.step()
+		}
+	}
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+
+	if err := sys.StartTrace(tracePath); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if err := sys.StopTrace(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "PC=001004 IR=005200 R0=000005") {
+		t.Fatalf("unexpected trace:\n%s", data)
+	}
+
+	// reference differs in the second INC
+	ref := strings.Replace(string(data), "PC=001006 IR=005200 R0=000006", "PC=001006 IR=005200 R0=000007", 1)
+	if err := os.WriteFile(refPath, []byte(ref), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.StartCompare(refPath); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if sys.CPU.Registers[7] != 01006 || sys.CPU.Registers[0] != 6 {
+		t.Errorf("expected CPU to halt before the diverging instruction, PC = %06o, R0 = %d",
+			sys.CPU.Registers[7], sys.CPU.Registers[0])
+	}
+	if err := sys.StopTrace(); err != nil {
+		t.Fatal(err)
+	}
+	sys.CPU.State = unibus.CPURUN
+}
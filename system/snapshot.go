@@ -0,0 +1,83 @@
+package system
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"pdp/unibus"
+)
+
+/*
+	Machine snapshots.
+	The file is a gob stream: snapshot header first, followed by the machine state.
+	Header is decoded on its own, so the version mismatch is reported before
+	the state decoding fails in a less obvious way.
+*/
+
+const (
+	snapshotMagic = "PDP11-SNAPSHOT"
+
+	// snapshotVersion has to be incremented with every change of the unibus.MachineState layout
+	snapshotVersion = 10
+)
+
+type snapshotHeader struct {
+	Magic   string
+	Version int
+	Model   string
+}
+
+// SaveSnapshot writes the machine state to the file
+func (sys *System) SaveSnapshot(path string) error {
+	var state *unibus.MachineState
+	sys.Do(func() {
+		state = sys.unibus.SaveState()
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	if err := enc.Encode(snapshotHeader{Magic: snapshotMagic, Version: snapshotVersion, Model: sys.model}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := enc.Encode(state); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadSnapshot restores the machine state saved by SaveSnapshot
+func (sys *System) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil || header.Magic != snapshotMagic {
+		return fmt.Errorf("%s is not a snapshot file", path)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported, expected %d", header.Version, snapshotVersion)
+	}
+	if header.Model != sys.model {
+		return fmt.Errorf("snapshot of PDP-%s can't be restored on PDP-%s", header.Model, sys.model)
+	}
+
+	state := new(unibus.MachineState)
+	if err := dec.Decode(state); err != nil {
+		return fmt.Errorf("can't read snapshot: %w", err)
+	}
+
+	sys.Do(func() {
+		err = sys.unibus.RestoreState(state)
+		sys.stopped = sys.CPU.State == unibus.HALT
+	})
+	return err
+}
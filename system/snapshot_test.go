@@ -0,0 +1,86 @@
+package system
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"pdp/interrupts"
+	"pdp/unibus"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pdp.snap")
+
+	sys.unibus.Memory[0100] = 0123456
+	sys.CPU.Registers = [8]uint16{1, 2, 3, 4, 5, 6, 07000, 01000}
+	sys.CPU.UserStackPointer = 0177000
+	sys.psw.Set(017)
+	sys.unibus.WriteIO(unibus.KernelPagesAddr+040, 01234) // KPAR0
+	sys.unibus.Mmu.SetSR0(1)
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+	sys.unibus.SendInterrupt(5, interrupts.IntRK)
+	sys.unibus.WriteIO(0777410, 02000) // RKBA
+	saved := sys.unibus.SaveState()
+
+	if err := sys.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// scramble the machine:
+	sys.unibus.Memory[0100] = 0
+	sys.CPU.Registers = [8]uint16{}
+	sys.CPU.UserStackPointer = 0
+	sys.psw.Set(0)
+	sys.unibus.WriteIO(unibus.KernelPagesAddr+040, 0)
+	sys.unibus.Mmu.SetSR0(0)
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+	sys.unibus.WriteIO(0777410, 0)
+
+	if err := sys.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := sys.unibus.SaveState()
+
+	if restored.Memory[0100] != 0123456 {
+		t.Errorf("memory not restored")
+	}
+	if restored.Registers != saved.Registers || restored.UserStackPointer != saved.UserStackPointer {
+		t.Errorf("expected registers %v, got %v", saved.Registers, restored.Registers)
+	}
+	if restored.PSW != 017 {
+		t.Errorf("expected PSW 017, got %06o", restored.PSW)
+	}
+	if restored.MMU.Pages[0] != saved.MMU.Pages[0] || restored.MMU.SR0 != 1 {
+		t.Errorf("MMU not restored: %v", restored.MMU)
+	}
+	if restored.InterruptQueue[0].Vector != interrupts.IntRK {
+		t.Errorf("interrupt queue not restored")
+	}
+	if restored.RK.RKBA != 02000 {
+		t.Errorf("expected RKBA 02000, got %o", restored.RK.RKBA)
+	}
+
+	sys.unibus.Mmu.SetSR0(0)
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+	sys.psw.Set(0)
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.snap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(snapshotHeader{Magic: snapshotMagic, Version: 0, Model: sys.model}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := sys.LoadSnapshot(path); err == nil {
+		t.Errorf("expected old snapshot version to be rejected")
+	}
+	if err := sys.LoadSnapshot(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected missing file error")
+	}
+}
@@ -1,14 +1,17 @@
 package system
 
 import (
+	"errors"
 	"fmt"
-	"go/build"
 	"log"
-	"path/filepath"
+	"os"
+	"pdp/config"
 	"pdp/console"
 	"pdp/interrupts"
 	"pdp/psw"
 	"pdp/unibus"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jroimartin/gocui"
 )
@@ -18,6 +21,9 @@ type System struct {
 	CPU *unibus.CPU
 	psw psw.PSW
 
+	// CPU model, as in the configuration
+	model string
+
 	// Unibus
 	unibus *unibus.Unibus
 	log    *log.Logger
@@ -26,68 +32,280 @@ type System struct {
 	console      console.Console
 	terminalView *gocui.View
 	regView      *gocui.View
+
+	// operator requests, executed by the emulation loop between two instructions
+	requests chan func()
+	pending  atomic.Int32
+
+	// locked by the emulation loop for all its life.
+	// Until it starts, Do executes the requests directly.
+	loop sync.Mutex
+
+	// the operator has been told about the halt
+	stopped bool
+	halts   chan struct{}
+
+	// debugger breakpoints, virtual addresses.
+	// resumed is set by continue, to leave the breakpoint
+	breakpoints map[uint16]bool
+	resumed     bool
+
+	// instruction trace, or nil
+	tracer    Tracer
+	traceFile *os.File
 }
 
 var (
-	clockCounter uint16
-	trapDebug    = true
+	trapDebug = true
 )
 
-// InitializeSystem initializes the emulated PDP-11/40 hardware
+// InitializeSystem initializes the emulated PDP-11 hardware described by the configuration
 func InitializeSystem(
-	c console.Console, terminalView, regView *gocui.View, gui *gocui.Gui, debugMode bool, log *log.Logger) *System {
+	conf *config.Config,
+	c console.Console, terminalView, regView *gocui.View, gui *gocui.Gui, debugMode bool, log *log.Logger) (*System, error) {
 	sys := new(System)
 	sys.console = c
 	sys.terminalView = terminalView
 	sys.regView = regView
 	sys.log = log
+	sys.model = conf.Model
 
 	// unibus
 	sys.unibus = unibus.New(&sys.psw, gui, &c, debugMode, log)
-	sys.unibus.PdpCPU.Reset()
-
-	// mount drive
-	fp := filepath.Join(build.Default.GOPATH, "src/pdp11/rk0")
-	fmt.Printf("Disk image path: %s\n", fp)
-	if err := sys.unibus.Rk01.Attach(0, fp); err != nil {
-		panic("Can't mount the drive")
+	model, ok := unibus.Models[conf.Model]
+	if !ok {
+		return nil, fmt.Errorf("unsupported CPU model %s", conf.Model)
+	}
+	if err := sys.unibus.SetModel(model); err != nil {
+		return nil, err
+	}
+	if err := sys.unibus.SetMemorySize(conf.Memory); err != nil {
+		return nil, err
 	}
 
-	sys.unibus.Rk01.Reset()
+	if err := sys.attachDevices(conf); err != nil {
+		return nil, err
+	}
+	sys.unibus.PdpCPU.Reset()
 	_ = sys.console.WriteConsole("Initializing PDP11 CPU.\n")
 
 	sys.CPU = sys.unibus.PdpCPU
 	sys.CPU.State = unibus.CPURUN
-	return sys
+
+	// plain console shares the keyboard with the teletype
+	if in, ok := c.(interface{ Input() chan<- uint8 }); ok {
+		sys.unibus.TermEmulator.SetConsoleInput(in.Input())
+	}
+	sys.requests = make(chan func())
+	sys.halts = make(chan struct{}, 1)
+	go sys.commandLoop()
+	return sys, nil
+}
+
+// attachDevices attaches configured devices to the unibus, and mounts the disk images
+func (sys *System) attachDevices(conf *config.Config) error {
+	for _, d := range conf.Devices {
+		switch d.Name {
+		case "rk11":
+			sys.unibus.Rk01 = unibus.NewRK(sys.unibus)
+			if err := sys.unibus.RegisterDevice(sys.unibus.Rk01); err != nil {
+				return err
+			}
+			for _, u := range d.Units {
+				if err := sys.attachUnit(sys.unibus.Rk01, "rk", u); err != nil {
+					return err
+				}
+			}
+		case "rl11":
+			sys.unibus.Rl = unibus.NewRL(sys.unibus)
+			if err := sys.unibus.RegisterDevice(sys.unibus.Rl); err != nil {
+				return err
+			}
+			for _, u := range d.Units {
+				if err := sys.attachUnit(sys.unibus.Rl, "rl", u); err != nil {
+					return err
+				}
+			}
+		case "rh11":
+			sys.unibus.Rh = unibus.NewRH(sys.unibus)
+			if err := sys.unibus.RegisterDevice(sys.unibus.Rh); err != nil {
+				return err
+			}
+			for _, u := range d.Units {
+				if err := sys.attachUnit(sys.unibus.Rh, "rp", u); err != nil {
+					return err
+				}
+			}
+		case "tm11":
+			sys.unibus.Tm = unibus.NewTM(sys.unibus)
+			if err := sys.unibus.RegisterDevice(sys.unibus.Tm); err != nil {
+				return err
+			}
+			for _, u := range d.Units {
+				if err := sys.attachUnit(sys.unibus.Tm, "mt", u); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown device %s", d.Name)
+		}
+	}
+	return nil
+}
+
+// diskController is a controller the disk or tape images are attached to
+type diskController interface {
+	Attach(drive int, path string) error
+	AttachReadOnly(drive int, path string) error
+	SetDriveType(drive int, driveType string) error
+	DetachAll() error
+}
+
+// attachUnit attaches the image to the unit of the disk controller. name is the prefix of the unit names.
+func (sys *System) attachUnit(d diskController, name string, u config.Unit) error {
+	var err error
+	if u.ReadOnly {
+		err = d.AttachReadOnly(u.Number, u.Path)
+	} else {
+		err = d.Attach(u.Number, u.Path)
+	}
+	if err == nil {
+		err = d.SetDriveType(u.Number, u.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("can't attach %s to %s%d: %w", u.Path, name, u.Number, err)
+	}
+	mode := "rw"
+	if u.ReadOnly {
+		mode = "ro"
+	}
+	_ = sys.console.WriteConsole(fmt.Sprintf("%s%d: %s (%s)\n", name, u.Number, u.Path, mode))
+	return nil
+}
+
+// Shutdown closes the trace and all attached disk and tape images
+func (sys *System) Shutdown() error {
+	err := sys.StopTrace()
+	for _, d := range sys.diskControllers() {
+		if e := d.DetachAll(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// diskControllers returns all configured disk and tape controllers
+func (sys *System) diskControllers() []diskController {
+	var controllers []diskController
+	if sys.unibus.Rk01 != nil {
+		controllers = append(controllers, sys.unibus.Rk01)
+	}
+	if sys.unibus.Rl != nil {
+		controllers = append(controllers, sys.unibus.Rl)
+	}
+	if sys.unibus.Rh != nil {
+		controllers = append(controllers, sys.unibus.Rh)
+	}
+	if sys.unibus.Tm != nil {
+		controllers = append(controllers, sys.unibus.Tm)
+	}
+	return controllers
 }
 
 // Run system
 func (sys *System) Run() {
-	for {
-		sys.run()
+	sys.loop.Lock()
+	sys.run()
+}
+
+// Do executes f in the emulation loop, between two instructions, and waits until it's done.
+// While the system is running, the operator can access the machine only this way.
+func (sys *System) Do(f func()) {
+	if sys.loop.TryLock() {
+		defer sys.loop.Unlock()
+		f()
+		return
 	}
+
+	done := make(chan struct{})
+	sys.pending.Add(1)
+	sys.requests <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// serve waits for a single operator request and executes it
+func (sys *System) serve() {
+	f := <-sys.requests
+	sys.pending.Add(-1)
+	f()
 }
 
 // actually run the system
 func (sys *System) run() {
-	defer func() {
-		t := recover()
-		switch t := t.(type) {
-		case interrupts.Trap:
-			sys.log.Printf("SENDING TRAP %o in the run sys.run : %s\n", t.Vector, t.Msg)
-			sys.trap(t)
-		case nil:
-			// ignore
-		default:
-			panic(t)
+	for {
+		if len(sys.breakpoints) != 0 {
+			sys.checkBreakpoint()
 		}
-	}()
 
-	for {
+		// halted CPU waits for the operator
+		if sys.CPU.State == unibus.HALT && !sys.stopped {
+			sys.stopped = true
+			_ = sys.console.WriteConsole(fmt.Sprintf("HALT at %06o\n", sys.CPU.Registers[7]))
+			sys.unibus.TermEmulator.GrabKeyboard()
+			_ = sys.flushTrace()
+			sys.notifyHalt()
+		}
+		if sys.pending.Load() != 0 || sys.CPU.State == unibus.HALT {
+			sys.serve()
+			continue
+		}
+		sys.stopped = false
 		sys.step()
 	}
 }
 
+// Halt stops the CPU after the instruction in progress
+func (sys *System) Halt() {
+	sys.Do(func() {
+		sys.CPU.State = unibus.HALT
+		sys.stopped = true
+		sys.notifyHalt()
+	})
+}
+
+// Halted returns true if the CPU is halted
+func (sys *System) Halted() bool {
+	var halted bool
+	sys.Do(func() {
+		halted = sys.CPU.State == unibus.HALT
+	})
+	return halted
+}
+
+// Continue resumes the halted CPU at the current PC
+func (sys *System) Continue() error {
+	var err error
+	sys.Do(func() {
+		if sys.CPU.State != unibus.HALT {
+			err = errors.New("CPU is not halted")
+			return
+		}
+		sys.CPU.State = unibus.CPURUN
+		sys.resumed = true
+	})
+	return err
+}
+
+// initialize - console INIT: reset the CPU and all devices, drop pending interrupts
+func (sys *System) initialize() {
+	sys.CPU.Reset()
+	sys.psw.Set(0)
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+}
+
 // single cpu step:
 func (sys *System) step() {
 	// handle interrupts
@@ -102,94 +320,53 @@ func (sys *System) step() {
 		return
 	}
 
+	if sys.tracer != nil {
+		sys.traceInstruction()
+		if sys.CPU.State == unibus.HALT {
+			return
+		}
+	}
+
 	// execute next CPU instruction
 	sys.CPU.Execute()
-	clockCounter++
-	if clockCounter >= 40000 {
-		clockCounter = 0
-		sys.unibus.LKS |= 1 << 7
-		if sys.unibus.LKS&(1<<6) != 0 {
-			sys.unibus.SendInterrupt(6, interrupts.IntCLOCK)
-		}
+	if t, ok := sys.unibus.TakeTrap(); ok {
+		sys.log.Printf("SENDING TRAP %o: %s\n", t.Vector, t.Msg)
+		sys.trap(t)
 	}
-	sys.unibus.Rk01.Step()
-	sys.unibus.TermEmulator.Step()
+	sys.unibus.StepDevices()
 }
 
 // process interrupt in the cpu interrupt queue
-//  1. push current PSW and PC to stack
-//  2. load PC from interrupt vector
-//  3. load PSW from (interrupt vector) + 2
-//  4. if the previous state mode was User, then set the corresponding bits in PSW
-//  5. Return from subprocedure cpu instruction at the end of the interrupt procedure
+//  1. load PC from interrupt vector, and PSW from (interrupt vector) + 2
+//  2. push current PSW and PC to the stack of the mode selected by the new PSW
+//  3. the mode the CPU was in becomes the previous mode of the new PSW
+//  4. Return from subprocedure cpu instruction at the end of the interrupt procedure
 //     makes sure to set the stack and PSW back to where it belongs
 func (sys *System) processInterrupt(interrupt interrupts.Interrupt) {
-	defer func() {
-		t := recover()
-		switch t := t.(type) {
-		case interrupts.Trap:
-			sys.log.Printf("SENDING TRAP %o while processing interrupt: %s\n", t.Vector, t.Msg)
-			sys.trap(t)
-		case nil:
-			break
-		default:
-			panic(t)
-		}
-
-		sys.CPU.Registers[7] = sys.unibus.Mmu.ReadMemoryWord(interrupt.Vector)
-		intPSW := sys.unibus.Mmu.ReadMemoryWord(interrupt.Vector + 2)
-
-		if (intPSW & (1 << 14)) != 0 {
-			fmt.Printf("ALERT: Fetched Interrupt PSW is in user mode")
-		}
-
-		if sys.unibus.Psw.GetPreviousMode() == psw.UserMode {
-			intPSW |= (1 << 13) | (1 << 12)
-		}
-		sys.psw.Set(intPSW)
-		sys.CPU.State = unibus.CPURUN
-	}()
-
-	// DEBUG: push to interrupt stack
-	//if interrupt.Vector != interrupts.IntCLOCK {
-	//	fmt.Printf("processing interrupt with the vector 0%o\n", interrupt.Vector)
-	//}
-	//sys.unibus.InterruptStack.Push(interrupt)
-
 	if interrupt.Vector != interrupts.IntCLOCK {
 		sys.log.Printf("processing interrupt with the vector 0%o\n", interrupt.Vector)
-
 	}
 
 	if sys.psw.GetMode() == psw.UserMode {
 		fmt.Printf("User mode interrupt\n")
 	}
 
-	prev := sys.psw.Get()
-	sys.CPU.SwitchMode(psw.KernelMode)
-	sys.CPU.Push(prev)
-	sys.CPU.Push(sys.CPU.Registers[7])
+	pc, ps := sys.CPU.ReadVector(interrupt.Vector)
+	sys.CPU.PushTrapFrame(sys.psw.Get(), ps)
+	if t, ok := sys.unibus.TakeTrap(); ok {
+		// stack is broken, the interrupt is lost
+		sys.log.Printf("SENDING TRAP %o while processing interrupt: %s\n", t.Vector, t.Msg)
+		sys.trap(t)
+		return
+	}
+	sys.CPU.Registers[7] = pc
+	sys.CPU.State = unibus.CPURUN
 }
 
 // Trap handles all Trap / abort events.
+// Red zone stack reference, or the trap that can't push the PC and PSW on the stack is the fatal stack error:
+// the SP is set to 4, PSW and PC are pushed to 2 and 0, leaving SP at 0, and the CPU traps to 4.
 func (sys *System) trap(trap interrupts.Trap) {
-	var prevPSW uint16
-	defer func() {
-		t := recover()
-		switch t := t.(type) {
-		case interrupts.Trap:
-			fmt.Printf("RED STACK TRAP!")
-			sys.unibus.Memory[0] = sys.CPU.Registers[7]
-			sys.unibus.Memory[1] = prevPSW
-			trap.Vector = 4
-			panic("FATAL")
-		case nil:
-			break
-		default:
-			panic(t)
-		}
-	}()
-
 	if trapDebug {
 		fmt.Printf("TRAP %o occured: %s\n", trap.Vector, trap.Msg)
 	}
@@ -198,14 +375,17 @@ func (sys *System) trap(trap interrupts.Trap) {
 		panic("Trap called with odd vector number!")
 	}
 
-	prevPSW = sys.psw.Get()
-	sys.CPU.SwitchMode(psw.KernelMode)
-	sys.CPU.Push(prevPSW)
-	sys.CPU.Push(sys.CPU.Registers[7])
-
-	sys.CPU.Registers[7] = sys.unibus.ReadIO(unibus.Uint18(trap.Vector))
-	sys.unibus.Psw.Set(sys.unibus.ReadIO(unibus.Uint18(trap.Vector) + 2))
-	if sys.CPU.IsPrevModeUser() { // user mode
-		sys.psw.Set(sys.psw.Get() | (1 << 13) | (1 << 12))
+	prevPSW := sys.psw.Get()
+	if !sys.CPU.TakeRedStack() {
+		pc, ps := sys.CPU.ReadVector(trap.Vector)
+		sys.CPU.PushTrapFrame(prevPSW, ps)
+		t, ok := sys.unibus.TakeTrap()
+		if !ok {
+			sys.CPU.Registers[7] = pc
+			return
+		}
+		sys.CPU.TakeRedStack()
+		sys.log.Printf("RED STACK TRAP while sending trap %o: %s\n", trap.Vector, t.Msg)
 	}
+	sys.CPU.RedStackTrap(prevPSW)
 }
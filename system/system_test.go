@@ -1,15 +1,18 @@
 package system
 
 import (
-	"go/build"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"pdp/config"
 	"pdp/console"
 	"pdp/interrupts"
 	"pdp/psw"
+	"pdp/testutil"
 	"pdp/unibus"
 	"testing"
+	"time"
 )
 
 // global resources
@@ -21,21 +24,42 @@ var (
 // TestMain : initialize memory and CPU
 func TestMain(m *testing.M) {
 	l := log.New(os.Stdout, "PDP: ", log.LstdFlags)
-	sys = new(System)
-	sys.log = l
 	c = console.NewSimple()
-	sys.unibus = unibus.New(&sys.psw, nil, &c, false, l)
 
-	sys.unibus.PdpCPU.Reset()
-	if err := sys.unibus.Rk01.Attach(0, filepath.Join(build.Default.GOPATH, "src/pdp11/rk0")); err != nil {
-		panic("Can't mount the drive")
+	// blank RK05 image, just to have a drive to attach
+	dir, err := os.MkdirTemp("", "pdp11")
+	if err != nil {
+		panic(err)
+	}
+	image := filepath.Join(dir, "rk0")
+	if err := os.WriteFile(image, make([]byte, 512*12*2*203), 0644); err != nil {
+		panic(err)
 	}
-	sys.unibus.Rk01.Reset()
 
-	sys.CPU = sys.unibus.PdpCPU
-	sys.CPU.State = unibus.CPURUN
+	// the bootstrap skips the first record of the tape, and starts the second one read to 0
+	program := []byte{
+		0300, 025, 0234, 02, // MOV #1234, R0
+		0, 0, // HALT
+	}
+	tape := filepath.Join(dir, "boot.tap")
+	if err := os.WriteFile(tape, testutil.TapeImage([]byte{1, 2}, program), 0644); err != nil {
+		panic(err)
+	}
+
+	conf := config.Default()
+	conf.Devices = []config.Device{
+		{Name: "rk11", Units: []config.Unit{{Number: 0, Path: image}}},
+		{Name: "tm11", Units: []config.Unit{{Number: 1, Path: tape, ReadOnly: true}}},
+	}
+	sys, err = InitializeSystem(conf, c, nil, nil, nil, false, l)
+	if err != nil {
+		panic(err)
+	}
 
-	os.Exit(m.Run())
+	code := m.Run()
+	_ = sys.Shutdown()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 var virtualAddressTests = []struct {
@@ -233,3 +257,334 @@ func TestInterruptHandling(t *testing.T) {
 }
 
 // test interrupt handling when CPU in user mode
+
+func TestInitializeSystemErrors(t *testing.T) {
+	l := log.New(os.Stdout, "PDP: ", log.LstdFlags)
+	image := filepath.Join(t.TempDir(), "rl0")
+	if err := os.WriteFile(image, make([]byte, 256), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		conf config.Config
+	}{
+		{"unsupported model", config.Config{Model: "11/03", Memory: config.DefaultMemory}},
+		{"too much memory", config.Config{Model: config.DefaultModel, Memory: 4 * 1024 * 1024}},
+		{"unknown device", config.Config{Model: config.DefaultModel, Memory: config.DefaultMemory,
+			Devices: []config.Device{{Name: "foo11"}}}},
+		{"missing image", config.Config{Model: config.DefaultModel, Memory: config.DefaultMemory,
+			Devices: []config.Device{{Name: "rk11", Units: []config.Unit{{Number: 0, Path: "foo.bar.rk5"}}}}}},
+		{"invalid drive type", config.Config{Model: config.DefaultModel, Memory: config.DefaultMemory,
+			Devices: []config.Device{{Name: "rl11", Units: []config.Unit{{Number: 0, Path: image, Type: "rk05"}}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := InitializeSystem(&tt.conf, c, nil, nil, nil, false, l); err == nil {
+				t.Errorf("expected InitializeSystem to fail")
+			}
+		})
+	}
+}
+
+func TestHaltInUserMode(t *testing.T) {
+	sys.CPU.State = unibus.CPURUN
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+	sys.CPU.KernelStackPointer = 01000
+	sys.unibus.Memory[04>>1] = 03000 // bus error trap handler
+	sys.unibus.Memory[06>>1] = 0340
+	sys.unibus.Memory[02000>>1] = 0 // HALT
+
+	sys.CPU.SwitchMode(psw.UserMode)
+	sys.CPU.Registers[7] = 02000
+	sys.step()
+
+	if sys.CPU.State != unibus.CPURUN {
+		t.Errorf("HALT in user mode must not stop the CPU")
+	}
+	if sys.CPU.Registers[7] != 03000 {
+		t.Errorf("expected trap to 03000, got PC %06o", sys.CPU.Registers[7])
+	}
+	if sys.psw.GetMode() != unibus.KernelMode {
+		t.Errorf("expected kernel mode after the trap")
+	}
+	sys.psw.Set(0)
+}
+
+func TestHaltParksRunLoop(t *testing.T) {
+	l := log.New(os.Stdout, "PDP: ", log.LstdFlags)
+	s, err := InitializeSystem(config.Default(), c, nil, nil, nil, false, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := []uint16{
+		012700, 1, // MOV #1, R0
+		0,      // HALT
+		005200, // INC R0
+		0,      // HALT
+	}
+	for i, c := range code {
+		s.unibus.Memory[01000>>1+i] = c
+	}
+	s.CPU.Registers[7] = 01000
+	go s.Run()
+
+	waitHalt := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for !s.Halted() {
+			if time.Now().After(deadline) {
+				t.Fatal("CPU didn't halt")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitHalt()
+	var r0, pc uint16
+	s.Do(func() { r0, pc = s.CPU.Registers[0], s.CPU.Registers[7] })
+	if r0 != 1 || pc != 01006 {
+		t.Errorf("expected R0 = 1, PC = 001006 after the first HALT, got R0 = %06o, PC = %06o", r0, pc)
+	}
+
+	if err := s.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	waitHalt()
+	s.Do(func() { r0, pc = s.CPU.Registers[0], s.CPU.Registers[7] })
+	if r0 != 2 || pc != 01012 {
+		t.Errorf("expected R0 = 2, PC = 001012 after continue, got R0 = %06o, PC = %06o", r0, pc)
+	}
+}
+
+func TestRedStackTrap(t *testing.T) {
+	sys.psw.Set(0)
+	sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+	sys.unibus.Memory[04>>1] = 03000 // bus error vector
+	sys.unibus.Memory[06>>1] = 0340
+
+	// EMT with the odd kernel stack pointer
+	sys.unibus.Memory[02000>>1] = 0104000
+	sys.CPU.Registers[6] = 0701
+	sys.CPU.Registers[7] = 02000
+	sys.CPU.State = unibus.CPURUN
+	sys.step()
+
+	if sys.CPU.Registers[7] != 03000 || sys.psw.Get() != 0340 {
+		t.Errorf("expected trap to 003000 with PSW 000340, got PC %06o, PSW %06o",
+			sys.CPU.Registers[7], sys.psw.Get())
+	}
+	if sys.CPU.Registers[6] != 0 || sys.unibus.Memory[0] != 02002 || sys.unibus.Memory[1] != 0 {
+		t.Errorf("expected PC and PSW saved at 0, got SP %06o, (0) = %06o, (2) = %06o",
+			sys.CPU.Registers[6], sys.unibus.Memory[0], sys.unibus.Memory[1])
+	}
+	sys.psw.Set(0)
+}
+
+func TestStackLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		sp     uint16
+		stored bool
+		red    bool
+	}{
+		{"above the yellow zone", 0402, true, false},
+		{"yellow zone", 0400, true, false},
+		{"red zone", 0340, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sys.psw.Set(0)
+			sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+			sys.unibus.Memory[04>>1] = 03000 // bus error vector
+			sys.unibus.Memory[06>>1] = 0340
+			sys.unibus.Memory[02000>>1] = 010046 // MOV R0,-(SP)
+			sys.unibus.Memory[0] = 0
+			sys.CPU.Registers[0] = 0123
+			sys.CPU.Registers[6] = tt.sp
+			sys.CPU.Registers[7] = 02000
+			sys.CPU.State = unibus.CPURUN
+			sys.step()
+			defer sys.psw.Set(0)
+
+			if got := sys.unibus.Memory[(tt.sp-2)>>1] == 0123; got != tt.stored {
+				t.Errorf("R0 stored = %v, want %v", got, tt.stored)
+			}
+			yellow := tt.sp-2 < 0400 && !tt.red
+			switch {
+			case tt.red:
+				if sys.CPU.Registers[7] != 03000 || sys.CPU.Registers[6] != 0 || sys.unibus.Memory[0] != 02002 {
+					t.Errorf("expected red stack trap, got PC %06o, SP %06o, (0) = %06o",
+						sys.CPU.Registers[7], sys.CPU.Registers[6], sys.unibus.Memory[0])
+				}
+			case yellow:
+				if sys.CPU.Registers[7] != 03000 || sys.CPU.Registers[6] != tt.sp-6 ||
+					sys.unibus.Memory[(tt.sp-6)>>1] != 02002 {
+					t.Errorf("expected yellow stack trap, got PC %06o, SP %06o", sys.CPU.Registers[7], sys.CPU.Registers[6])
+				}
+			default:
+				if sys.CPU.Registers[7] != 02002 || sys.CPU.Registers[6] != tt.sp-2 {
+					t.Errorf("unexpected trap, PC %06o, SP %06o", sys.CPU.Registers[7], sys.CPU.Registers[6])
+				}
+			}
+		})
+	}
+}
+
+func TestTraceTrap(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint16
+		// steps to the trace trap, and the PC it saves
+		steps   int
+		savedPC uint16
+	}{
+		{"RTI traps right after the return", 0000002, 1, 02000},
+		{"RTT traps after the next instruction", 0000006, 2, 02002},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sys.psw.Set(0)
+			sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+			sys.unibus.Memory[014>>1] = 03000 // trace trap vector
+			sys.unibus.Memory[016>>1] = 0340
+			sys.unibus.Memory[02000>>1] = 005200 // INC R0
+			sys.unibus.Memory[04000>>1] = tt.instruction
+
+			// return to 2000 with the T bit set
+			sys.unibus.Memory[0674>>1] = 02000
+			sys.unibus.Memory[0676>>1] = 020
+			sys.CPU.Registers[6] = 0674
+			sys.CPU.Registers[7] = 04000
+			sys.CPU.State = unibus.CPURUN
+			defer sys.psw.Set(0)
+
+			for i := 0; i < tt.steps; i++ {
+				sys.step()
+			}
+			if sys.CPU.Registers[7] != 03000 || sys.psw.Get() != 0340 {
+				t.Fatalf("expected trace trap, got PC %06o, PSW %06o", sys.CPU.Registers[7], sys.psw.Get())
+			}
+			if sys.unibus.Memory[0674>>1] != tt.savedPC || sys.unibus.Memory[0676>>1]&020 == 0 {
+				t.Errorf("trace trap saved PC %06o, PSW %06o", sys.unibus.Memory[0674>>1], sys.unibus.Memory[0676>>1])
+			}
+		})
+	}
+
+	t.Run("PSW write doesn't set the T bit", func(t *testing.T) {
+		sys.psw.Set(0)
+		sys.unibus.WriteIO(sys.unibus.IOAddress(unibus.PSWAddr), 037)
+		if got := sys.psw.Get(); got != 017 {
+			t.Errorf("expected PSW 000017, got %06o", got)
+		}
+		sys.psw.Set(0)
+	})
+}
+
+func TestInvalidInstructionTrap(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint16
+		vector      uint16
+	}{
+		{"reserved instruction", 0000010, 010},
+		{"unused opcode", 0007000, 010},
+		{"floating point", 0170011, 010},
+		{"JMP to register", 0000101, 04},
+		{"JSR to register", 0004701, 04},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sys.psw.Set(0)
+			sys.unibus.InterruptQueue = interrupts.InterruptQueue{}
+			sys.unibus.Memory[04>>1] = 03000
+			sys.unibus.Memory[06>>1] = 0340
+			sys.unibus.Memory[010>>1] = 04000
+			sys.unibus.Memory[012>>1] = 0340
+
+			sys.unibus.Memory[02000>>1] = tt.instruction
+			sys.CPU.Registers[1] = 0
+			sys.CPU.Registers[6] = 0700
+			sys.CPU.Registers[7] = 02000
+			sys.CPU.State = unibus.CPURUN
+			sys.step()
+
+			want := sys.unibus.Memory[tt.vector>>1]
+			if sys.CPU.Registers[7] != want || sys.CPU.Registers[6] != 0674 {
+				t.Errorf("expected trap to %06o with SP 000674, got PC %06o, SP %06o",
+					want, sys.CPU.Registers[7], sys.CPU.Registers[6])
+			}
+			if sys.unibus.Memory[0674>>1] != 02002 || sys.CPU.Registers[1] != 0 {
+				t.Errorf("expected saved PC 002002 and R1 unchanged, got %06o, R1 %06o",
+					sys.unibus.Memory[0674>>1], sys.CPU.Registers[1])
+			}
+		})
+	}
+	sys.psw.Set(0)
+}
+
+// benchmarkSystem returns the system with the program loaded at 01000, and the kernel stack at 0700
+func benchmarkSystem(b *testing.B, code map[uint16]uint16) *System {
+	s, err := InitializeSystem(config.Default(), c, nil, nil, nil, false, log.New(io.Discard, "", 0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for addr, v := range code {
+		s.unibus.Memory[addr>>1] = v
+	}
+	s.CPU.Registers[6] = 0700
+	s.CPU.Registers[7] = 01000
+
+	debug := trapDebug
+	trapDebug = false
+	b.Cleanup(func() { trapDebug = debug })
+	return s
+}
+
+// BenchmarkInstructions - INC R0; BR .-2
+func BenchmarkInstructions(b *testing.B) {
+	s := benchmarkSystem(b, map[uint16]uint16{01000: 005200, 01002: 000776})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.step()
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
+
+// BenchmarkTrap - every loop iteration traps on the odd address, the handler returns with RTI
+func BenchmarkTrap(b *testing.B) {
+	s := benchmarkSystem(b, map[uint16]uint16{
+		01000: 005737, 01002: 1, // TST @#1
+		01004: 000775, // BR 01000
+		02000: 000002, // RTI
+		04:    02000, 06: 0,
+	})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// TST, trap, RTI, BR
+		for j := 0; j < 3; j++ {
+			s.step()
+		}
+	}
+	if s.CPU.Registers[6] != 0700 {
+		b.Fatalf("unbalanced stack, SP = %06o", s.CPU.Registers[6])
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "traps/s")
+}
+
+func TestTapeBoot(t *testing.T) {
+	defer func() { sys.CPU.State = unibus.CPURUN }()
+
+	if err := sys.loadBootstrap("mt", 0); err == nil {
+		t.Errorf("expected error booting from the missing tape")
+	}
+	if err := sys.loadBootstrap("mt", 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000 && sys.CPU.State == unibus.CPURUN; i++ {
+		sys.step()
+	}
+	if sys.CPU.State != unibus.HALT || sys.CPU.Registers[0] != 01234 || sys.CPU.Registers[7] != 6 {
+		t.Errorf("expected HALT at 4 with R0 = 1234, got R0 %06o, PC %06o",
+			sys.CPU.Registers[0], sys.CPU.Registers[7])
+	}
+}
@@ -0,0 +1,103 @@
+package system
+
+import (
+	"errors"
+	"io"
+	"os"
+	"pdp/trace"
+	"pdp/unibus"
+)
+
+// number of instructions preceding the trace divergence shown in the report
+const compareContext = 20
+
+// Tracer receives the machine state before every executed instruction.
+// The error returned by the tracer halts the CPU, and it is reported on the console.
+type Tracer interface {
+	Trace(r trace.Record) error
+}
+
+// SetTracer starts tracing the executed instructions, nil stops it
+func (sys *System) SetTracer(t Tracer) {
+	sys.Do(func() {
+		sys.tracer = t
+	})
+}
+
+// StartTrace writes the trace of the executed instructions to the file
+func (sys *System) StartTrace(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return sys.setTrace(trace.NewWriter(f), f)
+}
+
+// StartCompare compares the executed instructions with the reference trace file,
+// and halts the CPU at the first difference
+func (sys *System) StartCompare(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return sys.setTrace(trace.NewComparator(f, compareContext), f)
+}
+
+// StopTrace stops tracing, and closes the trace file
+func (sys *System) StopTrace() error {
+	return sys.setTrace(nil, nil)
+}
+
+// setTrace replaces the tracer, closing the previous trace file
+func (sys *System) setTrace(t Tracer, f *os.File) error {
+	var err error
+	sys.Do(func() {
+		err = sys.flushTrace()
+		if sys.traceFile != nil {
+			if e := sys.traceFile.Close(); err == nil {
+				err = e
+			}
+		}
+		sys.tracer, sys.traceFile = t, f
+	})
+	return err
+}
+
+// flushTrace writes out the buffered trace records
+func (sys *System) flushTrace() error {
+	if f, ok := sys.tracer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// traceInstruction passes the state before the instruction at PC to the tracer
+func (sys *System) traceInstruction() {
+	if sys.CPU.State != unibus.CPURUN {
+		return
+	}
+	instr, text, err := sys.disassemble()
+	if err != nil {
+		// instruction fetch is going to trap, nothing gets executed
+		return
+	}
+
+	r := trace.Record{
+		PC:   sys.CPU.Registers[7],
+		IR:   instr,
+		SP:   sys.CPU.Registers[6],
+		PSW:  sys.psw.Get(),
+		Text: text,
+	}
+	copy(r.Registers[:], sys.CPU.Registers[:6])
+
+	if err := sys.tracer.Trace(r); err != nil {
+		sys.tracer = nil
+		sys.CPU.State = unibus.HALT
+		if errors.Is(err, io.EOF) {
+			_ = sys.console.WriteConsole("end of the reference trace\n")
+			return
+		}
+		_ = sys.console.WriteConsole(err.Error())
+	}
+}
@@ -208,7 +208,7 @@ func (t *Full) WriteTerm(address uint32, data uint16) error {
 		if data == 13 {
 			break
 		}
-		t.consoleOut <- string(data & 0x7F)
+		t.consoleOut <- string(rune(data & 0x7F))
 		<-t.done
 
 		t.TPS &= 0xFF7F
@@ -243,6 +243,6 @@ func (t *Full) ReadTerm(address uint32) (uint16, error) {
 	}
 }
 
+// AddChar - not implemented, the keystrokes are read from the view editor
 func (t *Full) AddChar(c byte) {
-	fmt.Errorf("not implemented")
 }
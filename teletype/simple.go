@@ -5,9 +5,14 @@ import (
 	"log"
 	"os"
 	"pdp/interrupts"
+	"sync"
 	//"pdp/logger"
 )
 
+// ConsoleEscape - keystroke switching the keyboard from the terminal
+// to the system control console (Ctrl-E)
+const ConsoleEscape = 005
+
 // Simple type  - simplest terminal emulator possible.
 type Simple struct {
 	KeyboardInput chan uint8
@@ -35,6 +40,12 @@ type Simple struct {
 
 	interruptQueue *interrupts.InterruptQueue
 
+	// keyboard routing to the control console.
+	// stdin runs in its own goroutine, hence the mutex
+	keyboard     sync.Mutex
+	consoleInput chan<- uint8
+	consoleMode  bool
+
 	log *log.Logger
 }
 
@@ -104,7 +115,9 @@ func (t *Simple) stdin() {
 		n, err := os.Stdin.Read(b[:])
 		if n == 1 {
 			t.log.Println("Registered keystroke", string(b[:n]))
-			t.KeyboardInput <- b[0]
+			if input := t.route(b[0]); input != nil {
+				input <- b[0]
+			}
 		}
 		if err != nil {
 			log.Fatal(err)
@@ -112,6 +125,57 @@ func (t *Simple) stdin() {
 	}
 }
 
+// route returns the channel the keystroke has to be sent to,
+// or nil if the keystroke only switches the keyboard to the console.
+func (t *Simple) route(b byte) chan<- uint8 {
+	t.keyboard.Lock()
+	defer t.keyboard.Unlock()
+
+	if t.consoleInput == nil {
+		return t.KeyboardInput
+	}
+	if b == ConsoleEscape {
+		t.consoleMode = true
+		return nil
+	}
+	if t.consoleMode {
+		return t.consoleInput
+	}
+	return t.KeyboardInput
+}
+
+// SetConsoleInput sets the channel receiving keystrokes in the console mode
+func (t *Simple) SetConsoleInput(input chan<- uint8) {
+	t.keyboard.Lock()
+	defer t.keyboard.Unlock()
+	t.consoleInput = input
+}
+
+// GrabKeyboard switches the keyboard to the console, if there is one
+func (t *Simple) GrabKeyboard() {
+	t.keyboard.Lock()
+	defer t.keyboard.Unlock()
+	t.consoleMode = t.consoleInput != nil
+}
+
+// ReleaseKeyboard switches the keyboard back to the terminal
+func (t *Simple) ReleaseKeyboard() {
+	t.keyboard.Lock()
+	defer t.keyboard.Unlock()
+	t.consoleMode = false
+}
+
+// State returns the teletype registers
+func (t *Simple) State() State {
+	return State{TKS: t.TKS, TPS: t.TPS, TKB: t.TKB, TPB: t.TPB, Ready: t.ready, Count: t.count}
+}
+
+// SetState restores the teletype registers
+func (t *Simple) SetState(s State) {
+	t.TKS, t.TPS, t.TKB, t.TPB = s.TKS, s.TPS, s.TKB, s.TPB
+	t.ready, t.count = s.Ready, s.Count
+}
+
 // ClearTerminal - reset terminal
 func (t *Simple) ClearTerminal() {
 	t.TKS = 0
@@ -10,4 +10,24 @@ type Teletype interface {
 	ClearTerminal()
 
 	AddChar(c byte)
+
+	// SetConsoleInput sets the channel receiving the keystrokes
+	// after the operator switches the keyboard to the control console
+	SetConsoleInput(input chan<- uint8)
+
+	// GrabKeyboard switches the keyboard to the control console,
+	// ReleaseKeyboard switches it back to the terminal
+	GrabKeyboard()
+	ReleaseKeyboard()
+
+	// State returns the teletype registers, SetState restores them
+	State() State
+	SetState(s State)
+}
+
+// State - serializable state of the teletype
+type State struct {
+	TKS, TPS, TKB, TPB uint16
+	Ready              bool
+	Count              uint8
 }
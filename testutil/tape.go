@@ -0,0 +1,22 @@
+// Package testutil has the helpers shared by the tests of several packages
+package testutil
+
+import "bytes"
+
+// TapeImage builds SIMH tape image: nil is the tape mark
+func TapeImage(records ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		n := []byte{byte(len(r)), byte(len(r) >> 8), 0, 0}
+		buf.Write(n)
+		if len(r) == 0 {
+			continue
+		}
+		buf.Write(r)
+		if len(r)&1 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.Write(n)
+	}
+	return buf.Bytes()
+}
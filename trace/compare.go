@@ -0,0 +1,108 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Comparator compares the executed instructions with the reference trace
+type Comparator struct {
+	ref *Reader
+
+	// last matching records, kept for the report
+	context int
+	history []Record
+
+	// Instruction is the number of compared instructions
+	Instruction int
+}
+
+// NewComparator returns the comparator reading the reference trace.
+// context is the number of instructions preceding the difference shown in the report.
+func NewComparator(ref io.Reader, context int) *Comparator {
+	return &Comparator{ref: NewReader(ref), context: context}
+}
+
+// Divergence - the first difference between the traces
+type Divergence struct {
+	// Instruction is the number of the instruction, counting from 1.
+	// Line is the reference trace line.
+	Instruction, Line int
+	Got, Want         Record
+	Fields            []string
+
+	// History - instructions preceding the difference
+	History []Record
+}
+
+// Error returns the divergence report
+func (d *Divergence) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "trace diverges at instruction %d (reference line %d) in %s\n",
+		d.Instruction, d.Line, strings.Join(d.Fields, ", "))
+	sb.WriteString("preceding instructions:\n")
+	for _, r := range d.History {
+		fmt.Fprintf(&sb, "  %s\n", r)
+	}
+	fmt.Fprintf(&sb, "emulator:  %s\n", d.Got)
+	fmt.Fprintf(&sb, "reference: %s\n", d.Want)
+	return sb.String()
+}
+
+// Trace compares the record with the next reference record.
+// It returns *Divergence on the first difference, and io.EOF at the end of the reference trace.
+func (c *Comparator) Trace(r Record) error {
+	want, err := c.ref.Next()
+	if err != nil {
+		return err
+	}
+	c.Instruction++
+
+	if diff := Diff(r, want); diff != nil {
+		return &Divergence{
+			Instruction: c.Instruction,
+			Line:        c.ref.Line,
+			Got:         r,
+			Want:        want,
+			Fields:      diff,
+			History:     append([]Record(nil), c.history...),
+		}
+	}
+
+	c.history = keep(c.history, r, c.context)
+	return nil
+}
+
+// keep appends the record, and keeps at most n last records
+func keep(h []Record, r Record, n int) []Record {
+	if n == 0 {
+		return h
+	}
+	if len(h) == n {
+		copy(h, h[1:])
+		h = h[:n-1]
+	}
+	return append(h, r)
+}
+
+// Compare compares the whole trace with the reference trace.
+// It returns nil if the traces match up to the end of the shorter one.
+func Compare(trace, ref io.Reader, context int) (int, error) {
+	c := NewComparator(ref, context)
+	r := NewReader(trace)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return c.Instruction, nil
+		}
+		if err != nil {
+			return c.Instruction, err
+		}
+		if err := c.Trace(rec); err == io.EOF {
+			return c.Instruction, nil
+		} else if err != nil {
+			return c.Instruction, err
+		}
+	}
+}
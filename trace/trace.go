@@ -0,0 +1,211 @@
+// Package trace writes and compares instruction traces.
+//
+// The trace has one line per executed instruction, with the machine state before the instruction,
+// all values octal, in the SimH-like "name=value" form:
+//
+//	PC=002002 IR=012706 R0=000000 R1=000000 R2=000000 R3=000000 R4=000000 R5=000000 SP=000000 PSW=000340 ; MOV $002000, SP
+//
+// Everything after the semicolon is informational, and it is ignored when the traces are compared.
+// Lines starting with '#' and empty lines are skipped, as are the fields the parser doesn't know,
+// so the reference traces produced by other emulators only need to be converted to this layout.
+//
+// The output of the SimH "SHOW CPU HISTORY" command is read as it is:
+//
+//	PC     PSW     src    dst     IR
+//
+//	002000 000340|002000 000000 MOV #2000,SP
+//
+// The history has PC, PSW and the disassembled instruction only, so the other fields
+// are left out of the comparison. The header line and the "sim>" prompts are skipped.
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Record - machine state before the execution of a single instruction
+type Record struct {
+	PC, IR    uint16
+	Registers [6]uint16 // R0 - R5
+	SP, PSW   uint16
+
+	// Text is the disassembled instruction
+	Text string
+
+	// missing - fields not present in the trace, bit per field in the trace order
+	missing uint16
+}
+
+// field names, in the trace order
+var fields = [...]string{"PC", "IR", "R0", "R1", "R2", "R3", "R4", "R5", "SP", "PSW"}
+
+// values returns pointers to the record fields, in the trace order
+func (r *Record) values() [len(fields)]*uint16 {
+	return [...]*uint16{
+		&r.PC, &r.IR,
+		&r.Registers[0], &r.Registers[1], &r.Registers[2], &r.Registers[3], &r.Registers[4], &r.Registers[5],
+		&r.SP, &r.PSW}
+}
+
+// String formats the record as a trace line
+func (r Record) String() string {
+	var sb strings.Builder
+	for i, v := range r.values() {
+		if r.missing&(1<<i) != 0 {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%s=%06o", fields[i], *v)
+	}
+	if r.Text != "" {
+		sb.WriteString(" ; ")
+		sb.WriteString(r.Text)
+	}
+	return sb.String()
+}
+
+// Parse parses a single trace line. PC and IR are mandatory, unless the line is SimH history entry.
+func Parse(line string) (Record, error) {
+	if strings.Contains(line, "|") {
+		return parseHistory(line)
+	}
+
+	var r Record
+	line, r.Text, _ = strings.Cut(line, ";")
+	r.Text = strings.TrimSpace(r.Text)
+
+	values := r.values()
+	seen := 0
+	for _, f := range strings.Fields(line) {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+		for i, n := range fields {
+			if strings.EqualFold(n, name) {
+				v, err := strconv.ParseUint(value, 8, 16)
+				if err != nil {
+					return r, fmt.Errorf("invalid %s value %q", name, value)
+				}
+				*values[i] = uint16(v)
+				seen |= 1 << i
+			}
+		}
+	}
+	if seen&3 != 3 {
+		return r, fmt.Errorf("PC or IR missing in %q", line)
+	}
+	r.missing = (1<<len(fields) - 1) &^ uint16(seen)
+	return r, nil
+}
+
+// historyColumns - width of the src and dst columns in the SimH history
+const historyColumns = 14
+
+// parseHistory parses SimH history entry: "PC PSW|src dst instruction",
+// where the src and dst columns are blank for instructions without the operands
+func parseHistory(line string) (Record, error) {
+	r := Record{missing: 1<<len(fields) - 1}
+	state, text, _ := strings.Cut(line, "|")
+	f := strings.Fields(state)
+	if len(f) != 2 {
+		return r, fmt.Errorf("PC or PSW missing in %q", line)
+	}
+	for i, p := range []*uint16{&r.PC, &r.PSW} {
+		v, err := strconv.ParseUint(f[i], 8, 16)
+		if err != nil {
+			return r, fmt.Errorf("invalid history value %q", f[i])
+		}
+		*p = uint16(v)
+	}
+	r.missing &^= 1<<0 | 1<<9 // PC, PSW
+
+	if len(text) > historyColumns {
+		text = text[historyColumns:]
+	}
+	r.Text = strings.TrimSpace(text)
+	return r, nil
+}
+
+// skipped returns true for the lines without a record: empty lines, comments,
+// SimH prompts and the SimH history header
+func skipped(line string) bool {
+	return line == "" || line[0] == '#' || strings.HasPrefix(line, "sim>") ||
+		strings.HasPrefix(line, "PC ") && !strings.ContainsAny(line, "=|")
+}
+
+// Diff returns names of the fields different in the two records.
+// Fields missing in either of the records are not compared.
+func Diff(a, b Record) []string {
+	var diff []string
+	va, vb := a.values(), b.values()
+	for i := range fields {
+		if (a.missing|b.missing)&(1<<i) != 0 {
+			continue
+		}
+		if *va[i] != *vb[i] {
+			diff = append(diff, fields[i])
+		}
+	}
+	return diff
+}
+
+// Writer writes the trace, one record per line
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns the trace writer. Flush has to be called at the end.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Trace writes the record
+func (t *Writer) Trace(r Record) error {
+	_, err := fmt.Fprintln(t.w, r.String())
+	return err
+}
+
+// Flush writes the buffered records
+func (t *Writer) Flush() error {
+	return t.w.Flush()
+}
+
+// Reader reads the trace records
+type Reader struct {
+	s *bufio.Scanner
+
+	// Line is the number of the last line read
+	Line int
+}
+
+// NewReader returns the trace reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{s: bufio.NewScanner(r)}
+}
+
+// Next returns the next record, or io.EOF at the end of the trace
+func (t *Reader) Next() (Record, error) {
+	for t.s.Scan() {
+		t.Line++
+		line := strings.TrimSpace(t.s.Text())
+		if skipped(line) {
+			continue
+		}
+		r, err := Parse(line)
+		if err != nil {
+			return r, fmt.Errorf("line %d: %w", t.Line, err)
+		}
+		return r, nil
+	}
+	if err := t.s.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
@@ -0,0 +1,114 @@
+package trace
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	r := Record{PC: 02002, IR: 012706, Registers: [6]uint16{1, 2, 3, 4, 5, 0177777}, SP: 01000, PSW: 0340, Text: "MOV $002000, SP"}
+	line := r.String()
+	want := "PC=002002 IR=012706 R0=000001 R1=000002 R2=000003 R3=000004 R4=000005 R5=177777 SP=001000 PSW=000340 ; MOV $002000, SP"
+	if line != want {
+		t.Errorf("expected %q, got %q", want, line)
+	}
+
+	parsed, err := Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != r {
+		t.Errorf("expected %v, got %v", r, parsed)
+	}
+
+	// unknown fields and the order don't matter:
+	parsed, err = Parse("IR=000240 CYCLE=12 PC=001000 psw=000004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PC != 01000 || parsed.IR != 0240 || parsed.PSW != 4 {
+		t.Errorf("unexpected record %v", parsed)
+	}
+
+	for _, line := range []string{"R0=000000", "PC=001000 IR=9", "PC=1234567 IR=0"} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("%q: expected parse error", line)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	got := "# emulator\nPC=001000 IR=012700 R0=000000\nPC=001004 IR=005200 R0=000005\nPC=001006 IR=000000 R0=000006\n"
+	ref := "PC=001000 IR=012700 R0=000000\n\nPC=001004 IR=005200 R0=000005\nPC=001006 IR=000000 R0=000007\n"
+
+	n, err := Compare(strings.NewReader(got), strings.NewReader(ref), 1)
+	var d *Divergence
+	if !errors.As(err, &d) {
+		t.Fatalf("expected divergence, got %v", err)
+	}
+	if n != 3 || d.Line != 4 || len(d.Fields) != 1 || d.Fields[0] != "R0" {
+		t.Errorf("unexpected divergence at %d, line %d in %v", n, d.Line, d.Fields)
+	}
+	if len(d.History) != 1 || d.History[0].PC != 01004 {
+		t.Errorf("expected single instruction context, got %v", d.History)
+	}
+
+	// fields missing in the reference are not compared
+	n, err = Compare(strings.NewReader("PC=001000 IR=012700 R0=000005 R1=000001\n"),
+		strings.NewReader("PC=001000 IR=012700 R0=000005\n"), 1)
+	if err != nil || n != 1 {
+		t.Errorf("expected match ignoring the missing R1, got %d, %v", n, err)
+	}
+
+	// shorter reference is not an error
+	n, err = Compare(strings.NewReader(got), strings.NewReader("PC=001000 IR=012700\n"), 1)
+	if err != nil || n != 1 {
+		t.Errorf("expected match of 1 instruction, got %d, %v", n, err)
+	}
+}
+
+// simhHistory is SimH "SHOW CPU HISTORY" excerpt
+const simhHistory = `sim> show cpu history=4
+PC     PSW     src    dst     IR
+
+002000 000340|002000 000000 MOV #2000,SP
+002004 000340|       001000 CLR R0
+002006 000344|              BR 2012
+002012 000344|000000 000000 MOV R0,R1
+`
+
+func TestParse_History(t *testing.T) {
+	r, err := Parse("002004 000340|       001000 CLR R0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PC != 02004 || r.PSW != 0340 || r.Text != "CLR R0" {
+		t.Errorf("unexpected record %v", r)
+	}
+	if s := r.String(); s != "PC=002004 PSW=000340 ; CLR R0" {
+		t.Errorf("unexpected history record %q", s)
+	}
+
+	for _, line := range []string{"002004|", "002004 000340 000001|", "00200x 000340|"} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("%q: expected parse error", line)
+		}
+	}
+}
+
+func TestCompare_History(t *testing.T) {
+	got := "PC=002000 IR=012706 R0=000005 SP=000000 PSW=000340\n" +
+		"PC=002004 IR=005000 R0=000005 SP=002000 PSW=000340\n" +
+		"PC=002006 IR=000402 R0=000000 SP=002000 PSW=000344\n" +
+		"PC=002012 IR=010001 R0=000000 SP=002000 PSW=000340\n"
+
+	n, err := Compare(strings.NewReader(got), strings.NewReader(simhHistory), 0)
+	var d *Divergence
+	if !errors.As(err, &d) {
+		t.Fatalf("expected divergence, got %v", err)
+	}
+	if n != 4 || d.Line != 7 || len(d.Fields) != 1 || d.Fields[0] != "PSW" || d.Want.Text != "MOV R0,R1" {
+		t.Errorf("unexpected divergence at %d, line %d in %v: %v", n, d.Line, d.Fields, d.Want)
+	}
+}
@@ -18,6 +18,9 @@ const (
 // KernelMode - kernel cpu mode const
 const KernelMode = 0
 
+// SupervisorMode - supervisor cpu mode const, 11/70 only
+const SupervisorMode = 1
+
 // UserMode - user cpu mode const
 const UserMode = 3
 
@@ -32,23 +35,58 @@ type CPU struct {
 	Registers [8]uint16
 	State     CpuState
 
-	KernelStackPointer, UserStackPointer uint16
+	KernelStackPointer, SupervisorStackPointer, UserStackPointer uint16
+
+	// StackLimit - lower limit of the kernel stack, set in the stack limit register (11/45, 11/70).
+	// Only the upper byte is used. Without the register the limit is 0: the kernel stack ends at 0400.
+	StackLimit uint16
 
 	unibus *Unibus
 	mmunit MMU
 	log    *log.Logger
 
-	// instructions is a map, where key is the opcode,
-	// and value is the function executing it
-	// the opcode function should append to the following signature:
-	// param: instruction int16
-	// return: error -> nil if everything went OK
-	singleOpOpcodes       map[uint16]func(uint16)
-	doubleOpOpcodes       map[uint16]func(uint16)
-	rddOpOpcodes          map[uint16]func(uint16)
-	controlOpcodes        map[uint16]func(uint16)
-	singleRegisterOpcodes map[uint16]func(uint16)
-	otherOpcodes          map[uint16]func(uint16)
+	// state at the beginning of the instruction, the instruction aborted by a trap rolls back to it
+	start instructionStart
+
+	// instruction for every instruction word
+	table *dispatchTable
+
+	// floating point processor, nil if not installed
+	fpp *FPP
+
+	// stack reference in the yellow zone, the instruction traps to 4 when it's completed
+	stackWarning bool
+
+	// stack reference in the red zone, or the trap that couldn't push its frame
+	redStack bool
+
+	// RTI restored the T bit: trace trap follows the instruction. RTT restored the T bit:
+	// the trace trap waits for the next instruction.
+	traceTrap, traceInhibit bool
+}
+
+// kernel stack zones above the stack limit
+const (
+	// yellowZone - stack reference below the limit + 0400 completes, and traps to 4
+	yellowZone = 0400
+
+	// redZone - stack reference below the limit + 0340 aborts, and the CPU takes the red stack trap
+	redZone = 0340
+)
+
+// instructionStart keeps the CPU state at the beginning of the instruction.
+// The aborted instruction leaves only the auto increments and decrements recorded in SR1,
+// so that the trap handler can restart it.
+type instructionStart struct {
+	registers                      [8]uint16
+	kernelSP, supervisorSP, userSP uint16
+	psw                            uint16
+
+	// register changes recorded in SR1
+	delta [8]uint16
+
+	// PC at the moment of the abort
+	abortPC uint16
 }
 
 // NewCPU initializes and returns the CPU variable:
@@ -63,109 +101,8 @@ func NewCPU(mmunit MMU, unibus *Unibus, debugMode bool, log *log.Logger) *CPU {
 		debugQueue = NewQueue(1000)
 	}
 
-	// single operand
-	c.singleOpOpcodes = make(map[uint16]func(uint16))
-	c.doubleOpOpcodes = make(map[uint16]func(uint16))
-	c.rddOpOpcodes = make(map[uint16]func(uint16))
-	c.controlOpcodes = make(map[uint16]func(uint16))
-	c.otherOpcodes = make(map[uint16]func(uint16))
-	c.singleRegisterOpcodes = make(map[uint16]func(uint16))
-
-	// single opearnd:
-	c.singleOpOpcodes[0100] = c.jmpOp
-	c.singleOpOpcodes[0300] = c.swabOp
-	c.singleOpOpcodes[05000] = c.clrOp
-	c.singleOpOpcodes[0105000] = c.clrOp
-	c.singleOpOpcodes[05100] = c.comOp
-	c.singleOpOpcodes[0105100] = c.combOp
-	c.singleOpOpcodes[05200] = c.incOp
-	c.singleOpOpcodes[0105200] = c.incbOp
-	c.singleOpOpcodes[05300] = c.decOp
-	c.singleOpOpcodes[0105300] = c.decbOp
-	c.singleOpOpcodes[05400] = c.negOp
-	c.singleOpOpcodes[0105400] = c.negbOp
-	c.singleOpOpcodes[05500] = c.adcOp
-	c.singleOpOpcodes[0105500] = c.adcOp
-	c.singleOpOpcodes[05600] = c.sbcOp
-	c.singleOpOpcodes[0105600] = c.sbcbOp
-	c.singleOpOpcodes[05700] = c.tstOp
-	c.singleOpOpcodes[0105700] = c.tstbOp
-	c.singleOpOpcodes[06000] = c.rorOp
-	c.singleOpOpcodes[0106000] = c.rorbOp
-	c.singleOpOpcodes[06100] = c.rolOp
-	c.singleOpOpcodes[0106100] = c.rolbOp
-	c.singleOpOpcodes[06200] = c.asrOp
-	c.singleOpOpcodes[0106200] = c.asrbOp
-	c.singleOpOpcodes[06300] = c.aslOp
-	c.singleOpOpcodes[0106300] = c.aslbOp
-	c.singleOpOpcodes[06400] = c.markOp
-	c.singleOpOpcodes[06500] = c.mfpiOp
-	c.singleOpOpcodes[06600] = c.mtpiOp
-	c.singleOpOpcodes[06700] = c.sxtOp
-
-	// dual operand:
-	c.doubleOpOpcodes[010000] = c.movOp
-	c.doubleOpOpcodes[0110000] = c.movbOp
-	c.doubleOpOpcodes[020000] = c.cmpOp
-	c.doubleOpOpcodes[0120000] = c.cmpOp
-	c.doubleOpOpcodes[030000] = c.bitOp
-	c.doubleOpOpcodes[0130000] = c.bitbOp
-	c.doubleOpOpcodes[040000] = c.bicOp
-	c.doubleOpOpcodes[0140000] = c.bicbOp
-	c.doubleOpOpcodes[050000] = c.bisOp
-	c.doubleOpOpcodes[0150000] = c.bisbOp
-	c.doubleOpOpcodes[060000] = c.addOp
-	c.doubleOpOpcodes[0160000] = c.subOp
-
-	// RDD dual operand:
-	c.rddOpOpcodes[070000] = c.mulOp
-	c.rddOpOpcodes[071000] = c.divOp
-	c.rddOpOpcodes[072000] = c.ashOp
-	c.rddOpOpcodes[073000] = c.ashcOp
-	c.rddOpOpcodes[074000] = c.xorOp
-	c.rddOpOpcodes[04000] = c.jsrOp
-	c.rddOpOpcodes[077000] = c.sobOp
-
-	// control instructions & traps:
-	c.controlOpcodes[0400] = c.brOp
-	c.controlOpcodes[01000] = c.bneOp
-	c.controlOpcodes[01400] = c.beqOp
-	c.controlOpcodes[0100000] = c.bplOp
-	c.controlOpcodes[0100400] = c.bmiOp
-	c.controlOpcodes[0102000] = c.bvcOp
-	c.controlOpcodes[0102400] = c.bvsOp
-	c.controlOpcodes[0103000] = c.bccOp
-	c.controlOpcodes[0103400] = c.bcsOp
-	c.controlOpcodes[0104000] = c.emtOp
-	c.controlOpcodes[0104400] = c.trapOp
-
-	// conditional branching - signed int
-	c.controlOpcodes[02000] = c.bgeOp
-	c.controlOpcodes[02400] = c.bltOp
-	c.controlOpcodes[03000] = c.bgtOp
-	c.controlOpcodes[03400] = c.bleOp
-
-	// conditional branching - unsigned int
-	c.controlOpcodes[0101000] = c.bhiOp
-	c.controlOpcodes[0101400] = c.blosOp
-	c.controlOpcodes[0103000] = c.bhisOp
-	c.controlOpcodes[0103400] = c.bloOp
-
-	// single register and condition code opcodes
-	c.singleRegisterOpcodes[0200] = c.rtsOp
-	c.singleRegisterOpcodes[0240] = c.setFlagOp
-	c.singleRegisterOpcodes[0250] = c.setFlagOp
-	c.singleRegisterOpcodes[0260] = c.clearFlagOp
-	c.singleRegisterOpcodes[0270] = c.clearFlagOp
-
-	// no operand:
-	c.otherOpcodes[0] = c.haltOp
-	c.otherOpcodes[1] = c.waitOp
-	c.otherOpcodes[2] = c.rtiOp
-	c.otherOpcodes[3] = c.bptOp
-	c.otherOpcodes[4] = c.iotOp
-	c.otherOpcodes[5] = c.resetOp
-	c.otherOpcodes[6] = c.rttOp
+	c.setInstructions(Models[defaultModel])
+
 	return &c
 }
 
@@ -174,7 +111,7 @@ func NewCPU(mmunit MMU, unibus *Unibus, debugMode bool, log *log.Logger) *CPU {
 // Fetch next instruction from memory
 // Address to fetch is kept in R7 (PC)
 func (c *CPU) Fetch() uint16 {
-	physicalAddress := c.mmunit.Decode(c.Registers[7], false, c.IsUserMode())
+	physicalAddress := c.mmunit.Decode(c.Registers[7], false, c.unibus.Psw.GetMode())
 	instruction := c.unibus.ReadIO(physicalAddress)
 
 	c.Registers[7] += 2
@@ -182,77 +119,46 @@ func (c *CPU) Fetch() uint16 {
 }
 
 // Decode fetched instruction
-// if instruction matching the mask not found in the opcodes map, fallback and try
-// to match anything lower.
-// Fail ultimately.
+// returns the function executing it. Instructions not found in the instruction set
+// are executed by invalidOp.
 func (c *CPU) Decode(instr uint16) func(uint16) {
-	// 2 operand instructions:
-	var opcode uint16
-
-	if opcode = instr & 0170000; opcode > 0 {
-		if val, ok := c.doubleOpOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	// 2 operand instruction in RDD format
-	if opcode = instr & 0177000; opcode > 0 {
-		if val, ok := c.rddOpOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	// control instructions:
-	if opcode = instr & 0177400; opcode > 0 {
-		if val, ok := c.controlOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	// single operand opcodes
-	if opcode = instr & 0177700; opcode > 0 {
-		if val, ok := c.singleOpOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	// single register opcodes
-	if opcode = instr & 0177770; opcode > 0 {
-		if val, ok := c.singleRegisterOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	if opcode = instr & 07; opcode > 0 {
-		if val, ok := c.otherOpcodes[opcode]; ok {
-			return val
-		}
-	}
-
-	// haltOp has opcode of 0, easiest to treat it separately
-	if instr == 0 {
-		return c.otherOpcodes[0]
-	}
+	op := c.table[instr]
+	return func(i uint16) { op.exec(c, i) }
+}
 
-	// at this point it can be only an invalid instruction:
-	fmt.Printf("%s\n", c.printState(instr))
+// invalidOp - instruction word not matching any known instruction traps to 010.
+// In the debug mode, the CPU state and the recently executed instructions are dumped to the log.
+func (c *CPU) invalidOp(instr uint16) {
 	if debug {
+		c.log.Printf("Invalid instruction %06o\n%s\n", instr, c.printState(instr))
 		for !debugQueue.IsEmpty() {
 			i, e := debugQueue.Dequeue()
 			if e != nil {
-				_ = fmt.Errorf(e.Error())
+				break
 			}
-			fmt.Printf("%s\n", i)
+			c.log.Printf("%s", i)
 		}
+	}
+	c.unibus.Trap(interrupts.Trap{Vector: interrupts.IntINVAL, Msg: fmt.Sprintf("Invalid instruction %06o", instr)})
+}
 
+// illegalInstruction - known instruction with the operand it can't use, traps to 4.
+// The KB11 CPUs trap it to 010.
+func (c *CPU) illegalInstruction(msg string) {
+	vector := uint16(interrupts.IntBUS)
+	if c.unibus.Model.KB11 {
+		vector = interrupts.IntINVAL
 	}
-	// this should really never happen. replace with Fatalf, and the program will stop here
-	c.log.Fatalf("ERROR: Invalid instruction: %06o", instr)
-	panic(interrupts.Trap{Vector: interrupts.IntINVAL, Msg: "Invalid Instruction"})
+	c.unibus.Trap(interrupts.Trap{Vector: vector, Msg: "Illegal instruction: " + msg})
 }
 
 // Execute decoded instruction
 func (c *CPU) Execute() {
+	// halted CPU waits for the operator
+	if c.State == HALT {
+		return
+	}
+
 	if c.State == WAIT {
 		select {
 		case v, ok := <-c.unibus.KeyboardInput:
@@ -264,13 +170,57 @@ func (c *CPU) Execute() {
 		return
 	}
 
+	c.mmunit.InstructionStart(c.Registers[7])
+	c.saveStart()
 	instruction := c.Fetch()
+	if c.unibus.TrapPending() {
+		c.rollback()
+		return
+	}
 	if debug {
 		debugQueue.Enqueue(fmt.Sprintf("%s %s\n", c.printState(instruction), c.unibus.Disasm(instruction)))
 	}
 
-	opcode := c.Decode(instruction)
-	opcode(instruction)
+	c.table[instruction].exec(c, instruction)
+	if c.unibus.TrapPending() {
+		c.stackWarning = false
+		c.rollback()
+		return
+	}
+	if c.stackWarning {
+		c.stackWarning = false
+		c.trapOpcode(interrupts.IntBUS)
+	}
+
+	// trace trap follows every instruction started with the T bit set
+	traced := c.start.psw&020 != 0 || c.traceTrap
+	if traced && !c.traceInhibit && c.State == CPURUN && !c.unibus.TrapPending() {
+		c.trapOpcode(interrupts.TrapBRKPT)
+	}
+}
+
+// saveStart saves the state the aborted instruction rolls back to
+func (c *CPU) saveStart() {
+	c.start.registers = c.Registers
+	c.start.kernelSP, c.start.supervisorSP, c.start.userSP = c.KernelStackPointer, c.SupervisorStackPointer, c.UserStackPointer
+	c.start.psw = c.unibus.Psw.Get()
+	c.start.delta = [8]uint16{}
+	c.traceTrap, c.traceInhibit = false, false
+}
+
+// rollback undoes the instruction aborted by the trap. Registers keep the changes recorded in SR1,
+// and the PC points where the instruction was when the trap occurred.
+func (c *CPU) rollback() {
+	for i := 0; i < 7; i++ {
+		c.Registers[i] = c.start.registers[i] + c.start.delta[i]
+	}
+	c.Registers[7] = c.start.abortPC
+	c.KernelStackPointer, c.SupervisorStackPointer, c.UserStackPointer = c.start.kernelSP, c.start.supervisorSP, c.start.userSP
+	c.unibus.Psw.Set(c.start.psw)
+}
+
+func (c *CPU) isKernelMode() bool {
+	return c.unibus.Psw.GetMode() == KernelMode
 }
 
 func (c *CPU) IsUserMode() bool {
@@ -282,13 +232,20 @@ func (c *CPU) IsPrevModeUser() bool {
 }
 
 // readWord returns value specified by source or destination part of the operand.
+// The immediate operand (PC mode 2) is a part of the instruction stream, it is fetched from the I space.
 func (c *CPU) readWord(op uint16) uint16 {
+	if op&077 == 027 {
+		return c.Fetch()
+	}
 	addr := c.GetVirtualAddress(op, 0)
 	return c.mmunit.ReadMemoryWord(addr)
 }
 
-// read byte
+// read byte. The immediate byte is the low byte of the instruction stream word.
 func (c *CPU) readByte(op uint16) byte {
+	if op&077 == 027 {
+		return byte(c.Fetch())
+	}
 	addr := c.GetVirtualAddress(op, 1)
 	return c.mmunit.ReadMemoryByte(addr)
 }
@@ -355,7 +312,8 @@ func (c *CPU) GetFlag(flag string) bool {
 	return false
 }
 
-// SwitchMode switches the kernel / user mode:
+// SwitchMode switches the CPU to the kernel, supervisor or user mode.
+// The stack pointer of the current mode is saved, and the current mode becomes the previous mode in the PSW.
 func (c *CPU) SwitchMode(mode uint16) {
 	previousMode := c.unibus.Psw.GetMode()
 
@@ -363,38 +321,49 @@ func (c *CPU) SwitchMode(mode uint16) {
 		c.log.Printf("Switching CPU from %d to %d mode", previousMode, mode)
 	}
 
-	// save processor stack pointers:
-	if previousMode == UserMode {
-		c.UserStackPointer = c.Registers[6]
-	} else {
-		c.KernelStackPointer = c.Registers[6]
-	}
+	// save processor stack pointer, and set the stack of the new mode:
+	*c.stackPointer(previousMode) = c.Registers[6]
+	c.Registers[6] = *c.stackPointer(mode)
 
-	// set processor stack:
-	if mode == UserMode {
-		c.Registers[6] = c.UserStackPointer
-	} else {
-		c.Registers[6] = c.KernelStackPointer
-	}
-	*c.unibus.Psw &= 000777
-	if mode == UserMode {
-		*c.unibus.Psw |= (1 << 15) | (1 << 14)
+	c.unibus.Psw.Set(c.unibus.Psw.Get()&000777 | mode<<14 | previousMode<<12)
+}
+
+// stackPointer returns the saved stack pointer of the mode.
+// Mode 2 is undefined, it shares the stack pointer with the user mode.
+func (c *CPU) stackPointer(mode uint16) *uint16 {
+	switch mode {
+	case KernelMode:
+		return &c.KernelStackPointer
+	case SupervisorMode:
+		return &c.SupervisorStackPointer
 	}
-	if previousMode == UserMode {
-		*c.unibus.Psw |= (1 << 13) | (1 << 12)
+	return &c.UserStackPointer
+}
+
+// modeStackPointer returns the stack pointer of the mode, R6 if the mode is the current one
+func (c *CPU) modeStackPointer(mode uint16) *uint16 {
+	if mode == c.unibus.Psw.GetMode() {
+		return &c.Registers[6]
 	}
+	return c.stackPointer(mode)
 }
 
 func (c *CPU) GetVirtualAddress(instruction, accessMode uint16) uint16 {
 	addressInc := uint16(2)
-	reg := instruction & 7
-	addressMode := (instruction >> 3) & 7
-	var virtAddress uint16
 
 	// byte mode does not apply to the SP and PC
-	if accessMode == 1 && reg < 6 {
+	if accessMode == 1 && instruction&7 < 6 {
 		addressInc = 1
 	}
+	return c.operandAddress(instruction, addressInc)
+}
+
+// operandAddress returns the virtual address of the operand. Auto increment and decrement modes
+// change the register by addressInc, the length of the operand.
+func (c *CPU) operandAddress(instruction, addressInc uint16) uint16 {
+	reg := instruction & 7
+	addressMode := (instruction >> 3) & 7
+	var virtAddress uint16
 
 	switch addressMode {
 	case 0:
@@ -404,20 +373,32 @@ func (c *CPU) GetVirtualAddress(instruction, accessMode uint16) uint16 {
 		// register contains the address of the operand
 		virtAddress = c.Registers[reg]
 	case 2:
-		// register keeps the address. Increment the value by 2 (word!)
+		// register keeps the address. Increment the value by the operand length
 		virtAddress = c.Registers[reg]
 		c.Registers[reg] = c.Registers[reg] + addressInc
+		c.registerChanged(reg, int16(addressInc))
 	case 3:
 		// autoincrement deferred --> it doesn't look like byte mode applies here?
+		if reg == 7 {
+			// absolute address is a part of the instruction stream
+			virtAddress = c.Fetch()
+			break
+		}
 		virtAddress = c.mmunit.ReadMemoryWord(c.Registers[reg])
 		c.Registers[reg] = c.Registers[reg] + 2
+		c.registerChanged(reg, 2)
 	case 4:
 		// autodecrement - step depends on which register is in use:
 		c.Registers[reg] = c.Registers[reg] - addressInc
+		c.registerChanged(reg, -int16(addressInc))
 		virtAddress = c.Registers[reg]
+		if reg == 6 {
+			c.checkStack(virtAddress)
+		}
 	case 5:
 		// autodecrement deferred
 		c.Registers[reg] = c.Registers[reg] - 2
+		c.registerChanged(reg, -2)
 		virtAddress = c.mmunit.ReadMemoryWord(c.Registers[reg])
 	case 6:
 		// index mode -> read next word to get the basis for address, add value in Register
@@ -431,16 +412,95 @@ func (c *CPU) GetVirtualAddress(instruction, accessMode uint16) uint16 {
 	return virtAddress
 }
 
+// registerChanged reports the auto increment or decrement to the MMU (SR1).
+// PC changes are not recorded, PC of the instruction is kept in SR2.
+// Nothing is recorded after the abort, the rest of the instruction is going to be rolled back.
+func (c *CPU) registerChanged(reg uint16, delta int16) {
+	if reg != 7 && !c.unibus.TrapPending() {
+		c.start.delta[reg] += uint16(delta)
+		c.mmunit.RegisterChanged(reg, delta)
+	}
+}
+
 // Push to processor stack
 func (c *CPU) Push(v uint16) {
 	c.Registers[6] -= 2
+	c.registerChanged(6, -2)
+	c.checkStack(c.Registers[6])
 	c.mmunit.WriteMemoryWord(c.Registers[6], v)
 }
 
+// checkStack checks the kernel stack reference against the stack limit.
+// The reference in the yellow zone completes the instruction, the one in the red zone aborts it.
+func (c *CPU) checkStack(addr uint16) {
+	if c.unibus.Psw.GetMode() != KernelMode || c.unibus.TrapPending() {
+		return
+	}
+	limit := uint32(c.StackLimit & 0177400)
+	switch {
+	case uint32(addr) < limit+redZone:
+		c.redStack = true
+		c.unibus.Trap(interrupts.Trap{Vector: interrupts.IntBUS, Msg: fmt.Sprintf("Red zone stack reference %06o", addr)})
+	case uint32(addr) < limit+yellowZone:
+		c.stackWarning = true
+	}
+}
+
+// ReadVector reads the new PC and PSW of the trap or interrupt vector from the kernel data space
+func (c *CPU) ReadVector(vector uint16) (pc, ps uint16) {
+	pc = c.unibus.ReadIO(c.mmunit.DecodeData(vector, false, KernelMode))
+	ps = c.unibus.ReadIO(c.mmunit.DecodeData(vector+2, false, KernelMode))
+	return pc, ps
+}
+
+// PushTrapFrame switches the CPU to the mode of the new PSW, pushes the previous PSW and PC on its stack,
+// and loads the new PSW. The mode the CPU was in becomes the previous mode of the new PSW.
+// Stack references of the trap sequence are not recorded in SR1, and only the red zone is checked.
+// Trap that couldn't push its frame on the kernel stack ends with the red stack trap.
+func (c *CPU) PushTrapFrame(prevPSW, newPSW uint16) {
+	c.SwitchMode(newPSW >> 14)
+	if c.unibus.Psw.GetMode() == KernelMode && uint32(c.Registers[6]-4) < uint32(c.StackLimit&0177400)+redZone {
+		c.redStack = true
+		c.unibus.Trap(interrupts.Trap{Vector: interrupts.IntBUS,
+			Msg: fmt.Sprintf("Red zone stack reference %06o", c.Registers[6]-4)})
+		return
+	}
+	c.Registers[6] -= 2
+	c.mmunit.WriteMemoryWord(c.Registers[6], prevPSW)
+	c.Registers[6] -= 2
+	c.mmunit.WriteMemoryWord(c.Registers[6], c.Registers[7])
+	if c.unibus.TrapPending() {
+		c.redStack = c.unibus.Psw.GetMode() == KernelMode
+		return
+	}
+	c.unibus.Psw.Set(newPSW&^030000 | (prevPSW>>2)&030000)
+}
+
+// TakeRedStack returns true if the pending trap is the red stack trap, and clears it
+func (c *CPU) TakeRedStack() bool {
+	red := c.redStack
+	c.redStack = false
+	return red
+}
+
+// RedStackTrap handles the fatal stack error. The stack pointer is set to 4, the PSW and PC are pushed
+// to 2 and 0 through the kernel data space mapping, leaving SP at 0, and the CPU traps to 4 in the kernel mode.
+func (c *CPU) RedStackTrap(prevPSW uint16) {
+	c.SwitchMode(KernelMode)
+	c.unibus.WriteIO(c.mmunit.DecodeData(2, true, KernelMode), prevPSW)
+	c.unibus.WriteIO(c.mmunit.DecodeData(0, true, KernelMode), c.Registers[7])
+	c.Registers[6] = 0
+
+	pc, ps := c.ReadVector(interrupts.IntBUS)
+	c.unibus.Psw.Set(ps&^030000 | (prevPSW>>2)&030000)
+	c.Registers[7] = pc
+}
+
 // Pop from CPU stack
 func (c *CPU) Pop() uint16 {
 	val := c.mmunit.ReadMemoryWord(c.Registers[6])
 	c.Registers[6] += 2
+	c.registerChanged(6, 2)
 	return val
 }
 
@@ -449,14 +509,17 @@ func (c *CPU) Reset() {
 	for i := 0; i < 7; i++ {
 		c.Registers[i] = 0
 	}
-	for i := 0; i < 16; i++ {
-		c.mmunit.SetPage(i, page{par: 0, pdr: 0})
+	c.mmunit.Reset()
+	if c.fpp != nil {
+		c.fpp.Reset()
 	}
 
 	c.KernelStackPointer = 0
+	c.SupervisorStackPointer = 0
 	c.UserStackPointer = 0
-	c.mmunit.SetSR0(0)
-	c.unibus.Rk01.Reset()
+	c.StackLimit = 0
+	c.stackWarning, c.redStack = false, false
+	c.unibus.ResetDevices()
 	c.State = CPURUN
 }
 
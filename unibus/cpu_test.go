@@ -1,6 +1,7 @@
 package unibus
 
 import (
+	"io"
 	"log"
 	"os"
 	"pdp/console"
@@ -56,3 +57,90 @@ func TestCPU_GetFlag(t *testing.T) {
 		})
 	}
 }
+
+// BenchmarkCPU_Execute runs a loop of the common instructions: MOV, ADD, INC, ASL, CLR, BR
+func BenchmarkCPU_Execute(b *testing.B) {
+	p := psw.PSW(0)
+	l := log.New(io.Discard, "", 0)
+	var cons console.Console = console.NewSimple()
+	u := New(&p, nil, &cons, false, l)
+
+	code := []uint16{010002, 060203, 005204, 006305, 005002, 000772}
+	for i, c := range code {
+		u.Memory[01000>>1+i] = c
+	}
+	u.PdpCPU.Registers[7] = 01000
+	u.PdpCPU.State = CPURUN
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u.PdpCPU.Execute()
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
+
+func TestCPU_Decode(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint16
+		want        string
+	}{
+		{"halt", 0, "HALT"},
+		{"reset", 5, "RESET"},
+		{"invalid in no operand range", 012, "??"},
+		{"mov", 010203, "MOV"},
+		{"movb", 0110203, "MOVB"},
+		{"cmpb", 0120203, "CMPB"},
+		{"xor", 074102, "XOR"},
+		{"jsr", 004737, "JSR"},
+		{"bcs", 0103776, "BCS"},
+		{"rts", 0207, "RTS"},
+		{"clc", 0241, "CC"},
+		{"sec", 0261, "CC"},
+		{"fp", 0170000, "??"},
+		{"unused", 0007000, "??"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.PdpCPU.table[tt.instruction].name; got != tt.want {
+				t.Errorf("table[%06o] = %s, want %s", tt.instruction, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPU_ConditionCodes(t *testing.T) {
+	u.Psw.Set(0)
+	u.PdpCPU.Decode(0277)(0277)
+	if got := u.Psw.Get() & 017; got != 017 {
+		t.Errorf("SCC: flags = %02o, want 17", got)
+	}
+	u.PdpCPU.Decode(0241)(0241)
+	if got := u.Psw.Get() & 017; got != 016 {
+		t.Errorf("CLC: flags = %02o, want 16", got)
+	}
+	if got := disasmCC(0261); got != "SEC" {
+		t.Errorf("disasmCC(0261) = %s, want SEC", got)
+	}
+
+	// combined codes
+	tests := []struct {
+		instruction uint16
+		psw, want   uint16
+	}{
+		{0245, 017, 012}, // CLZC
+		{0246, 017, 011}, // CLZV
+		{0256, 017, 001}, // CLNZV
+		{0263, 000, 003}, // SEVC
+		{0265, 002, 007}, // SEZC
+		{0276, 001, 017}, // SENZV
+	}
+	for _, tt := range tests {
+		u.Psw.Set(tt.psw)
+		u.PdpCPU.Decode(tt.instruction)(tt.instruction)
+		if got := u.Psw.Get() & 017; got != tt.want {
+			t.Errorf("%s: flags = %02o, want %02o", disasmCC(tt.instruction), got, tt.want)
+		}
+	}
+	u.Psw.Set(0)
+}
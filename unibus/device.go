@@ -0,0 +1,244 @@
+package unibus
+
+import (
+	"fmt"
+	"pdp/interrupts"
+	"pdp/teletype"
+)
+
+// IOPageAddr - begin of the unibus I/O page. All device registers live above it.
+const IOPageAddr = 0760000
+
+// number of words in the I/O page
+const ioPageWords = (01000000 - IOPageAddr) >> 1
+
+// Device is a peripheral attached to the Unibus.
+// Every device answers to a continuous range of addresses in the I/O page,
+// and the bus dispatches all reads and writes in that range to the device.
+type Device interface {
+	// Name returns the short device name, as shown by the control console
+	Name() string
+
+	// AddressRange returns the first and the last (word) address the device answers to
+	AddressRange() (begin, end Uint18)
+
+	// Read16 and Write16 are called for the word access to the device registers
+	Read16(addr Uint18) (uint16, error)
+	Write16(addr Uint18, data uint16) error
+
+	// Read8 and Write8 are called for the byte access. addr can be odd.
+	Read8(addr Uint18) (uint16, error)
+	Write8(addr Uint18, data uint16) error
+
+	// Reset is called on the bus INIT, i.e. by the RESET instruction
+	Reset()
+
+	// Vector returns the interrupt vector and the bus request priority
+	// used by the device. Devices not sending interrupts return zeros.
+	Vector() (vector, priority uint16)
+}
+
+// stepper is implemented by devices that need to do some work
+// after every executed CPU instruction
+type stepper interface {
+	Step()
+}
+
+// RegisterDevice attaches the device to the bus and maps its address range.
+func (u *Unibus) RegisterDevice(d Device) error {
+	begin, end := d.AddressRange()
+	if begin < IOPageAddr || end > 0777777 || begin > end || begin&1 == 1 {
+		return fmt.Errorf("invalid device address range %06o - %06o", begin, end)
+	}
+
+	for addr := begin; addr <= end; addr += 2 {
+		if other := u.ioMap[(addr-IOPageAddr)>>1]; other != nil {
+			return fmt.Errorf("device address %06o is already taken by %T", addr, other)
+		}
+	}
+	for addr := begin; addr <= end; addr += 2 {
+		u.ioMap[(addr-IOPageAddr)>>1] = d
+	}
+
+	u.devices = append(u.devices, d)
+	if s, ok := d.(stepper); ok {
+		u.steppers = append(u.steppers, s)
+	}
+	return nil
+}
+
+// unregisterDevice detaches the device answering to the address from the bus
+func (u *Unibus) unregisterDevice(addr Uint18) {
+	d := u.ioMap[(addr-IOPageAddr)>>1]
+	if d == nil {
+		return
+	}
+	for i := range u.ioMap {
+		if u.ioMap[i] == d {
+			u.ioMap[i] = nil
+		}
+	}
+	for i, other := range u.devices {
+		if other == d {
+			u.devices = append(u.devices[:i], u.devices[i+1:]...)
+			break
+		}
+	}
+	for i, s := range u.steppers {
+		if any(s) == any(d) {
+			u.steppers = append(u.steppers[:i], u.steppers[i+1:]...)
+			break
+		}
+	}
+}
+
+// Devices returns all registered devices in order of registration
+func (u *Unibus) Devices() []Device {
+	return u.devices
+}
+
+// ResetDevices sends INIT to all devices attached to the bus
+func (u *Unibus) ResetDevices() {
+	for _, d := range u.devices {
+		d.Reset()
+	}
+}
+
+// StepDevices runs a single step on all devices that need it
+func (u *Unibus) StepDevices() {
+	for _, s := range u.steppers {
+		s.Step()
+	}
+}
+
+// device returns the device mapped at the I/O page address and the 18 bit Unibus address
+// the device answers to. On the 22 bit machine the I/O page lives at the top of the physical address space.
+func (u *Unibus) device(physicalAddress Uint18) (Device, Uint18) {
+	if physicalAddress < u.ioPage || physicalAddress-u.ioPage >= ioPageWords<<1 {
+		return nil, 0
+	}
+	return u.ioMap[(physicalAddress-u.ioPage)>>1], physicalAddress - u.ioPage + IOPageAddr
+}
+
+// IOAddress translates the 18 bit Unibus address of the device register to the physical address
+func (u *Unibus) IOAddress(addr Uint18) Uint18 {
+	return addr - IOPageAddr + u.ioPage
+}
+
+// byte access helpers for devices which don't care about the byte access
+// and are happy with the read-modify-write of the whole word.
+func readByteFromWord(d Device, addr Uint18) (uint16, error) {
+	val, err := d.Read16(addr &^ 1)
+	if err != nil {
+		return 0, err
+	}
+	if addr&1 != 0 {
+		return val >> 8, nil
+	}
+	return val & 0xFF, nil
+}
+
+func writeByteToWord(d Device, addr Uint18, data uint16) error {
+	val, err := d.Read16(addr &^ 1)
+	if err != nil {
+		return err
+	}
+	if addr&1 == 0 {
+		val = (val & 0xFF00) | (data & 0xFF)
+	} else {
+		val = (val & 0xFF) | (data << 8)
+	}
+	return d.Write16(addr&^1, val)
+}
+
+// ioRegisters adapts simple registers, that do not deserve a device type on their own,
+// (PSW, CPU registers, MMU registers...) to the Device interface
+type ioRegisters struct {
+	name       string
+	begin, end Uint18
+	read       func(addr Uint18) (uint16, error)
+	write      func(addr Uint18, data uint16) error
+}
+
+func (r *ioRegisters) Name() string {
+	return r.name
+}
+
+func (r *ioRegisters) AddressRange() (Uint18, Uint18) {
+	return r.begin, r.end
+}
+
+func (r *ioRegisters) Read16(addr Uint18) (uint16, error) {
+	return r.read(addr)
+}
+
+func (r *ioRegisters) Write16(addr Uint18, data uint16) error {
+	if r.write == nil {
+		return nil
+	}
+	return r.write(addr, data)
+}
+
+func (r *ioRegisters) Read8(addr Uint18) (uint16, error) {
+	return readByteFromWord(r, addr)
+}
+
+func (r *ioRegisters) Write8(addr Uint18, data uint16) error {
+	return writeByteToWord(r, addr, data)
+}
+
+func (r *ioRegisters) Reset() {}
+
+func (r *ioRegisters) Vector() (uint16, uint16) {
+	return 0, 0
+}
+
+// consoleDevice - console teletype attached to the bus
+type consoleDevice struct {
+	tty teletype.Teletype
+}
+
+func (c *consoleDevice) Name() string {
+	return "DL11"
+}
+
+func (c *consoleDevice) AddressRange() (Uint18, Uint18) {
+	return ConsoleAddr, ConsoleAddr + 6
+}
+
+func (c *consoleDevice) Read16(addr Uint18) (uint16, error) {
+	return c.tty.ReadTerm(uint32(addr)), nil
+}
+
+func (c *consoleDevice) Write16(addr Uint18, data uint16) error {
+	return c.tty.WriteTerm(uint32(addr), data)
+}
+
+// Read8 - no read-modify-write here, reading TKB has side effects.
+func (c *consoleDevice) Read8(addr Uint18) (uint16, error) {
+	val := c.tty.ReadTerm(uint32(addr &^ 1))
+	if addr&1 != 0 {
+		return val >> 8, nil
+	}
+	return val & 0xFF, nil
+}
+
+// Write8 - only the lower byte of the teletype registers is meaningful
+func (c *consoleDevice) Write8(addr Uint18, data uint16) error {
+	if addr&1 != 0 {
+		return nil
+	}
+	return c.tty.WriteTerm(uint32(addr), data&0xFF)
+}
+
+func (c *consoleDevice) Reset() {
+	c.tty.ClearTerminal()
+}
+
+func (c *consoleDevice) Vector() (uint16, uint16) {
+	return interrupts.TTYin, 4
+}
+
+func (c *consoleDevice) Step() {
+	c.tty.Step()
+}
@@ -10,74 +10,15 @@ const (
 	flagO    = 1 << 2
 	flagR    = 1 << 3
 	flagNone = 1 << 4
+	flagCC   = 1 << 5
+	flagF    = 1 << 6 // floating operand, mode 0 is the accumulator
+	flagAS   = 1 << 7 // source operand, accumulator in bits 7-6
+	flagAD   = 1 << 8 // accumulator in bits 7-6, destination operand
+	flagN    = 1 << 9 // number in bits 2-0
 )
 
-var disasmtable = []struct {
-	inst, arg uint16
-	msg       string
-	flag      uint
-	b         bool
-}{
-	{0077700, 0005000, "CLR", flagD, true},
-	{0077700, 0005100, "COM", flagD, true},
-	{0077700, 0005200, "INC", flagD, true},
-	{0077700, 0005300, "DEC", flagD, true},
-	{0077700, 0005400, "NEG", flagD, true},
-	{0077700, 0005700, "TST", flagD, true},
-	{0077700, 0006200, "ASR", flagD, true},
-	{0077700, 0006300, "ASL", flagD, true},
-	{0077700, 0006000, "ROR", flagD, true},
-	{0077700, 0006100, "ROL", flagD, true},
-	{0177700, 0000300, "SWAB", flagD, false},
-	{0077700, 0005500, "ADC", flagD, true},
-	{0077700, 0005600, "SBC", flagD, true},
-	{0177700, 0006700, "SXT", flagD, false},
-	{0070000, 0010000, "MOV", flagS | flagD, true},
-	{0070000, 0020000, "CMP", flagS | flagD, true},
-	{0170000, 0060000, "ADD", flagS | flagD, false},
-	{0170000, 0160000, "SUB", flagS | flagD, false},
-	{0070000, 0030000, "BIT", flagS | flagD, true},
-	{0070000, 0040000, "BIC", flagS | flagD, true},
-	{0070000, 0050000, "BIS", flagS | flagD, true},
-	{0177000, 0070000, "MUL", flagR | flagD, false},
-	{0177000, 0071000, "DIV", flagR | flagD, false},
-	{0177000, 0072000, "ASH", flagR | flagD, false},
-	{0177000, 0073000, "ASHC", flagR | flagD, false},
-	{0177400, 0000400, "BR", flagO, false},
-	{0177400, 0001000, "BNE", flagO, false},
-	{0177400, 0001400, "BEQ", flagO, false},
-	{0177400, 0100000, "BPL", flagO, false},
-	{0177400, 0100400, "BMI", flagO, false},
-	{0177400, 0101000, "BHI", flagO, false},
-	{0177400, 0101400, "BLOS", flagO, false},
-	{0177400, 0102000, "BVC", flagO, false},
-	{0177400, 0102400, "BVS", flagO, false},
-	{0177400, 0103000, "BCC", flagO, false},
-	{0177400, 0103400, "BCS", flagO, false},
-	{0177400, 0002000, "BGE", flagO, false},
-	{0177400, 0002400, "BLT", flagO, false},
-	{0177400, 0003000, "BGT", flagO, false},
-	{0177400, 0003400, "BLE", flagO, false},
-	{0177700, 0000100, "JMP", flagD, false},
-	{0177000, 0004000, "JSR", flagR | flagD, false},
-	{0177770, 0000200, "RTS", flagR, false},
-	{0177777, 0006400, "MARK", 0, false},
-	{0177000, 0077000, "SOB", flagR | flagO, false},
-	{0177777, 0000005, "RESET", 0, false},
-	{0177700, 0006500, "MFPI", flagD, false},
-	{0177700, 0006600, "MTPI", flagD, false},
-	{0177777, 0000001, "WAIT", 0, false},
-	{0177777, 0000002, "RTI", 0, false},
-	{0177777, 0000006, "RTT", 0, false},
-	{0177400, 0104000, "EMT", flagNone, false},
-	{0177400, 0104400, "TRAP", flagNone, false},
-	{0177777, 0000003, "BPT", 0, false},
-	{0177777, 0000004, "IOT", 0, false},
-	{0170000, 0170000, "FP", 0, false},
-}
-
 func (u *Unibus) disasmaddr(m uint16, a uint16) string {
-	physicalAddress := u.Mmu.Decode(a, false, u.PdpCPU.IsUserMode())
+	physicalAddress := u.Mmu.Decode(a, false, u.Psw.GetMode())
 	if (m & 7) == 7 {
 		switch m {
 		case 027:
@@ -121,25 +62,16 @@ func (u *Unibus) disasmaddr(m uint16, a uint16) string {
 func (u *Unibus) Disasm(a uint16) string {
 	ins := a
 	a = u.PdpCPU.Registers[7] - 2
-	l := disasmtable[0]
-
-	for i := 0; i < len(disasmtable); i++ {
-		l = disasmtable[i]
-		if (ins & l.inst) == l.arg {
-			goto found
-		}
+	l := u.PdpCPU.table[ins]
+	if l == &invalidInstruction {
+		return "??"
 	}
-	// panic(fmt.Sprintf("disasm: cannot disassemble instruction %06o at %06o", ins, a))
-	return "??"
 
-found:
-	msg := l.msg
-	if l.b && (ins&0100000 == 0100000) {
-		msg += "B"
-	}
+	msg := l.name
 	source := (ins & 07700) >> 6
 	destination := ins & 077
 	o := byte(ins & 0377)
+	ac := fmt.Sprintf("AC%d", (ins>>6)&3)
 	switch l.flag {
 	case flagS | flagD:
 		msg += " " + u.disasmaddr(source, a) + ","
@@ -160,6 +92,50 @@ found:
 		msg += " " + rs[(ins&0700)>>6] + ", " + u.disasmaddr(destination, a)
 	case flagR:
 		msg += " " + rs[ins&7]
+	case flagN:
+		msg += fmt.Sprintf(" %o", ins&7)
+	case flagCC:
+		msg = disasmCC(ins)
+	case flagF:
+		msg += " " + u.disasmFloat(destination, a)
+	case flagF | flagAS:
+		msg += " " + u.disasmFloat(destination, a) + ", " + ac
+	case flagD | flagAS:
+		msg += " " + u.disasmaddr(destination, a) + ", " + ac
+	case flagF | flagAD:
+		msg += " " + ac + ", " + u.disasmFloat(destination, a)
+	case flagD | flagAD:
+		msg += " " + ac + ", " + u.disasmaddr(destination, a)
+	}
+	return msg
+}
+
+// disasmFloat returns the floating operand, accumulator in the mode 0
+func (u *Unibus) disasmFloat(m uint16, a uint16) string {
+	if m&070 == 0 {
+		return fmt.Sprintf("AC%d", m&7)
+	}
+	return u.disasmaddr(m, a)
+}
+
+// disasmCC returns the mnemonic of the condition code operator
+func disasmCC(ins uint16) string {
+	switch ins {
+	case 0240, 0260:
+		return "NOP"
+	case 0257:
+		return "CCC"
+	case 0277:
+		return "SCC"
+	}
+	msg := "CL"
+	if ins&020 != 0 {
+		msg = "SE"
+	}
+	for i, f := range "NZVC" {
+		if ins&(010>>i) != 0 {
+			msg += string(f)
+		}
 	}
 	return msg
 }
@@ -0,0 +1,81 @@
+package unibus
+
+import (
+	"math/big"
+	"pdp/interrupts"
+)
+
+// InstallFIS adds the KE11-F floating instruction set option
+func (c *CPU) InstallFIS() {
+	c.table.add(fisInstructions)
+}
+
+// fisOp - FADD, FSUB, FMUL and FDIV
+// The register holds the address of the operands in the F format: B at (R) and A at (R)+4.
+// A op B replaces A, and the register is incremented by 4, so it points to the result.
+// N: set if the result < 0
+// Z: set if the result = 0
+// V, C: cleared
+// Overflow, underflow and division by zero leave the operands and the register
+// unchanged, set the condition codes and trap to 244.
+func (c *CPU) fisOp(instruction uint16) {
+	reg := instruction & 7
+	addr := c.Registers[reg]
+
+	var w [4]uint16
+	for i := range w {
+		w[i] = c.mmunit.ReadMemoryWord(addr + uint16(2*i))
+	}
+	if c.unibus.TrapPending() {
+		return
+	}
+
+	b := unpackFloat(w[0:2], precF)
+	a := unpackFloat(w[2:4], precF)
+	res := new(big.Float).SetPrec(precF).SetMode(big.ToNearestAway)
+	switch instruction & 070 {
+	case 000:
+		res.Add(a, b)
+	case 010:
+		res.Sub(a, b)
+	case 020:
+		res.Mul(a, b)
+	case 030:
+		if b.Sign() == 0 {
+			c.fisTrap(true, true, true)
+			return
+		}
+		res.Quo(a, b)
+	}
+
+	switch packFloat(res, w[2:4]) {
+	case errFloatOverflow:
+		c.fisTrap(false, true, false)
+		return
+	case errFloatUnderflow:
+		c.fisTrap(true, true, false)
+		return
+	}
+
+	c.mmunit.WriteMemoryWord(addr+4, w[2])
+	c.mmunit.WriteMemoryWord(addr+6, w[3])
+	if c.unibus.TrapPending() {
+		return
+	}
+	c.Registers[reg] = addr + 4
+
+	c.SetFlag("N", w[2]&0100000 != 0)
+	c.SetFlag("Z", w[2] == 0)
+	c.SetFlag("V", false)
+	c.SetFlag("C", false)
+}
+
+// fisTrap sets the condition codes of the floating point error and traps to 244:
+// overflow - V, underflow - N and V, division by zero - N, V and C
+func (c *CPU) fisTrap(n, v, carry bool) {
+	c.SetFlag("N", n)
+	c.SetFlag("Z", false)
+	c.SetFlag("V", v)
+	c.SetFlag("C", carry)
+	c.trapOpcode(interrupts.IntFP)
+}
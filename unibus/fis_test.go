@@ -0,0 +1,86 @@
+package unibus
+
+import (
+	"testing"
+)
+
+func TestCPU_fisOp(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint16
+		a, b        [2]uint16
+		want        [2]uint16
+		flags       flags
+	}{
+		{"FADD 1 + 2", 075001, [2]uint16{040200, 0}, [2]uint16{040400, 0}, [2]uint16{040500, 0}, flags{}},
+		{"FSUB 1 - 2", 075011, [2]uint16{040200, 0}, [2]uint16{040400, 0}, [2]uint16{0140200, 0}, flags{n: true}},
+		{"FSUB 2 - 2", 075011, [2]uint16{040400, 0}, [2]uint16{040400, 0}, [2]uint16{0, 0}, flags{z: true}},
+		{"FMUL 3 * 2", 075021, [2]uint16{040500, 0}, [2]uint16{040400, 0}, [2]uint16{040700, 0}, flags{}},
+		{"FDIV 1 / 2", 075031, [2]uint16{040200, 0}, [2]uint16{040400, 0}, [2]uint16{040000, 0}, flags{}},
+		{"FDIV 1 / 3 is rounded", 075031, [2]uint16{040200, 0}, [2]uint16{040500, 0}, [2]uint16{037652, 0125253}, flags{}},
+		{"FADD dirty zero", 075001, [2]uint16{000177, 1}, [2]uint16{040400, 0}, [2]uint16{040400, 0}, flags{}},
+	}
+
+	u.Psw.Set(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u.PdpCPU.Registers[1] = 01000
+			u.Memory[01000>>1], u.Memory[01002>>1] = tt.b[0], tt.b[1]
+			u.Memory[01004>>1], u.Memory[01006>>1] = tt.a[0], tt.a[1]
+
+			u.PdpCPU.fisOp(tt.instruction)
+
+			if got := [2]uint16{u.Memory[01004>>1], u.Memory[01006>>1]}; got != tt.want {
+				t.Errorf("result = %06o, want %06o", got, tt.want)
+			}
+			if u.PdpCPU.Registers[1] != 01004 {
+				t.Errorf("R1 = %06o, want 001004", u.PdpCPU.Registers[1])
+			}
+			got := flags{c.GetFlag("C"), c.GetFlag("V"), c.GetFlag("Z"), c.GetFlag("N")}
+			if got != tt.flags {
+				t.Errorf("flags = %v, want %v", got, tt.flags)
+			}
+		})
+	}
+}
+
+func TestCPU_fisTrap(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint16
+		a, b        [2]uint16
+		psw         uint16
+	}{
+		{"overflow", 075021, [2]uint16{077777, 0177777}, [2]uint16{040400, 0}, 02},
+		{"underflow", 075031, [2]uint16{000200, 0}, [2]uint16{040400, 0}, 012},
+		{"division by zero", 075031, [2]uint16{040200, 0}, [2]uint16{0, 0}, 013},
+	}
+
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.Memory[0244>>1] = 04000
+	u.Memory[0246>>1] = 0340
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u.Psw.Set(0)
+			u.PdpCPU.Registers[1] = 01000
+			u.PdpCPU.Registers[6] = 0700
+			u.PdpCPU.Registers[7] = 02002
+			u.Memory[01000>>1], u.Memory[01002>>1] = tt.b[0], tt.b[1]
+			u.Memory[01004>>1], u.Memory[01006>>1] = tt.a[0], tt.a[1]
+
+			u.PdpCPU.fisOp(tt.instruction)
+
+			if u.PdpCPU.Registers[7] != 04000 || u.Psw.Get() != 0340 {
+				t.Errorf("expected trap to 004000, got PC %06o, PSW %06o", u.PdpCPU.Registers[7], u.Psw.Get())
+			}
+			if u.Memory[0674>>1] != 02002 || u.Memory[0676>>1] != tt.psw {
+				t.Errorf("expected PC 002002 and PSW %06o on the stack, got %06o, %06o",
+					tt.psw, u.Memory[0674>>1], u.Memory[0676>>1])
+			}
+			if u.PdpCPU.Registers[1] != 01000 || u.Memory[01004>>1] != tt.a[0] {
+				t.Errorf("expected operands unchanged, got R1 %06o, A %06o", u.PdpCPU.Registers[1], u.Memory[01004>>1])
+			}
+		})
+	}
+	u.Psw.Set(0)
+}
@@ -0,0 +1,80 @@
+package unibus
+
+import (
+	"errors"
+	"math/big"
+)
+
+/*
+DEC floating point format, used by the FIS and the FP11.
+
+The first word holds the sign (bit 15), the excess 128 exponent (bits 14-7)
+and the high 7 bits of the fraction. Following words hold the rest of the fraction,
+one word in the F format, three words in the D format.
+The fraction is normalized, its leading 1 is not stored: the value is 0.1fraction * 2^(exponent-128).
+Zero exponent is the zero, regardless of the sign and the fraction.
+*/
+
+// fraction precision of the F and D formats, including the hidden bit
+const (
+	precF = 24
+	precD = 56
+)
+
+var (
+	errFloatOverflow  = errors.New("floating overflow")
+	errFloatUnderflow = errors.New("floating underflow")
+)
+
+// unpackFloat converts the DEC floating number in words to big.Float with the precision prec
+func unpackFloat(words []uint16, prec uint) *big.Float {
+	f := new(big.Float).SetPrec(prec)
+	exp := int(words[0]>>7) & 0377
+	if exp == 0 {
+		return f
+	}
+
+	mant := uint64(words[0]&0177 | 0200)
+	for _, w := range words[1:] {
+		mant = mant<<16 | uint64(w)
+	}
+	bits := 8 + 16*(len(words)-1)
+	f.SetUint64(mant)
+	f.SetMantExp(f, exp-128-bits)
+	if words[0]&0100000 != 0 {
+		f.Neg(f)
+	}
+	return f
+}
+
+// packFloat converts f to the DEC floating number in words.
+// f is expected to be rounded to the precision of the format.
+// Exponent out of the range returns error, the words then hold the exponent modulo 256.
+func packFloat(f *big.Float, words []uint16) error {
+	if f.Sign() == 0 {
+		for i := range words {
+			words[i] = 0
+		}
+		return nil
+	}
+
+	mant := new(big.Float)
+	exp := f.MantExp(mant) + 128
+	bits := 8 + 16*(len(words)-1)
+	m, _ := mant.SetMantExp(mant.Abs(mant), bits).Uint64()
+	words[0] = uint16(exp&0377)<<7 | uint16(m>>(bits-8))&0177
+	if f.Sign() < 0 {
+		words[0] |= 0100000
+	}
+	for i := 1; i < len(words); i++ {
+		words[i] = uint16(m >> (bits - 8 - 16*i))
+	}
+
+	switch {
+	case exp > 0377:
+		return errFloatOverflow
+	case exp < 1:
+		return errFloatUnderflow
+	}
+	return nil
+}
@@ -0,0 +1,563 @@
+package unibus
+
+import (
+	"math/big"
+	"pdp/interrupts"
+)
+
+/*
+FP11 floating point processor, as used in pdp11/45 and pdp11/70.
+
+Six 64 bit accumulators hold the F (single) or D (double) precision numbers in the DEC format.
+Single precision values use the high 32 bits of the accumulator.
+FPS selects the precision, the integer length and the rounding, and enables the error traps.
+Errors are recorded in FEC and FEA, and trap to 244 at the end of the instruction.
+*/
+
+// FPS bits
+const (
+	fpsFC   = 1 << 0
+	fpsFV   = 1 << 1
+	fpsFZ   = 1 << 2
+	fpsFN   = 1 << 3
+	fpsFT   = 1 << 5  // truncate
+	fpsFL   = 1 << 6  // long integer
+	fpsFD   = 1 << 7  // double precision
+	fpsFIC  = 1 << 8  // interrupt on integer conversion error
+	fpsFIV  = 1 << 9  // interrupt on overflow
+	fpsFIU  = 1 << 10 // interrupt on underflow
+	fpsFIUV = 1 << 11 // interrupt on undefined variable
+	fpsFID  = 1 << 14 // disable all interrupts
+	fpsFER  = 1 << 15 // error
+	fpsMask = 0147777
+)
+
+// FEC error codes
+const (
+	fecOP    = 2  // floating opcode error
+	fecDZRO  = 4  // division by zero
+	fecICVT  = 6  // integer conversion error
+	fecOVFLO = 8  // overflow
+	fecUNFLO = 10 // underflow
+	fecUNDFV = 12 // undefined variable
+)
+
+// fppTrapEnable - FPS bit enabling the trap on the error
+var fppTrapEnable = map[uint16]uint16{fecICVT: fpsFIC, fecOVFLO: fpsFIV, fecUNFLO: fpsFIU, fecUNDFV: fpsFIUV}
+
+// fpac - accumulator or the floating operand, high word first
+type fpac [4]uint16
+
+// FPP - floating point processor state
+type FPP struct {
+	AC  [6]fpac
+	FPS uint16
+	FEC uint16
+	FEA uint16
+
+	// error of the current instruction
+	err uint16
+}
+
+// floatOperand - accumulator (mode 0), or the address of the floating operand in memory
+type floatOperand struct {
+	ac   int
+	addr uint16
+
+	// words in memory: 2, 4, or 1 for the immediate operand
+	words int
+
+	// immediate operand is a part of the instruction stream in the I space
+	immediate bool
+}
+
+// InstallFPP adds the FP11 floating point processor
+func (c *CPU) InstallFPP() {
+	c.fpp = &FPP{}
+	c.table.add(fppInstructions)
+}
+
+// fppOp - all FP11 instructions.
+// Format is 17 OOOO A DD: opcode in bits 11-8, accumulator in bits 7-6 and the operand in bits 5-0.
+func (c *CPU) fppOp(instruction uint16) {
+	p := c.fpp
+	p.err = 0
+	ac := int(instruction>>6) & 3
+
+	switch (instruction >> 8) & 017 {
+	case 0:
+		switch ac {
+		case 0:
+			c.fppNoOperand(instruction)
+		case 1: // LDFPS
+			fps := c.readWord(instruction)
+			if !c.unibus.TrapPending() {
+				p.FPS = fps & fpsMask
+			}
+		case 2: // STFPS
+			c.writeWord(instruction, p.FPS)
+		case 3: // STST
+			c.stst(instruction)
+		}
+	case 1:
+		c.fppSingleOperand(instruction)
+	case 2: // MULF
+		if x, y, ok := c.fppOperands(instruction); ok {
+			p.setResult(ac, p.float().Mul(x, y))
+		}
+	case 3:
+		c.modf(instruction)
+	case 4: // ADDF
+		if x, y, ok := c.fppOperands(instruction); ok {
+			p.setResult(ac, p.float().Add(x, y))
+		}
+	case 5: // LDF
+		o, ok := c.floatOperand(instruction, p.double())
+		if !ok {
+			break
+		}
+		if v, ok := c.loadFloat(o); ok {
+			p.setResult(ac, p.value(v, p.double()))
+		}
+	case 6: // SUBF
+		if x, y, ok := c.fppOperands(instruction); ok {
+			p.setResult(ac, p.float().Sub(x, y))
+		}
+	case 7: // CMPF - compares the source to the accumulator
+		if x, y, ok := c.fppOperands(instruction); ok {
+			cmp := y.Cmp(x)
+			p.setCC(cmp < 0, cmp == 0, false, false)
+		}
+	case 010: // STF
+		if o, ok := c.floatOperand(instruction, p.double()); ok {
+			c.storeFloat(o, p.AC[ac])
+		}
+	case 011: // DIVF
+		if x, y, ok := c.fppOperands(instruction); ok {
+			if y.Sign() == 0 {
+				p.err = fecDZRO
+				break
+			}
+			p.setResult(ac, p.float().Quo(x, y))
+		}
+	case 012:
+		c.stexp(instruction)
+	case 013:
+		c.stcfi(instruction)
+	case 014: // STCFD - stores the accumulator in the other precision
+		if o, ok := c.floatOperand(instruction, !p.double()); ok {
+			x := p.value(p.AC[ac], p.double())
+			c.storeFloat(o, p.pack(p.convert(x, !p.double()), !p.double()))
+		}
+	case 015:
+		c.ldexp(instruction)
+	case 016:
+		c.ldcif(instruction)
+	case 017: // LDCDF - loads the operand in the other precision
+		o, ok := c.floatOperand(instruction, !p.double())
+		if !ok {
+			break
+		}
+		if v, ok := c.loadFloat(o); ok {
+			p.setResult(ac, p.convert(p.value(v, !p.double()), p.double()))
+		}
+	}
+
+	if p.err != 0 && !c.unibus.TrapPending() {
+		c.fppException(p.err)
+	}
+}
+
+// fppNoOperand - CFCC, SETF, SETD, SETI, SETL
+func (c *CPU) fppNoOperand(instruction uint16) {
+	p := c.fpp
+	switch instruction & 077 {
+	case 0: // CFCC
+		c.unibus.Psw.Set(c.unibus.Psw.Get()&^017 | p.FPS&017)
+	case 1:
+		p.FPS &^= fpsFD
+	case 011:
+		p.FPS |= fpsFD
+	case 2:
+		p.FPS &^= fpsFL
+	case 012:
+		p.FPS |= fpsFL
+	default:
+		p.err = fecOP
+	}
+}
+
+// fppSingleOperand - CLRF, TSTF, ABSF, NEGF
+func (c *CPU) fppSingleOperand(instruction uint16) {
+	p := c.fpp
+	o, ok := c.floatOperand(instruction, p.double())
+	if !ok {
+		return
+	}
+
+	op := (instruction >> 6) & 3
+	var v fpac
+	if op != 0 {
+		if v, ok = c.loadFloat(o); !ok {
+			return
+		}
+	}
+	if v[0]&0177600 == 0 {
+		v = fpac{}
+	}
+	switch op {
+	case 2: // ABSF
+		v[0] &^= 0100000
+	case 3: // NEGF
+		if v[0] != 0 {
+			v[0] ^= 0100000
+		}
+	}
+	if op != 1 && !c.storeFloat(o, v) {
+		return
+	}
+	p.setCC(v[0]&0100000 != 0, v[0] == 0, false, false)
+}
+
+// fppOperands returns the accumulator and the source operand of the arithmetic instructions
+func (c *CPU) fppOperands(instruction uint16) (*big.Float, *big.Float, bool) {
+	p := c.fpp
+	o, ok := c.floatOperand(instruction, p.double())
+	if !ok {
+		return nil, nil, false
+	}
+	v, ok := c.loadFloat(o)
+	if !ok {
+		return nil, nil, false
+	}
+	return p.value(p.AC[(instruction>>6)&3], p.double()), p.value(v, p.double()), true
+}
+
+// modf - multiplies the accumulator by the source, and splits the product to the integer and fraction.
+// Fraction is stored in the accumulator, integer in the accumulator or-ed with 1, unless the accumulator is odd.
+func (c *CPU) modf(instruction uint16) {
+	p := c.fpp
+	x, y, ok := c.fppOperands(instruction)
+	if !ok {
+		return
+	}
+	ac := int(instruction>>6) & 3
+	prod := new(big.Float).SetPrec(2*p.prec()).Mul(x, y)
+
+	i, _ := prod.Int(nil)
+	integer := new(big.Float).SetPrec(p.prec()).SetMode(big.ToZero).SetInt(i)
+	fraction := p.float().Sub(prod, integer)
+	if prod.MantExp(nil) > int(p.prec()) {
+		fraction.SetInt64(0)
+	}
+
+	p.setResult(ac|1, integer)
+	overflow := p.FPS&fpsFV != 0
+	p.setResult(ac, fraction)
+	if overflow {
+		p.FPS |= fpsFV
+	}
+}
+
+// stst - stores FEC, and FEA if the destination is not a register
+func (c *CPU) stst(instruction uint16) {
+	p := c.fpp
+	if instruction&070 == 0 {
+		c.writeWord(instruction, p.FEC)
+		return
+	}
+	addr := c.floatAddress(instruction, 2)
+	c.mmunit.WriteMemoryWord(addr, p.FEC)
+	if instruction&077 != 027 {
+		c.mmunit.WriteMemoryWord(addr+2, p.FEA)
+	}
+}
+
+// stexp - stores the exponent of the accumulator
+func (c *CPU) stexp(instruction uint16) {
+	p := c.fpp
+	exp := (p.AC[(instruction>>6)&3][0]>>7)&0377 - 0200
+	c.writeWord(instruction, exp)
+	if c.unibus.TrapPending() {
+		return
+	}
+	p.setCC(exp&0100000 != 0, exp == 0, false, false)
+	c.copyCC()
+}
+
+// ldexp - loads the exponent of the accumulator.
+// Exponent out of the range clears the accumulator, unless the overflow or underflow trap is enabled.
+func (c *CPU) ldexp(instruction uint16) {
+	p := c.fpp
+	ac := (instruction >> 6) & 3
+	exp := int(int16(c.readWord(instruction))) + 0200
+	if c.unibus.TrapPending() {
+		return
+	}
+
+	v := p.AC[ac]
+	v[0] = v[0]&0100177 | uint16(exp&0377)<<7
+	overflow := false
+	switch {
+	case exp > 0377:
+		overflow = true
+		p.err = fecOVFLO
+		if p.FPS&fpsFIV == 0 {
+			v = fpac{}
+		}
+	case exp < 1:
+		p.err = fecUNFLO
+		if p.FPS&fpsFIU == 0 {
+			v = fpac{}
+		}
+	}
+	p.AC[ac] = v
+	p.setCC(v[0]&0100000 != 0, v[0]&0177600 == 0, overflow, false)
+}
+
+// stcfi - converts the accumulator to the integer, truncated towards zero.
+// Value out of the integer range stores 0, and sets C and V.
+func (c *CPU) stcfi(instruction uint16) {
+	p := c.fpp
+	long := p.FPS&fpsFL != 0
+	x := p.value(p.AC[(instruction>>6)&3], p.double())
+
+	i, _ := x.Int64()
+	failed := long && (i < -1<<31 || i >= 1<<31) || !long && (i < -1<<15 || i >= 1<<15)
+	if failed {
+		i = 0
+	}
+
+	switch {
+	case !long, instruction&070 == 0:
+		// register destination receives the high word of the long integer
+		w := uint16(i)
+		if long {
+			w = uint16(i >> 16)
+		}
+		c.writeWord(instruction, w)
+	default:
+		addr := c.floatAddress(instruction, 2)
+		c.mmunit.WriteMemoryWord(addr, uint16(i>>16))
+		if instruction&077 != 027 {
+			c.mmunit.WriteMemoryWord(addr+2, uint16(i))
+		}
+	}
+	if c.unibus.TrapPending() {
+		return
+	}
+	if failed {
+		p.err = fecICVT
+	}
+	p.setCC(i < 0, i == 0, failed, failed)
+	c.copyCC()
+}
+
+// ldcif - converts the integer to floating point
+func (c *CPU) ldcif(instruction uint16) {
+	p := c.fpp
+	var i int64
+	switch {
+	case p.FPS&fpsFL == 0:
+		i = int64(int16(c.readWord(instruction)))
+	case instruction&070 == 0, instruction&077 == 027:
+		// register or the immediate operand is the high word of the long integer
+		i = int64(int32(uint32(c.readWord(instruction)) << 16))
+	default:
+		addr := c.floatAddress(instruction, 2)
+		hi := c.mmunit.ReadMemoryWord(addr)
+		lo := c.mmunit.ReadMemoryWord(addr + 2)
+		i = int64(int32(uint32(hi)<<16 | uint32(lo)))
+	}
+	if c.unibus.TrapPending() {
+		return
+	}
+	p.setResult(int(instruction>>6)&3, p.float().SetInt64(i))
+}
+
+// floatAddress returns the address of the operand of n words. Immediate operand is always one word.
+func (c *CPU) floatAddress(instruction uint16, n int) uint16 {
+	length := uint16(2 * n)
+	if instruction&077 == 027 {
+		length = 2
+	}
+	return c.operandAddress(instruction, length)
+}
+
+// floatOperand decodes the floating operand in bits 5-0. Mode 0 selects the accumulator 0-5.
+func (c *CPU) floatOperand(instruction uint16, double bool) (floatOperand, bool) {
+	if instruction&070 == 0 {
+		ac := int(instruction & 7)
+		if ac > 5 {
+			c.fpp.err = fecOP
+			return floatOperand{}, false
+		}
+		return floatOperand{ac: ac}, true
+	}
+
+	o := floatOperand{ac: -1, words: 2}
+	if double {
+		o.words = 4
+	}
+	o.addr = c.floatAddress(instruction, o.words)
+	if instruction&077 == 027 {
+		o.words, o.immediate = 1, true
+	}
+	return o, !c.unibus.TrapPending()
+}
+
+// loadFloat reads the floating operand.
+// Negative zero is the undefined variable, an error if the trap is enabled.
+func (c *CPU) loadFloat(o floatOperand) (fpac, bool) {
+	var v fpac
+	if o.ac >= 0 {
+		v = c.fpp.AC[o.ac]
+		if !c.fpp.double() {
+			v[2], v[3] = 0, 0
+		}
+	} else {
+		if o.immediate {
+			v[0] = c.unibus.ReadIO(c.mmunit.Decode(o.addr, false, c.unibus.Psw.GetMode()))
+		} else {
+			for i := 0; i < o.words; i++ {
+				v[i] = c.mmunit.ReadMemoryWord(o.addr + uint16(2*i))
+			}
+		}
+		if c.unibus.TrapPending() {
+			return v, false
+		}
+	}
+
+	if v[0]&0177600 == 0100000 && c.fpp.FPS&fpsFIUV != 0 {
+		c.fpp.err = fecUNDFV
+		return v, false
+	}
+	return v, true
+}
+
+// storeFloat writes the floating operand
+func (c *CPU) storeFloat(o floatOperand, v fpac) bool {
+	if o.ac >= 0 {
+		c.fpp.AC[o.ac] = v
+		return true
+	}
+	for i := 0; i < o.words; i++ {
+		c.mmunit.WriteMemoryWord(o.addr+uint16(2*i), v[i])
+	}
+	return !c.unibus.TrapPending()
+}
+
+// fppException records the error in FEC and FEA and traps to 244.
+// Conversion, overflow, underflow and undefined variable errors trap only if enabled in FPS.
+func (c *CPU) fppException(code uint16) {
+	p := c.fpp
+	if bit, ok := fppTrapEnable[code]; ok && p.FPS&bit == 0 {
+		return
+	}
+
+	p.FPS |= fpsFER
+	p.FEC = code
+	p.FEA = c.start.registers[7]
+	if p.FPS&fpsFID == 0 {
+		c.trapOpcode(interrupts.IntFP)
+	}
+}
+
+// copyCC copies the FPS condition codes to the PSW
+func (c *CPU) copyCC() {
+	c.unibus.Psw.Set(c.unibus.Psw.Get()&^017 | c.fpp.FPS&017)
+}
+
+// Reset clears the accumulators and the status
+func (p *FPP) Reset() {
+	*p = FPP{}
+}
+
+func (p *FPP) double() bool {
+	return p.FPS&fpsFD != 0
+}
+
+// prec returns the fraction precision of the current mode
+func (p *FPP) prec() uint {
+	if p.double() {
+		return precD
+	}
+	return precF
+}
+
+// float returns the number for the result in the current precision and rounding
+func (p *FPP) float() *big.Float {
+	f := new(big.Float).SetPrec(p.prec())
+	if p.FPS&fpsFT != 0 {
+		return f.SetMode(big.ToZero)
+	}
+	return f.SetMode(big.ToNearestAway)
+}
+
+// convert rounds x to the precision of the format
+func (p *FPP) convert(x *big.Float, double bool) *big.Float {
+	f := p.float()
+	if double {
+		f.SetPrec(precD)
+	} else {
+		f.SetPrec(precF)
+	}
+	return f.Set(x)
+}
+
+// value returns the number in the accumulator or the operand
+func (p *FPP) value(v fpac, double bool) *big.Float {
+	if double {
+		return unpackFloat(v[:], precD)
+	}
+	return unpackFloat(v[:2], precF)
+}
+
+// setResult stores the result in the accumulator
+func (p *FPP) setResult(ac int, f *big.Float) {
+	p.AC[ac] = p.pack(f, p.double())
+}
+
+// pack converts the result to the DEC format and sets the condition codes.
+// Result out of the exponent range is 0, unless the overflow or underflow trap is enabled.
+func (p *FPP) pack(f *big.Float, double bool) fpac {
+	var v fpac
+	n := 2
+	if double {
+		n = 4
+	}
+
+	overflow := false
+	switch packFloat(f, v[:n]) {
+	case errFloatOverflow:
+		overflow = true
+		p.err = fecOVFLO
+		if p.FPS&fpsFIV == 0 {
+			v = fpac{}
+		}
+	case errFloatUnderflow:
+		p.err = fecUNFLO
+		if p.FPS&fpsFIU == 0 {
+			v = fpac{}
+		}
+	}
+	p.setCC(v[0]&0100000 != 0, v[0]&0177600 == 0, overflow, false)
+	return v
+}
+
+// setCC sets the FPS condition codes
+func (p *FPP) setCC(n, z, v, c bool) {
+	p.FPS &^= fpsFN | fpsFZ | fpsFV | fpsFC
+	if n {
+		p.FPS |= fpsFN
+	}
+	if z {
+		p.FPS |= fpsFZ
+	}
+	if v {
+		p.FPS |= fpsFV
+	}
+	if c {
+		p.FPS |= fpsFC
+	}
+}
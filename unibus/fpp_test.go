@@ -0,0 +1,121 @@
+package unibus
+
+import (
+	"testing"
+)
+
+// withFPP installs the floating point processor in the shared CPU for the duration of the test
+func withFPP(t *testing.T) *FPP {
+	table, fpp := u.PdpCPU.table, u.PdpCPU.fpp
+	t.Cleanup(func() { u.PdpCPU.table, u.PdpCPU.fpp = table, fpp })
+
+	copied := *table
+	u.PdpCPU.table = &copied
+	u.PdpCPU.InstallFPP()
+	return u.PdpCPU.fpp
+}
+
+// runProgram executes the instructions loaded at 01000
+func runProgram(t *testing.T, program []uint16, steps int) {
+	for i, w := range program {
+		u.Memory[01000>>1+i] = w
+	}
+	u.Psw.Set(0)
+	u.PdpCPU.Registers[6] = 0700
+	u.PdpCPU.Registers[7] = 01000
+	u.PdpCPU.State = CPURUN
+	for i := 0; i < steps; i++ {
+		u.PdpCPU.Execute()
+		if _, ok := u.TakeTrap(); ok {
+			t.Fatalf("unexpected trap at %06o", u.PdpCPU.Registers[7])
+		}
+	}
+}
+
+func TestFPP_Arithmetic(t *testing.T) {
+	p := withFPP(t)
+
+	u.Memory[02000>>1], u.Memory[02002>>1] = 040400, 0 // 2.0
+	u.PdpCPU.Registers[1] = 02000
+	u.PdpCPU.Registers[2] = 03000
+	runProgram(t, []uint16{
+		0170001,         // SETF
+		0172427, 040200, // LDF #1.0, AC0
+		0172011,    // ADDF (R1), AC0
+		0171000,    // MULF AC0, AC0
+		0174022,    // STF AC0, (R2)+
+		0170011,    // SETD
+		0177127, 5, // LDCIF #5, AC1
+		0175503, // STCFI AC1, R3
+		0173401, // CMPF AC1, AC0
+	}, 9)
+
+	if got := p.AC[0]; got != (fpac{041020, 0, 0, 0}) {
+		t.Errorf("AC0 = %06o, want 9.0", got)
+	}
+	if u.Memory[03000>>1] != 041020 || u.PdpCPU.Registers[2] != 03004 {
+		t.Errorf("STF: (03000) = %06o, R2 = %06o", u.Memory[03000>>1], u.PdpCPU.Registers[2])
+	}
+	if got := p.AC[1]; got != (fpac{040640, 0, 0, 0}) {
+		t.Errorf("AC1 = %06o, want 5.0", got)
+	}
+	if u.PdpCPU.Registers[3] != 5 {
+		t.Errorf("STCFI: R3 = %06o, want 5", u.PdpCPU.Registers[3])
+	}
+	// 5.0 compared to 9.0
+	if p.FPS&017 != fpsFN {
+		t.Errorf("CMPF: FPS = %06o, expected only N set", p.FPS)
+	}
+	if p.FPS&fpsFD == 0 {
+		t.Errorf("SETD: FPS = %06o", p.FPS)
+	}
+}
+
+func TestFPP_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		fps  uint16
+		prog []uint16
+		fec  uint16
+		trap bool
+	}{
+		{"division by zero", 0, []uint16{0174427, 0}, fecDZRO, true},
+		{"overflow, trap disabled", 0, []uint16{0171027, 077600}, 0, false},
+		{"overflow", fpsFIV, []uint16{0171027, 077600}, fecOVFLO, true},
+		{"all traps disabled", fpsFIV | fpsFID, []uint16{0171027, 077600}, fecOVFLO, false},
+		{"accumulator 6", 0, []uint16{0172406}, fecOP, true},
+	}
+
+	p := withFPP(t)
+	u.Memory[0244>>1] = 04000
+	u.Memory[0246>>1] = 0340
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.Reset()
+			p.FPS = tt.fps
+			p.AC[0] = fpac{077600, 0, 0, 0}
+			for i, w := range tt.prog {
+				u.Memory[01000>>1+i] = w
+			}
+			u.Psw.Set(0)
+			u.PdpCPU.Registers[6] = 0700
+			u.PdpCPU.Registers[7] = 01000
+			u.PdpCPU.State = CPURUN
+			u.PdpCPU.Execute()
+
+			if trapped := u.PdpCPU.Registers[7] == 04000; trapped != tt.trap {
+				t.Errorf("trap = %v, want %v (PC %06o)", trapped, tt.trap, u.PdpCPU.Registers[7])
+			}
+			if p.FEC != tt.fec {
+				t.Errorf("FEC = %d, want %d", p.FEC, tt.fec)
+			}
+			if tt.fec != 0 && (p.FEA != 01000 || p.FPS&fpsFER == 0) {
+				t.Errorf("FEA = %06o, FPS = %06o", p.FEA, p.FPS)
+			}
+			if tt.fec == 0 && (p.AC[0] != fpac{} || p.FPS&(fpsFV|fpsFZ) != fpsFV|fpsFZ) {
+				t.Errorf("expected zero result with V set, got %06o, FPS %06o", p.AC[0], p.FPS)
+			}
+		})
+	}
+	u.Psw.Set(0)
+}
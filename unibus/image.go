@@ -0,0 +1,122 @@
+package unibus
+
+import (
+	"io"
+	"os"
+)
+
+// diskImage - disk image loaded to memory.
+// Every write done by the guest is written through to the image file.
+type diskImage struct {
+	rdisk []byte
+
+	// image attached in the read only mode - the drive is write protected
+	readOnly bool
+
+	// image file, nil for the image created in memory
+	file *os.File
+}
+
+// openImage reads the image file
+func openImage(path string, readOnly bool) (*diskImage, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &diskImage{rdisk: buf, readOnly: readOnly, file: file}, nil
+}
+
+// grow pads the image shorter than the disk with zeros.
+// The missing part is written to the file together with the first write to it.
+func (d *diskImage) grow(size int) {
+	if len(d.rdisk) < size {
+		d.rdisk = append(d.rdisk, make([]byte, size-len(d.rdisk))...)
+	}
+}
+
+// flush writes the modified part of the disk back to the image file
+func (d *diskImage) flush(from, to int) error {
+	if d.readOnly || d.file == nil {
+		return nil
+	}
+	_, err := d.file.WriteAt(d.rdisk[from:to], int64(from))
+	return err
+}
+
+// Modes of the word transfer between the image and the memory
+const (
+	imageRead = iota
+	imageWrite
+	imageWriteCheck
+)
+
+// imageTransfer is the word transfer between the disk image and the memory
+type imageTransfer struct {
+	mode int
+
+	// bus address of the next word, advanced by step after every word
+	addr Uint18
+	step Uint18
+
+	// words moved
+	words int
+
+	// transfer stopped at the address past the installed memory
+	nxm bool
+
+	// write check found a word different from the memory
+	mismatch bool
+}
+
+// transfer moves up to words words between the image at pos and the memory. It returns the end of the last sector
+// touched: a write fills the rest of the sector with zeros and writes the sectors back to the image file.
+func (d *diskImage) transfer(u *Unibus, t *imageTransfer, pos, words, sectorSize int) int {
+	start := pos
+	for ; t.words < words; t.words++ {
+		if t.addr >= u.memoryTop() {
+			t.nxm = true
+			break
+		}
+		disk := uint16(d.rdisk[pos]) | uint16(d.rdisk[pos+1])<<8
+		switch t.mode {
+		case imageWrite:
+			val := u.ReadIO(t.addr)
+			d.rdisk[pos] = byte(val & 0xFF)
+			d.rdisk[pos+1] = byte(val >> 8)
+		case imageWriteCheck:
+			if u.ReadIO(t.addr) != disk {
+				t.mismatch = true
+			}
+		default:
+			u.WriteIO(t.addr, disk)
+		}
+		pos += 2
+		t.addr = (t.addr + t.step) & 0x3FFFF
+	}
+
+	end := start + (pos-start+sectorSize-1)/sectorSize*sectorSize
+	if t.mode == imageWrite {
+		clear(d.rdisk[pos:end])
+		if err := d.flush(start, end); err != nil {
+			u.log.Printf("can't write sector to the disk image: %v\n", err)
+		}
+	}
+	return end
+}
+
+// close closes the image file
+func (d *diskImage) close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
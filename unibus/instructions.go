@@ -1,9 +1,5 @@
 package unibus
 
-import (
-	"pdp/psw"
-)
-
 // Definition of all PDP-11 CPU instructions
 // All should follow the func (*CPU) (int16) signature
 
@@ -186,8 +182,7 @@ func (c *CPU) sbcbOp(instruction uint16) {
 // tst - sets the condition codes N and Z according to the contents
 // of the destination address
 func (c *CPU) tstOp(instruction uint16) {
-	dstAddr := c.GetVirtualAddress(instruction&077, 0)
-	dest := c.mmunit.ReadMemoryWord(dstAddr)
+	dest := c.readWord(instruction & 077)
 
 	c.SetFlag("Z", dest == 0)
 	c.SetFlag("N", (dest&0x8000) > 0)
@@ -196,8 +191,7 @@ func (c *CPU) tstOp(instruction uint16) {
 }
 
 func (c *CPU) tstbOp(instruction uint16) {
-	dstAddr := c.GetVirtualAddress(instruction&077, 1)
-	dest := c.mmunit.ReadMemoryByte(dstAddr)
+	dest := c.readByte(instruction & 077)
 
 	c.SetFlag("Z", dest == 0)
 	c.SetFlag("N", (dest&0x80) > 0)
@@ -330,10 +324,11 @@ func (c *CPU) rolbOp(instruction uint16) {
 
 // jmp - jump to address:
 func (c *CPU) jmpOp(instruction uint16) {
-	dest := c.GetVirtualAddress(instruction&077, 0) // c.readWord(uint16(instruction & 077))
 	if instruction&070 == 0 {
-		panic("JMP: Can't jump to register")
+		c.illegalInstruction("JMP to register")
+		return
 	}
+	dest := c.GetVirtualAddress(instruction&077, 0)
 	c.Registers[7] = dest
 }
 
@@ -364,27 +359,40 @@ func (c *CPU) markOp(instruction uint16) {
 	c.Registers[5] = c.Pop()
 }
 
-// mfpi - move from previous instruction space
+// mfpi - move from previous instruction space.
+// With both the current and the previous mode user, MFPI reads the data space:
+// the user program can't read the instructions it is not allowed to see as data.
 func (c *CPU) mfpiOp(instruction uint16) {
-	var val uint16
-	dest := c.GetVirtualAddress(instruction&077, 0)
+	if c.IsUserMode() && c.IsPrevModeUser() {
+		c.moveFromPrevious(instruction, c.mmunit.DecodeData)
+		return
+	}
+	c.moveFromPrevious(instruction, c.mmunit.Decode)
+}
 
-	switch {
-	case dest == 0177706:
-		if c.IsUserMode() == c.IsPrevModeUser() {
-			val = c.Registers[6]
-		} else {
-			if c.IsPrevModeUser() { // user
-				val = c.UserStackPointer
-			} else {
-				val = c.KernelStackPointer
-			}
-		}
-	// if register:
-	case dest&0177770 == 0170000:
-		panic("MFPI attended on Register address")
-	default:
-		physicalAddress := c.mmunit.Decode(dest, false, c.IsPrevModeUser())
+// mfpd - move from previous data space
+func (c *CPU) mfpdOp(instruction uint16) {
+	c.moveFromPrevious(instruction, c.mmunit.DecodeData)
+}
+
+// previousRegister returns the register operand of MFPx/MTPx in the register mode:
+// R6 is the stack pointer of the previous mode, the other registers are shared by all the modes.
+func (c *CPU) previousRegister(reg uint16) *uint16 {
+	if reg == 6 {
+		return c.modeStackPointer(c.unibus.Psw.GetPreviousMode())
+	}
+	return &c.Registers[reg]
+}
+
+// moveFromPrevious pushes the word read from the address space of the previous mode.
+// decode translates the address in the instruction or data space.
+func (c *CPU) moveFromPrevious(instruction uint16, decode func(uint16, bool, uint16) Uint18) {
+	var val uint16
+	if instruction&070 == 0 {
+		val = *c.previousRegister(instruction & 07)
+	} else {
+		dest := c.GetVirtualAddress(instruction&077, 0)
+		physicalAddress := decode(dest, false, c.unibus.Psw.GetPreviousMode())
 		val = c.unibus.ReadIO(physicalAddress)
 	}
 
@@ -396,25 +404,25 @@ func (c *CPU) mfpiOp(instruction uint16) {
 
 // mtpi - move to previous instruction space
 func (c *CPU) mtpiOp(instruction uint16) {
-	destAddr := c.GetVirtualAddress(instruction&077, 0)
-	val := c.Pop()
+	c.moveToPrevious(instruction, c.mmunit.Decode)
+}
 
-	switch {
-	case destAddr == 0177706:
-		if c.IsUserMode() == c.IsPrevModeUser() {
-			c.Registers[6] = val
-		} else {
-			if c.IsPrevModeUser() {
-				c.UserStackPointer = val
-			} else {
-				c.KernelStackPointer = val
-			}
-		}
-	case destAddr&0177770 == 0170000:
-		panic("MTPI attended on Register address")
-	default:
-		sourceAddress := c.mmunit.Decode(destAddr, false, c.IsPrevModeUser())
-		c.unibus.WriteIO(sourceAddress, val)
+// mtpd - move to previous data space
+func (c *CPU) mtpdOp(instruction uint16) {
+	c.moveToPrevious(instruction, c.mmunit.DecodeData)
+}
+
+// moveToPrevious pops the word and writes it to the address space of the previous mode
+func (c *CPU) moveToPrevious(instruction uint16, decode func(uint16, bool, uint16) Uint18) {
+	var val uint16
+	if instruction&070 == 0 {
+		val = c.Pop()
+		*c.previousRegister(instruction & 07) = val
+	} else {
+		destAddr := c.GetVirtualAddress(instruction&077, 0)
+		val = c.Pop()
+		physicalAddress := decode(destAddr, true, c.unibus.Psw.GetPreviousMode())
+		c.unibus.WriteIO(physicalAddress, val)
 	}
 
 	// TODO: Not strictly needed
@@ -443,8 +451,7 @@ func (c *CPU) movOp(instruction uint16) {
 	source := (instruction & 07700) >> 6
 	dest := instruction & 077
 
-	srcAddr := c.GetVirtualAddress(source, 0)
-	sourceVal := c.mmunit.ReadMemoryWord(srcAddr)
+	sourceVal := c.readWord(source)
 	dstAddr := c.GetVirtualAddress(dest, 0)
 
 	c.SetFlag("N", (sourceVal&0x8000) > 0)
@@ -462,8 +469,7 @@ func (c *CPU) movbOp(instruction uint16) {
 	source := (instruction & 07700) >> 6
 	dest := instruction & 077
 
-	sourceAddr := c.GetVirtualAddress(source, 1)
-	sourceVal := c.mmunit.ReadMemoryByte(sourceAddr)
+	sourceVal := c.readByte(source)
 	destAddr := c.GetVirtualAddress(dest, 1)
 
 	c.SetFlag("Z", sourceVal == 0)
@@ -481,8 +487,13 @@ func (c *CPU) movbOp(instruction uint16) {
 }
 
 // misc instructions (decode all bits)
-// halt
+// halt - stops the processor in kernel mode.
+// HALT is a privileged instruction, in supervisor and user mode it traps to the vector 4.
 func (c *CPU) haltOp(_ uint16) {
+	if !c.isKernelMode() {
+		c.trapOpcode(04)
+		return
+	}
 	c.State = HALT
 }
 
@@ -496,51 +507,58 @@ func (c *CPU) iotOp(_ uint16) {
 	c.trapOpcode(020)
 }
 
-// rti - return from interrupt
+// rti - return from interrupt.
+// RTI restoring the T bit traps to 014 right after it.
 func (c *CPU) rtiOp(_ uint16) {
-	c.log.Printf("calling rti \n")
-	// DEBUG: POP from interrupt stack
-	//c.unibus.InterruptStack.Pop()
-
-	c.Registers[7] = c.Pop()
-	val := c.Pop()      // pop the PSW
-	if c.IsUserMode() { // why does it happen at all?
-		// DEBUG code
-		c.log.Printf("interrupt return in user mode\n")
-
-		// why is that needed at all??
-		val &= 047                          // Save the flags
-		val |= c.unibus.Psw.Get() & 0177730 // how is that correct?
+	c.returnFromInterrupt()
+	if c.unibus.Psw.T() {
+		c.traceTrap = true
 	}
-	c.unibus.WriteIO(PSWAddr, val)
 }
 
-// rtt - return from trap
+// rtt - return from trap.
+// Unlike RTI, RTT restoring the T bit lets the next instruction execute before the trace trap,
+// so that the debugger can step through the program.
 func (c *CPU) rttOp(_ uint16) {
-	//c.unibus.InterruptStack.Pop()
+	c.returnFromInterrupt()
+	if c.unibus.Psw.T() {
+		c.traceInhibit = true
+	}
+}
 
+// returnFromInterrupt pops the PC and PSW. Outside of the kernel mode the popped PSW
+// changes only the condition codes and the T bit, and it can't make the mode more privileged.
+func (c *CPU) returnFromInterrupt() {
 	c.Registers[7] = c.Pop()
-	val := c.Pop()      // pop the PSW
-	if c.IsUserMode() { // why does it happen at all?
-		c.log.Printf("Trap return in user mode\n")
-		val &= 047                          // Save the flags
-		val |= c.unibus.Psw.Get() & 0177730 // how is that correct?
+	val := c.Pop() // pop the PSW
+	if !c.isKernelMode() {
+		psw := c.unibus.Psw.Get()
+		val = (val|psw)&0170000 | psw&0007740 | val&037
 	}
-	c.unibus.WriteIO(PSWAddr, val)
-	// c.rtiOp(instruction)
+	c.SwitchMode(val >> 14)
+	c.unibus.Psw.Set(val)
 }
 
-// wait for interrupt
+// wait for interrupt. Outside of the kernel mode WAIT does nothing.
 func (c *CPU) waitOp(_ uint16) {
-	if !c.IsUserMode() {
+	if c.isKernelMode() {
 		c.State = WAIT
 	}
 }
 
-// Sends INIT on UNIBUS for 10ms. All devices on the UNIBUS are reset and power up
+// Sends INIT on UNIBUS for 10ms. All devices on the UNIBUS are reset and power up.
+// Outside of the kernel mode RESET does nothing.
 func (c *CPU) resetOp(_ uint16) {
-	c.unibus.Rk01.Reset()
-	c.unibus.TermEmulator.ClearTerminal()
+	if c.isKernelMode() {
+		c.unibus.ResetDevices()
+	}
+}
+
+// spl - set priority level. Outside of the kernel mode SPL does nothing.
+func (c *CPU) splOp(instruction uint16) {
+	if c.isKernelMode() {
+		c.unibus.Psw.Set(c.unibus.Psw.Get()&^0340 | (instruction&7)<<5)
+	}
 }
 
 // compare (2) - byte op included
@@ -623,10 +641,8 @@ func (c *CPU) bitbOp(instruction uint16) {
 	source := (instruction & 07700) >> 6
 	dest := instruction & 077
 
-	sourceAddr := c.GetVirtualAddress(source, 1)
-	sourceVal := c.mmunit.ReadMemoryByte(sourceAddr)
-	destAddr := c.GetVirtualAddress(dest, 1)
-	destVal := c.mmunit.ReadMemoryByte(destAddr)
+	sourceVal := c.readByte(source)
+	destVal := c.readByte(dest)
 
 	res := sourceVal & destVal
 	c.SetFlag("V", false)
@@ -682,9 +698,8 @@ func (c *CPU) bisOp(instruction uint16) {
 func (c *CPU) bisbOp(instruction uint16) {
 	source := (instruction >> 6) & 077
 	dest := instruction & 077
-	sourceAddr := c.GetVirtualAddress(source, 1)
+	sourceVal := c.readByte(source)
 	destAddr := c.GetVirtualAddress(dest, 1)
-	sourceVal := c.mmunit.ReadMemoryByte(sourceAddr)
 	destVal := c.mmunit.ReadMemoryByte(destAddr)
 
 	destVal = sourceVal | destVal
@@ -700,12 +715,11 @@ func (c *CPU) bisbOp(instruction uint16) {
 func (c *CPU) jsrOp(instruction uint16) {
 	register := (instruction >> 6) & 7
 	destination := instruction & 077
-	val := c.GetVirtualAddress(destination, 0)
-
-	// check if destination is register address. it shouldn't be
-	if (val & 0177770) == 0170000 {
-		panic("JSR to register. That should not happen")
+	if destination&070 == 0 {
+		c.illegalInstruction("JSR to register")
+		return
 	}
+	val := c.GetVirtualAddress(destination, 0)
 
 	c.Push(c.Registers[register])
 	c.Registers[register] = c.Registers[7]
@@ -799,8 +813,7 @@ func (c *CPU) ashOp(instruction uint16) {
 func (c *CPU) ashcOp(instruction uint16) {
 
 	var result uint32
-	destAddr := c.GetVirtualAddress(instruction&077, 0)
-	offset := uint8(c.mmunit.ReadMemoryWord(destAddr) & 077)
+	offset := uint8(c.readWord(instruction&077) & 077)
 	if offset == 0 {
 		return
 	}
@@ -864,23 +877,10 @@ func (c *CPU) sobOp(instruction uint16) {
 // todo: something fishy is going on here
 // todo: add test
 func (c *CPU) trapOpcode(vector uint16) {
-	prevPs := c.unibus.Psw.Get()
-	c.SwitchMode(psw.KernelMode)
-
-	// push current PS and PC to stack
-	c.Push(prevPs)
-	c.Push(c.Registers[7])
-
-	// load PC and PS from trap vector location
-	c.Registers[7] = c.mmunit.ReadMemoryWord(vector)
-	newPsw := c.mmunit.ReadMemoryWord(vector + 2)
-	if prevPs&(1<<14) > 0 {
-		newPsw |= (1 << 13) | (1 << 12)
-	}
-
-	// todo -> can the new PSW set the cpu to the user mode?
-
-	c.unibus.Psw.Set(newPsw)
+	// load PC and PS from trap vector location, push current PS and PC on the stack of the new mode
+	pc, ps := c.ReadVector(vector)
+	c.PushTrapFrame(c.unibus.Psw.Get(), ps)
+	c.Registers[7] = pc
 }
 
 // emt - emulator trap - trap vector hardcoded to location 32
@@ -905,46 +905,14 @@ func (c *CPU) rtsOp(instruction uint16) {
 	c.Registers[register] = c.Pop()
 }
 
-// clear flag opcodes
-// covers following operations: CLN, CLZ, CLV, CLC, CCC
+// clear flag opcodes: bits 3-0 of the instruction select N, Z, V and C to clear.
+// covers following operations: CLN, CLZ, CLV, CLC, CCC and their combinations
 func (c *CPU) clearFlagOp(instruction uint16) {
-
-	switch flag := instruction & 0777; flag {
-	case 0241:
-		c.SetFlag("C", false)
-	case 0242:
-		c.SetFlag("V", false)
-	case 0243:
-		c.SetFlag("C", false)
-		c.SetFlag("V", false)
-	case 0244:
-		c.SetFlag("Z", false)
-	case 0250:
-		c.SetFlag("N", false)
-	case 0257:
-		c.SetFlag("N", false)
-		c.SetFlag("Z", false)
-		c.SetFlag("C", false)
-		c.SetFlag("V", false)
-	}
+	c.unibus.Psw.Set(c.unibus.Psw.Get() &^ (instruction & 017))
 }
 
-// set flag opcodes
-// covers following operations: SEN, SEZ, SEV, SEC, SCC
+// set flag opcodes: bits 3-0 of the instruction select N, Z, V and C to set.
+// covers following operations: SEN, SEZ, SEV, SEC, SCC and their combinations
 func (c *CPU) setFlagOp(instruction uint16) {
-	switch flag := instruction & 0777; flag {
-	case 0261:
-		c.SetFlag("C", true)
-	case 0262:
-		c.SetFlag("V", true)
-	case 0264:
-		c.SetFlag("Z", true)
-	case 0270:
-		c.SetFlag("N", true)
-	case 0277:
-		c.SetFlag("N", true)
-		c.SetFlag("Z", true)
-		c.SetFlag("C", true)
-		c.SetFlag("V", true)
-	}
+	c.unibus.Psw.Set(c.unibus.Psw.Get() | instruction&017)
 }
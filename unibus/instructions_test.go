@@ -1069,3 +1069,128 @@ func TestCPU_trapOp(t *testing.T) {
 		})
 	}
 }
+
+func TestCPU_SupervisorMode(t *testing.T) {
+	u.Psw.Set(0)
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.PdpCPU.Registers[6] = 01000
+	u.PdpCPU.SupervisorStackPointer = 02000
+	u.PdpCPU.UserStackPointer = 03000
+
+	// TRAP from the user mode to the handler running in supervisor mode
+	u.Memory[034>>1] = 04000
+	u.Memory[036>>1] = 0040340
+	u.PdpCPU.SwitchMode(UserMode)
+	u.Psw.Set(0140017)
+	u.PdpCPU.Registers[7] = 05000
+	u.PdpCPU.trapOp(0)
+
+	if u.Psw.Get() != 0070340 {
+		t.Errorf("PSW = %06o, want supervisor mode with previous user mode", u.Psw.Get())
+	}
+	if u.PdpCPU.Registers[6] != 01774 || u.Memory[01774>>1] != 05000 || u.Memory[01776>>1] != 0140017 {
+		t.Errorf("trap frame: SP = %06o, PC = %06o, PSW = %06o",
+			u.PdpCPU.Registers[6], u.Memory[01774>>1], u.Memory[01776>>1])
+	}
+	if u.PdpCPU.KernelStackPointer != 01000 || u.PdpCPU.UserStackPointer != 03000 {
+		t.Errorf("kernel SP = %06o, user SP = %06o", u.PdpCPU.KernelStackPointer, u.PdpCPU.UserStackPointer)
+	}
+
+	// MFPI SP, MTPI SP in supervisor mode access the user stack pointer
+	u.PdpCPU.mfpiOp(0006506)
+	if u.PdpCPU.Registers[6] != 01772 || u.Memory[01772>>1] != 03000 {
+		t.Errorf("MFPI SP pushed %06o", u.Memory[01772>>1])
+	}
+	u.Memory[01772>>1] = 03100
+	u.PdpCPU.mtpiOp(0006606)
+	if u.PdpCPU.UserStackPointer != 03100 || u.PdpCPU.Registers[6] != 01774 {
+		t.Errorf("MTPI SP: user SP = %06o, SP = %06o", u.PdpCPU.UserStackPointer, u.PdpCPU.Registers[6])
+	}
+
+	// RTT returns to the user mode and its stack. Outside of the kernel mode,
+	// the priority is kept and the mode bits can't become more privileged.
+	u.PdpCPU.rttOp(0)
+	if u.Psw.Get() != 0170357 || u.PdpCPU.Registers[6] != 03100 || u.PdpCPU.SupervisorStackPointer != 02000 {
+		t.Errorf("RTT: PSW = %06o, SP = %06o, supervisor SP = %06o",
+			u.Psw.Get(), u.PdpCPU.Registers[6], u.PdpCPU.SupervisorStackPointer)
+	}
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.Psw.Set(0)
+}
+
+func TestCPU_PrivilegedInstructions(t *testing.T) {
+	u.Memory[04>>1] = 03000
+	u.Memory[06>>1] = 0340
+	for _, mode := range []uint16{SupervisorMode, UserMode} {
+		u.Psw.Set(0)
+		u.PdpCPU.SwitchMode(KernelMode)
+		u.PdpCPU.Registers[6] = 01000
+		u.PdpCPU.SwitchMode(mode)
+		u.PdpCPU.Registers[6] = 02000
+		u.PdpCPU.Registers[7] = 05000
+		u.PdpCPU.State = CPURUN
+
+		// WAIT and RESET are ignored
+		u.Clock.LKS = 0100
+		u.PdpCPU.waitOp(0)
+		u.PdpCPU.resetOp(0)
+		if u.PdpCPU.State != CPURUN || u.Clock.LKS != 0100 {
+			t.Errorf("mode %d: WAIT or RESET executed, state %v, LKS %06o", mode, u.PdpCPU.State, u.Clock.LKS)
+		}
+
+		// HALT traps to 4
+		u.PdpCPU.haltOp(0)
+		if u.PdpCPU.State != CPURUN || u.PdpCPU.Registers[7] != 03000 || u.Psw.GetMode() != KernelMode {
+			t.Errorf("mode %d: HALT state %v, PC %06o, PSW %06o", mode, u.PdpCPU.State, u.PdpCPU.Registers[7], u.Psw.Get())
+		}
+	}
+	u.Psw.Set(0)
+	u.Clock.Reset()
+}
+
+func TestCPU_MoveToFromPreviousRegister(t *testing.T) {
+	u.Psw.Set(0)
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.Psw.Set(0030000) // previous mode user
+	u.PdpCPU.Registers[6] = 01000
+	u.PdpCPU.UserStackPointer = 03000
+	u.PdpCPU.Registers[0] = 0123456
+
+	// MFPI R0 pushes R0 of the current register set
+	u.PdpCPU.mfpiOp(0006500)
+	if u.PdpCPU.Registers[6] != 0776 || u.Memory[0776>>1] != 0123456 || !u.PdpCPU.GetFlag("N") {
+		t.Errorf("MFPI R0: SP = %06o, pushed %06o", u.PdpCPU.Registers[6], u.Memory[0776>>1])
+	}
+	// MTPI R1 pops it to R1
+	u.PdpCPU.mtpiOp(0006601)
+	if u.PdpCPU.Registers[6] != 01000 || u.PdpCPU.Registers[1] != 0123456 {
+		t.Errorf("MTPI R1: SP = %06o, R1 = %06o", u.PdpCPU.Registers[6], u.PdpCPU.Registers[1])
+	}
+	// MFPD SP pushes the user stack pointer
+	u.PdpCPU.mfpdOp(0106506)
+	if u.PdpCPU.Registers[6] != 0776 || u.Memory[0776>>1] != 03000 {
+		t.Errorf("MFPD SP: SP = %06o, pushed %06o", u.PdpCPU.Registers[6], u.Memory[0776>>1])
+	}
+	u.Psw.Set(0)
+}
+
+func TestCPU_Spl(t *testing.T) {
+	u.Psw.Set(0)
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.Psw.Set(017)
+	u.PdpCPU.splOp(0000235)
+	if u.Psw.Get() != 0257 {
+		t.Errorf("kernel mode SPL 5: PSW = %06o", u.Psw.Get())
+	}
+
+	for _, mode := range []uint16{SupervisorMode, UserMode} {
+		u.PdpCPU.SwitchMode(mode)
+		psw := u.Psw.Get()
+		u.PdpCPU.splOp(0000237)
+		if u.Psw.Get() != psw {
+			t.Errorf("mode %d: SPL changed PSW %06o to %06o", mode, psw, u.Psw.Get())
+		}
+	}
+	u.PdpCPU.SwitchMode(KernelMode)
+	u.Psw.Set(0)
+}
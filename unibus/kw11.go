@@ -0,0 +1,74 @@
+package unibus
+
+import (
+	"pdp/interrupts"
+)
+
+// number of CPU steps between two clock ticks
+const clockTicks = 40000
+
+// KW11 - KW11-L line time clock
+type KW11 struct {
+	// LKS - clock status register.
+	// bit 7: clock monitor (set on every tick), bit 6: interrupt enable
+	LKS uint16
+
+	counter uint16
+	unibus  *Unibus
+}
+
+// NewKW11 returns new line clock
+func NewKW11(u *Unibus) *KW11 {
+	k := KW11{}
+	k.unibus = u
+	return &k
+}
+
+func (k *KW11) Name() string {
+	return "KW11"
+}
+
+// AddressRange - the clock has only the LKS register
+func (k *KW11) AddressRange() (Uint18, Uint18) {
+	return LKSAddr, LKSAddr
+}
+
+func (k *KW11) Read16(_ Uint18) (uint16, error) {
+	return k.LKS, nil
+}
+
+func (k *KW11) Write16(_ Uint18, data uint16) error {
+	k.LKS = data
+	return nil
+}
+
+func (k *KW11) Read8(addr Uint18) (uint16, error) {
+	return readByteFromWord(k, addr)
+}
+
+func (k *KW11) Write8(addr Uint18, data uint16) error {
+	return writeByteToWord(k, addr, data)
+}
+
+// Reset clears the interrupt enable bit
+func (k *KW11) Reset() {
+	k.LKS = 1 << 7
+}
+
+func (k *KW11) Vector() (uint16, uint16) {
+	return interrupts.IntCLOCK, 6
+}
+
+// Step - count CPU steps and tick the clock
+func (k *KW11) Step() {
+	k.counter++
+	if k.counter < clockTicks {
+		return
+	}
+	k.counter = 0
+	k.LKS |= 1 << 7
+	if k.LKS&(1<<6) != 0 {
+		vector, priority := k.Vector()
+		k.unibus.SendInterrupt(priority, vector)
+	}
+}
@@ -2,10 +2,11 @@ package unibus
 
 /*
 Interfaces and type definitions for the MMU
-(should definitely work for 18bit MMU, as used in 11/40)
+(18 bit MMU, as used in 11/40 and 22 bit MMU of 11/70)
 */
 
-// Uint18 is being unsed only in context of physical 18 bit address.
+// Uint18 is being used only in context of the physical address.
+// Despite the name, it keeps also 22 bit addresses of the 11/70.
 type Uint18 uint32
 
 type page struct {
@@ -22,16 +23,48 @@ type MMU interface {
 	WriteMemoryByte(addr uint16, data byte)
 
 	MmuEnabled() bool
-	Decode(a uint16, w, user bool) Uint18
+	// Decode translates the virtual address of the CPU mode (kernel, supervisor, user)
+	// in the instruction space, DecodeData in the data space
+	Decode(a uint16, w bool, mode uint16) Uint18
+	DecodeData(a uint16, w bool, mode uint16) Uint18
 
 	// SR0 getter and setter
 	SetSR0(v uint16)
+	SetSR1(v uint16)
 	SetSR2(v uint16)
 	GetSR0() uint16
+	GetSR1() uint16
 	GetSR2() uint16
 
-	SetPage(i int, p page)
+	// InstructionStart is called before the instruction fetch, RegisterChanged
+	// on every auto increment and decrement. Both keep SR1 and SR2 up to date,
+	// so that the abort handler can undo the register changes and restart the instruction.
+	InstructionStart(pc uint16)
+	RegisterChanged(reg uint16, delta int16)
+
+	// Reset clears status and page registers
+	Reset()
+
+	// snapshot support
+	SaveState() MMUState
+	RestoreState(s MMUState) error
 
 	// Debugging methods
 	DumpMemory() error
 }
+
+// frozen returns true if SR0 holds an abort. SR0, SR1 and SR2 are not updated,
+// until the software clears the abort bits.
+func frozen(sr0 uint16) bool {
+	return sr0&0160000 != 0
+}
+
+// recordRegister adds the register number and the 5 bit two's complement delta to SR1.
+// The first change goes to the lower byte, the second to the upper one.
+func recordRegister(sr1, reg uint16, delta int16) uint16 {
+	change := (uint16(delta)&037)<<3 | reg&7
+	if sr1 == 0 {
+		return change
+	}
+	return sr1&0377 | change<<8
+}
@@ -11,9 +11,9 @@ const DEBUG_MMU = false
 const RegisterAddressVirtual = 0177700
 
 type MMU18 struct {
-	SR0, SR2 uint16
-	pages    [16]page
-	unibus   *Unibus
+	SR0, SR1, SR2 uint16
+	pages         [16]page
+	unibus        *Unibus
 }
 
 func (p *page) read() bool   { return p.pdr&2 == 2 }
@@ -40,10 +40,8 @@ func (m *MMU18) Read16(addr Uint18) uint16 {
 	if (addr >= 0777640) && (addr < 0777660) {
 		return m.pages[i+8].par
 	}
-	panic(interrupts.Trap{
-		Vector: interrupts.IntBUS,
-		Msg:    fmt.Sprintf("Attempt to read from invalid address %06o", addr)})
-
+	m.unibus.busError("Attempt to read from invalid address %06o", addr)
+	return 0
 }
 
 func (m *MMU18) ReadMemoryWord(a uint16) uint16 {
@@ -51,7 +49,7 @@ func (m *MMU18) ReadMemoryWord(a uint16) uint16 {
 		return m.unibus.PdpCPU.Registers[a&7]
 	}
 
-	pAddr := m.Decode(a, false, m.unibus.PdpCPU.IsUserMode())
+	pAddr := m.Decode(a, false, m.unibus.Psw.GetMode())
 	return m.unibus.ReadIO(pAddr)
 }
 
@@ -60,7 +58,7 @@ func (m *MMU18) ReadMemoryByte(a uint16) byte {
 		return byte(m.unibus.PdpCPU.Registers[a&7] & 0xff)
 	}
 
-	pAddr := m.Decode(a, false, m.unibus.PdpCPU.IsUserMode())
+	pAddr := m.Decode(a, false, m.unibus.Psw.GetMode())
 	return byte(m.unibus.ReadIOByte(pAddr))
 }
 
@@ -82,9 +80,7 @@ func (m *MMU18) Write16(addr Uint18, data uint16) {
 		m.pages[i+8].par = data
 		return
 	}
-	panic(interrupts.Trap{
-		Vector: interrupts.IntBUS,
-		Msg:    fmt.Sprintf("Attempt to write to an invalid address %06o", addr)})
+	m.unibus.busError("Attempt to write to an invalid address %06o", addr)
 }
 
 func (m *MMU18) WriteMemoryWord(addr, data uint16) {
@@ -93,7 +89,7 @@ func (m *MMU18) WriteMemoryWord(addr, data uint16) {
 		return
 	}
 
-	pAddr := m.Decode(addr, true, m.unibus.PdpCPU.IsUserMode())
+	pAddr := m.Decode(addr, true, m.unibus.Psw.GetMode())
 	m.unibus.WriteIO(pAddr, data)
 }
 
@@ -104,7 +100,7 @@ func (m *MMU18) WriteMemoryByte(addr uint16, data byte) {
 		return
 	}
 
-	pAddr := m.Decode(addr, true, m.unibus.PdpCPU.IsUserMode())
+	pAddr := m.Decode(addr, true, m.unibus.Psw.GetMode())
 	m.unibus.WriteIOByte(pAddr, uint16(data))
 }
 
@@ -112,8 +108,14 @@ func (m *MMU18) MmuEnabled() bool {
 	return m.SR0&1 == 1
 }
 
-// Decode 16 bit virtual address to 18 bit physical address
-func (m *MMU18) Decode(a uint16, w, user bool) (addr Uint18) {
+// DecodeData - there are no separate data pages in 11/40, data references use the same pages as instructions
+func (m *MMU18) DecodeData(a uint16, w bool, mode uint16) Uint18 {
+	return m.Decode(a, w, mode)
+}
+
+// Decode 16 bit virtual address to 18 bit physical address.
+// There's no supervisor mode in 11/40, every mode but user uses the kernel pages.
+func (m *MMU18) Decode(a uint16, w bool, mode uint16) (addr Uint18) {
 	if !m.MmuEnabled() {
 		aa := Uint18(a)
 		if aa >= 0170000 { // unibus memory address space begin
@@ -124,47 +126,23 @@ func (m *MMU18) Decode(a uint16, w, user bool) (addr Uint18) {
 		}
 		return aa
 	}
+	user := mode == UserMode
 	offset := a >> 13
 	if user {
 		offset += 8
 	}
 	p := m.pages[offset]
-	if w && !p.write() {
-		m.SR0 = (1 << 13) | 1
-		m.SR0 |= a >> 12 & ^uint16(1)
-		if user {
-			m.SR0 |= (1 << 5) | (1 << 6)
-		}
-		m.SR2 = m.unibus.PdpCPU.Registers[7]
-		panic(interrupts.Trap{
-			Vector: interrupts.IntFAULT,
-			Msg:    fmt.Sprintf("Abort: write on read-only page %o\n", a)})
-	}
 	if !p.read() {
-		m.SR0 = (1 << 15) | 1
-		m.SR0 |= (a >> 12) & ^uint16(1)
-		if user {
-			m.SR0 |= (1 << 5) | (1 << 6)
-		}
-		m.SR2 = m.unibus.PdpCPU.Registers[7]
-		panic(interrupts.Trap{
-			Vector: interrupts.IntFAULT,
-			Msg:    fmt.Sprintf("read from no-access page %06o", a),
-		})
+		return m.abort(a, user, 1<<15, fmt.Sprintf("access to no-access page %06o", a))
+	}
+	if w && !p.write() {
+		return m.abort(a, user, 1<<13, fmt.Sprintf("write on read-only page %06o", a))
 	}
 	block := (a >> 6) & 0177
 	disp := Uint18(a & 077)
 	if p.ed() && block < p.len() || !p.ed() && block > p.len() {
-		m.SR0 = (1 << 14) | 1
-		m.SR0 |= (a >> 12) & ^uint16(1)
-		if user {
-			m.SR0 |= (1 << 5) | (1 << 6)
-		}
-		m.SR2 = m.unibus.PdpCPU.Registers[7]
-		panic(interrupts.Trap{
-			Vector: interrupts.IntFAULT,
-			Msg: fmt.Sprintf("page length exceeded, address %06o (block %03o) is beyond %03o",
-				a, block, p.len())})
+		return m.abort(a, user, 1<<14, fmt.Sprintf("page length exceeded, address %06o (block %03o) is beyond %03o",
+			a, block, p.len()))
 	}
 	if w {
 		p.pdr |= 1 << 6
@@ -177,10 +155,41 @@ func (m *MMU18) Decode(a uint16, w, user bool) (addr Uint18) {
 
 }
 
+// abort records the error, mode and page in SR0 and raises the MMU trap.
+// SR0 - SR2 stay frozen until the error bits are cleared by the software.
+func (m *MMU18) abort(a uint16, user bool, reason uint16, msg string) Uint18 {
+	if !frozen(m.SR0) && !m.unibus.TrapPending() {
+		m.SR0 = reason | (a>>12)&^1 | 1
+		if user {
+			m.SR0 |= (1 << 5) | (1 << 6)
+		}
+	}
+	m.unibus.Trap(interrupts.Trap{Vector: interrupts.IntFAULT, Msg: "Abort: " + msg})
+	return 0
+}
+
+// InstructionStart clears SR1 and saves the address of the instruction in SR2
+func (m *MMU18) InstructionStart(pc uint16) {
+	if !frozen(m.SR0) {
+		m.SR1, m.SR2 = 0, pc
+	}
+}
+
+// RegisterChanged records the auto increment or decrement of the register in SR1
+func (m *MMU18) RegisterChanged(reg uint16, delta int16) {
+	if !frozen(m.SR0) {
+		m.SR1 = recordRegister(m.SR1, reg, delta)
+	}
+}
+
 func (m *MMU18) GetSR0() uint16 {
 	return m.SR0
 }
 
+func (m *MMU18) GetSR1() uint16 {
+	return m.SR1
+}
+
 func (m *MMU18) GetSR2() uint16 {
 	return m.SR2
 }
@@ -189,12 +198,18 @@ func (m *MMU18) SetSR0(v uint16) {
 	m.SR0 = v
 }
 
+func (m *MMU18) SetSR1(v uint16) {
+	m.SR1 = v
+}
+
 func (m *MMU18) SetSR2(v uint16) {
 	m.SR2 = v
 }
 
-func (m *MMU18) SetPage(i int, p page) {
-	m.pages[i] = p
+// Reset clears status and all page registers
+func (m *MMU18) Reset() {
+	m.SR0, m.SR1, m.SR2 = 0, 0, 0
+	m.pages = [16]page{}
 }
 
 func NewMMU18(unibus *Unibus) *MMU18 {
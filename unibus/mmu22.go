@@ -2,135 +2,280 @@ package unibus
 
 import (
 	"fmt"
-	"pdp/psw"
+	"pdp/interrupts"
 )
 
 /*
-UNFINISHED implementation of the 22 bit MMU used in pdp11/70
+22 bit memory management unit (KT11-C), as used in pdp11/70.
 
+Compared to the 18 bit MMU of the 11/40, it adds:
+  - supervisor mode page set,
+  - separate instruction and data page sets for each mode, enabled in SR3,
+  - 22 bit relocation, enabled in SR3. Page address field is 16 bits wide.
+
+The 11/45 uses the same MMU without the 22 bit relocation, its physical address space is 18 bit wide.
+
+With 22 bit mapping disabled, relocated addresses are 18 bit wide,
+and the top 8K of the 18 bit space is mapped to the I/O page.
+The I/O page lives at the top of the 22 bit physical address space (017760000).
 */
 
-// memory related constans (by far not all needed -- figuring out as while writing)
+// 22 bit physical address space
+const (
+	// IOPage22Addr - begin of the I/O page in the 22 bit physical address space
+	IOPage22Addr = 017760000
+
+	// MEMSIZE22 - maximal memory size of the 22 bit machine. (4MB - 8K of the I/O page)
+	MEMSIZE22 = IOPage22Addr
+)
+
+// SR3 bits
 const (
-	// ByteMode -> Read addresses by byte, not by word (?)
-	ByteMode = 1
-
-	//IO base UNIBUS adresses:
-	IObaseVirtual = 0160000
-	IObase18bit   = 0760000
-	IObaseUnibus  = 017000000
-	IObase22bit   = 017760000
+	sr3UserD       = 1 << 0
+	sr3SupervisorD = 1 << 1
+	sr3KernelD     = 1 << 2
+	sr3Enable22    = 1 << 4
+	sr3UnibusMap   = 1 << 5
+	sr3Mask        = sr3UserD | sr3SupervisorD | sr3KernelD | sr3Enable22 | sr3UnibusMap
+)
+
+// instruction and data page sets
+const (
+	iSpace = 0
+	dSpace = 1
 )
 
-// MMU related functionality - translating virtual to physical addresses.
 type MMU22 struct {
-	Memory          *[4 * 1024 * 1024]byte
-	MMR             [4]int16 // Memory Management Registers
-	MMR3Map         [4]int16 // Map from mode to MMR3 I/D bit mask
-	MMUEnable       int16
-	MMULastMode     int
-	MMMULastVirtual uint16
-
-	// Current memory management mode:
-	// 0 = kernel
-	// 1 = super
-	// 2 = undefined
-	// 3 = user
-	// Typically this should be set by writing PSW (Processor Status Word).
-	// There are though few instructions moving data between address spaces.
-	// Those modify the MMU Mode without writing the PSW and set it back if all worked OK
-	MMUMode int
-
-	// MMU Page Address Registers
-	// relying on zero-initialization
-	// 0 = kernel
-	// 1 = super
-	// 2 = unused
-	// 3 = user
-	MMUPar [4][16]int16
-
-	// Page description Regiserts
-	MMUPDR [4][16]int16
-
-	// Processor status word.
-	// MMU puts it in either 0177776 or 0777776 location
-	// (and I'm not really sure which is user where)
-	Psw psw.PSW
-}
-
-// MapVirtualToPhysical maps the 17 bit I/D virtual address to a 22 bit physical address
-// TODO: All checks and specifics (i.e. 18bit calculation)
-func (m *MMU22) MapVirtualToPhysical(virtualAddress uint16, accessMask int16) uint32 {
-	var physicalAddress uint32
-	// this access doesn't require MMU
-	if (accessMask & m.MMUEnable) == 0 {
-		physicalAddress = uint32(virtualAddress & 0xffff) // virtual addr. without mmu is 16 bit!
-		m.MMMULastVirtual = virtualAddress & 0xffff
-		// TODO: add boundary checks, throw trap if fail
-		return physicalAddress
-		// in any other case, MMU is required:
-	}
-
-	// In any other case MMU translation is required.
-	m.MMMULastVirtual = virtualAddress
-
-	// address page -> oldest 3 bits points to the MMR keeping it
-	page := virtualAddress >> 13
-	fmt.Printf("DEBUG: page: %#o\n", page)
-	// TODO: Add error checking like in pdp11.js, line 484
-
-	// TODO: is it used anywhere?
-	// pdr: address pointed by PAR:
-	pdr := m.MMUPDR[m.MMUMode][page]
-	fmt.Printf("DEBUG: pdr: %#o\n", pdr)
-
-	// physical address calculation:
-	physicalAddress = (uint32(m.MMUPar[m.MMUMode][page]<<6) + uint32(virtualAddress&0x1FFF)) & 0x3fffff
-	return physicalAddress
-}
-
-// ReadMemoryWord reads 16 bit word from the memory
-// params:
-// addr : 16 bit virtual address
-// returns: 16 bit word
-func (m *MMU22) ReadMemoryWord(addr uint16) uint16 {
-	// NO MMU SUPPORT SO FAR, 16 bit ADDRESSING ONLY HERE!!
-	lowerBit := m.Memory[addr]
-	higherBit := m.Memory[addr+1]
-	returnWord := uint16(higherBit) << 8
-	return returnWord | uint16(lowerBit)
-}
-
-// ReadMemoryByte returns single byte from the memory
-// TODO: add virtual to physical address translation call
-// params:
-// addr: 16 bit virtual address
-// returns: byte
-func (m *MMU22) ReadMemoryByte(addr uint16) byte {
+	SR0, SR1, SR2, SR3 uint16
+
+	// 22 bit relocation is available (11/70)
+	addr22 bool
+
+	// page registers: [mode][I/D][page]. Mode 2 is undefined, its pages are never used.
+	pages  [4][2][8]page
+	unibus *Unibus
+}
+
+// NewMMU22 returns the 22 bit MMU, with memory management disabled
+func NewMMU22(unibus *Unibus) *MMU22 {
+	return &MMU22{unibus: unibus, addr22: true}
+}
+
+// pageRegister returns pointer to the PAR or PDR at the I/O page address, or nil.
+// Every mode has a block of 32 registers: PDR I 0-7, PDR D 0-7, PAR I 0-7, PAR D 0-7.
+func (m *MMU22) pageRegister(addr Uint18) *uint16 {
+	var mode int
+	switch {
+	case addr >= KernelPagesAddr && addr < KernelPagesAddr+0100:
+		mode = KernelMode
+	case addr >= SupervisorPagesAddr && addr < SupervisorPagesAddr+0100:
+		mode = SupervisorMode
+	case addr >= UserPagesAddr && addr < UserPagesAddr+0100:
+		mode = UserMode
+	default:
+		return nil
+	}
+
+	i := (addr & 077) >> 1
+	p := &m.pages[mode][(i>>3)&1][i&7]
+	if i < 16 {
+		return &p.pdr
+	}
+	return &p.par
+}
+
+func (m *MMU22) Read16(addr Uint18) uint16 {
+	if r := m.pageRegister(addr); r != nil {
+		return *r
+	}
+	m.unibus.busError("Attempt to read from invalid address %06o", addr)
+	return 0
+}
+
+func (m *MMU22) Write16(addr Uint18, data uint16) {
+	r := m.pageRegister(addr)
+	if r == nil {
+		m.unibus.busError("Attempt to write to an invalid address %06o", addr)
+		return
+	}
+	// writing the PDR clears the W bit, unused bits read as zeros
+	if addr&040 == 0 {
+		data &= 077417
+	}
+	*r = data
+}
+
+func (m *MMU22) ReadMemoryWord(a uint16) uint16 {
+	if a&0177770 == RegisterAddressVirtual {
+		return m.unibus.PdpCPU.Registers[a&7]
+	}
+	return m.unibus.ReadIO(m.decode(a, false, m.unibus.Psw.GetMode(), dSpace))
+}
+
+func (m *MMU22) ReadMemoryByte(a uint16) byte {
+	if a&0177770 == RegisterAddressVirtual {
+		return byte(m.unibus.PdpCPU.Registers[a&7] & 0xff)
+	}
+	return byte(m.unibus.ReadIOByte(m.decode(a, false, m.unibus.Psw.GetMode(), dSpace)))
+}
+
+func (m *MMU22) WriteMemoryWord(addr, data uint16) {
+	if addr&0177770 == RegisterAddressVirtual {
+		m.unibus.PdpCPU.Registers[addr&7] = data
+		return
+	}
+	m.unibus.WriteIO(m.decode(addr, true, m.unibus.Psw.GetMode(), dSpace), data)
+}
+
+func (m *MMU22) WriteMemoryByte(addr uint16, data byte) {
+	if addr&0177770 == RegisterAddressVirtual {
+		m.unibus.PdpCPU.Registers[addr&7] = uint16(data)
+		return
+	}
+	m.unibus.WriteIOByte(m.decode(addr, true, m.unibus.Psw.GetMode(), dSpace), uint16(data))
+}
+
+func (m *MMU22) MmuEnabled() bool {
+	return m.SR0&1 == 1
+}
+
+// Decode translates the virtual address in the instruction space of the mode to the 22 bit physical address
+func (m *MMU22) Decode(a uint16, w bool, mode uint16) Uint18 {
+	return m.decode(a, w, mode, iSpace)
+}
+
+// DecodeData translates the virtual address in the data space of the mode to the 22 bit physical address
+func (m *MMU22) DecodeData(a uint16, w bool, mode uint16) Uint18 {
+	return m.decode(a, w, mode, dSpace)
+}
+
+// decode translates the virtual address to the 22 bit physical address.
+// Data space is used only if it is enabled in SR3 for the mode, otherwise D references go to the I pages.
+func (m *MMU22) decode(a uint16, w bool, mode uint16, space int) Uint18 {
+	if !m.MmuEnabled() {
+		aa := Uint18(a)
+		if aa >= 0160000 {
+			aa += m.unibus.ioPage - 0160000
+		}
+		return aa
+	}
+
+	if space == dSpace && !m.dSpaceEnabled(mode) {
+		space = iSpace
+	}
+	n := a >> 13
+	p := &m.pages[mode&3][space][n]
+
+	// access control field:
+	// 0, 3, 7 - non resident, 1, 2 - read only, 4, 5, 6 - read/write
+	switch p.pdr & 7 {
+	case 0, 3, 7:
+		return m.abort(a, mode, space, 1<<15, fmt.Sprintf("access to non-resident page, address %06o", a))
+	case 1, 2:
+		if w {
+			return m.abort(a, mode, space, 1<<13, fmt.Sprintf("write to read-only page, address %06o", a))
+		}
+	}
+
+	block := (a >> 6) & 0177
+	if p.ed() && block < p.len() || !p.ed() && block > p.len() {
+		return m.abort(a, mode, space, 1<<14, fmt.Sprintf("page length exceeded, address %06o (block %03o) is beyond %03o",
+			a, block, p.len()))
+	}
+	if w {
+		p.pdr |= 1 << 6
+	}
+
+	aa := ((Uint18(block) + Uint18(p.par)) << 6) + Uint18(a&077)
+	if m.SR3&sr3Enable22 != 0 {
+		return aa & 017777777
+	}
+	aa &= 0777777
+	if aa >= IOPageAddr {
+		aa += m.unibus.ioPage - IOPageAddr
+	}
+	return aa
+}
+
+// dSpaceEnabled returns true if the mode uses separate data pages
+func (m *MMU22) dSpaceEnabled(mode uint16) bool {
+	switch mode {
+	case KernelMode:
+		return m.SR3&sr3KernelD != 0
+	case SupervisorMode:
+		return m.SR3&sr3SupervisorD != 0
+	case UserMode:
+		return m.SR3&sr3UserD != 0
+	}
+	return false
+}
+
+// abort sets the error bits, mode, page and space in SR0 and raises the MMU trap.
+// SR0 - SR2 stay frozen until the error bits are cleared by the software.
+func (m *MMU22) abort(a, mode uint16, space int, reason uint16, msg string) Uint18 {
+	if !frozen(m.SR0) && !m.unibus.TrapPending() {
+		m.SR0 = reason | (mode&3)<<5 | (a>>12)&^1 | 1
+		if space == dSpace {
+			m.SR0 |= 1 << 4
+		}
+	}
+	m.unibus.Trap(interrupts.Trap{Vector: interrupts.IntFAULT, Msg: "Abort: " + msg})
 	return 0
 }
 
-// WriteMemoryWord writes 16 bit word at the memory address
-// passed as function parameter
-// params:
-// addr: 16 bit virtual address
-// data: 16 bit word to write
-// returns: error
-// TODO: is it proper order?
-func (m *MMU22) WriteMemoryWord(addr, data uint16) error {
-	lowerByte := byte(data & 0xff)
-	upperByte := byte(data >> 8)
-	m.Memory[addr] = lowerByte
-	m.Memory[addr+1] = upperByte
-	return nil
-}
-
-// WriteMemoryByte writes 8 bit byte at the memory address
-// passed as function parameter
-// params:
-// addr: 16 bit virtual addr
-// data: byte to be written
-// returns: error
-func (m *MMU22) WriteMemoryByte(addr uint16, data byte) error {
-	return nil
+// InstructionStart clears SR1 and saves the address of the instruction in SR2
+func (m *MMU22) InstructionStart(pc uint16) {
+	if !frozen(m.SR0) {
+		m.SR1, m.SR2 = 0, pc
+	}
+}
+
+// RegisterChanged records the auto increment or decrement of the register in SR1
+func (m *MMU22) RegisterChanged(reg uint16, delta int16) {
+	if !frozen(m.SR0) {
+		m.SR1 = recordRegister(m.SR1, reg, delta)
+	}
+}
+
+func (m *MMU22) GetSR0() uint16 {
+	return m.SR0
+}
+
+func (m *MMU22) GetSR1() uint16 {
+	return m.SR1
+}
+
+func (m *MMU22) GetSR2() uint16 {
+	return m.SR2
+}
+
+func (m *MMU22) SetSR0(v uint16) {
+	m.SR0 = v
+}
+
+func (m *MMU22) SetSR1(v uint16) {
+	m.SR1 = v
+}
+
+func (m *MMU22) SetSR2(v uint16) {
+	m.SR2 = v
+}
+
+// GetSR3 returns the SR3, mapped at 0772516
+func (m *MMU22) GetSR3() uint16 {
+	return m.SR3
+}
+
+// SetSR3 sets the D space enables, 22 bit mapping and Unibus map relocation
+func (m *MMU22) SetSR3(v uint16) {
+	m.SR3 = v & sr3Mask
+	if !m.addr22 {
+		m.SR3 &^= sr3Enable22 | sr3UnibusMap
+	}
+}
+
+// Reset clears status and all page registers
+func (m *MMU22) Reset() {
+	m.SR0, m.SR1, m.SR2, m.SR3 = 0, 0, 0, 0
+	m.pages = [4][2][8]page{}
 }
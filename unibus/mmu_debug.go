@@ -7,14 +7,23 @@ import (
 
 // DumpMemory writes "size" words into file
 func (m *MMU18) DumpMemory() error {
+	return dumpMemory(m.unibus.Memory)
+}
+
+// DumpMemory writes the whole memory into file
+func (m *MMU22) DumpMemory() error {
+	return dumpMemory(m.unibus.Memory)
+}
+
+func dumpMemory(memory []uint16) error {
 	file, err := os.Create("mem_dmp.txt")
 	if err != nil {
 		return err
 	}
 
 	defer file.Close()
-	for i := 0; i < 0760000/2; i++ {
-		fmt.Fprintf(file, "%06o : %06o\n", i*2, m.unibus.Memory[i])
+	for i := range memory {
+		fmt.Fprintf(file, "%06o : %06o\n", i*2, memory[i])
 	}
 	return err
 }
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"pdp/console"
+	"pdp/interrupts"
 	"pdp/psw"
 	"testing"
 )
@@ -28,9 +29,255 @@ func TestMMU_DecodeAddress(t *testing.T) {
 	u.Mmu.Write16(0772314, 077606)
 
 	t.Run("Decode 16 bit virtual address to 18 bit physical", func(t *testing.T) {
-		decodedAddress := u.Mmu.Decode(virtualAddress, false, false)
+		decodedAddress := u.Mmu.Decode(virtualAddress, false, KernelMode)
 		if decodedAddress != physicalAddress {
 			t.Errorf("Expected decoded address to equal %06o, got %06o", physicalAddress, decodedAddress)
 		}
 	})
 }
+
+func TestMMU22_Decode(t *testing.T) {
+	p := psw.PSW(0)
+	var cons console.Console = console.NewSimple()
+	l := log.New(os.Stdout, "PDP", log.Ldate|log.Ltime|log.Lshortfile)
+	u := New(&p, nil, &cons, false, l)
+	if err := u.InstallMMU22(); err != nil {
+		t.Fatalf("can't install MMU22: %v", err)
+	}
+	if err := u.SetMemorySize(MEMSIZE22); err != nil {
+		t.Fatalf("can't set memory size: %v", err)
+	}
+
+	t.Run("I/O page without memory management", func(t *testing.T) {
+		if got := u.Mmu.Decode(0177776, false, KernelMode); got != 017777776 {
+			t.Errorf("expected %08o, got %08o", 017777776, got)
+		}
+		u.Psw.Set(017)
+		if got := u.ReadIO(u.IOAddress(PSWAddr)); got != 017 {
+			t.Errorf("expected PSW %06o, got %06o", 017, got)
+		}
+	})
+
+	// kernel page 1: read/write, full length, relocated to 2MB
+	u.WriteIO(u.IOAddress(KernelPagesAddr+2), 077406)
+	u.WriteIO(u.IOAddress(KernelPagesAddr+042), 0100000)
+	// user page 0: read only
+	u.WriteIO(u.IOAddress(UserPagesAddr), 077402)
+	// user D page 0
+	u.WriteIO(u.IOAddress(UserPagesAddr+020), 077406)
+	u.WriteIO(u.IOAddress(UserPagesAddr+060), 0200)
+	u.Mmu.SetSR0(1)
+
+	tests := []struct {
+		name     string
+		sr3      uint16
+		virtual  uint16
+		mode     uint16
+		physical Uint18
+	}{
+		{"22 bit mapping", sr3Enable22, 020010, KernelMode, 010000010},
+		{"18 bit mapping", 0, 020010, KernelMode, 000000010},
+		{"user I space", sr3Enable22 | sr3UserD, 0100, UserMode, 0100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u.WriteIO(u.IOAddress(SR3Addr), tt.sr3)
+			if got := u.Mmu.Decode(tt.virtual, false, tt.mode); got != tt.physical {
+				t.Errorf("expected %08o, got %08o", tt.physical, got)
+			}
+		})
+	}
+
+	t.Run("user D space", func(t *testing.T) {
+		u.Psw.Set(0140000)
+		defer u.Psw.Set(0)
+		u.WriteIO(u.IOAddress(SR3Addr), sr3Enable22|sr3UserD)
+		u.Memory[(0200<<6+0100)>>1] = 0123456
+		if got := u.Mmu.ReadMemoryWord(0100); got != 0123456 {
+			t.Errorf("expected %06o, got %06o", 0123456, got)
+		}
+	})
+
+	t.Run("write to read-only page aborts", func(t *testing.T) {
+		u.Mmu.Decode(0100, true, UserMode)
+		trap, ok := u.TakeTrap()
+		if !ok || trap.Vector != interrupts.IntFAULT {
+			t.Errorf("expected MMU abort, got %v", trap)
+		}
+		if sr0 := u.Mmu.GetSR0(); sr0&(1<<13) == 0 || (sr0>>5)&3 != UserMode {
+			t.Errorf("unexpected SR0 %06o", sr0)
+		}
+	})
+}
+
+func TestMMU_SR1(t *testing.T) {
+	p := psw.PSW(0)
+	var cons console.Console = console.NewSimple()
+	l := log.New(os.Stdout, "PDP", log.Ldate|log.Ltime|log.Lshortfile)
+	u := New(&p, nil, &cons, false, l)
+
+	// kernel page 0 read/write, page 1 no access
+	u.WriteIO(KernelPagesAddr, 077406)
+	u.Mmu.SetSR0(1)
+
+	// MOV (R1)+, -(R2)
+	u.Memory[01000>>1] = 012142
+	u.PdpCPU.Registers[1] = 02000
+	u.PdpCPU.Registers[2] = 020002
+	u.PdpCPU.Registers[7] = 01000
+	u.PdpCPU.State = CPURUN
+
+	execute := func() interrupts.Trap {
+		u.PdpCPU.Execute()
+		trap, _ := u.TakeTrap()
+		return trap
+	}
+
+	if trap := execute(); trap.Vector != interrupts.IntFAULT {
+		t.Fatalf("expected MMU abort, got %v", trap)
+	}
+	// aborted instruction keeps only the register changes recorded in SR1
+	if r1, r2 := u.PdpCPU.Registers[1], u.PdpCPU.Registers[2]; r1 != 02002 || r2 != 020000 {
+		t.Errorf("expected R1 = 002002, R2 = 020000, got %06o, %06o", r1, r2)
+	}
+	if sr1 := u.ReadIO(SR1Addr); sr1 != 0171021 {
+		t.Errorf("expected SR1 %06o, got %06o", 0171021, sr1)
+	}
+	if sr2 := u.Mmu.GetSR2(); sr2 != 01000 {
+		t.Errorf("expected SR2 %06o, got %06o", 01000, sr2)
+	}
+	sr0 := u.Mmu.GetSR0()
+	if sr0 != 0100003 {
+		t.Errorf("expected SR0 %06o, got %06o", 0100003, sr0)
+	}
+
+	t.Run("status registers are frozen", func(t *testing.T) {
+		u.PdpCPU.Registers[7] = 01000
+		u.PdpCPU.Registers[2] = 0140002
+		execute()
+		if u.Mmu.GetSR0() != sr0 || u.Mmu.GetSR1() != 0171021 {
+			t.Errorf("status changed: SR0 %06o, SR1 %06o", u.Mmu.GetSR0(), u.Mmu.GetSR1())
+		}
+	})
+
+	t.Run("cleared abort releases the status registers", func(t *testing.T) {
+		u.WriteIO(SR0Addr, 1)
+		u.PdpCPU.Registers[7] = 01000
+		u.PdpCPU.Registers[1] = 02000
+		u.PdpCPU.Registers[2] = 02002
+		if trap := execute(); trap.Vector != 0 {
+			t.Fatalf("unexpected trap %v", trap)
+		}
+		if sr1 := u.Mmu.GetSR1(); sr1 != 0171021 {
+			t.Errorf("expected SR1 %06o, got %06o", 0171021, sr1)
+		}
+		if sr2 := u.Mmu.GetSR2(); sr2 != 01000 {
+			t.Errorf("expected SR2 %06o, got %06o", 01000, sr2)
+		}
+	})
+}
+
+func TestMMU22_SplitID(t *testing.T) {
+	m := newModel(t, "11/70")
+	cpu := m.PdpCPU
+
+	// kernel I page 0 unrelocated, kernel D page 0 at 020000, user D page 0 at 040000
+	m.WriteIO(m.IOAddress(KernelPagesAddr), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+020), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+060), 0200)
+	m.WriteIO(m.IOAddress(UserPagesAddr+020), 077406)
+	m.WriteIO(m.IOAddress(UserPagesAddr+060), 0400)
+	m.WriteIO(m.IOAddress(SR3Addr), sr3KernelD|sr3UserD)
+	m.Mmu.SetSR0(1)
+
+	program := []uint16{
+		012700, 0123, // MOV #123, R0
+		013701, 02000, // MOV @#2000, R1
+		0106537, 02000, // MFPD @#2000
+		0106637, 02002, // MTPD @#2002
+	}
+	for i, w := range program {
+		m.Memory[01000>>1+i] = w
+	}
+	m.Memory[(020000+02000)>>1] = 0111
+	m.Memory[(040000+02000)>>1] = 0222
+	m.Psw.Set(030000)
+	cpu.Registers[6] = 0700
+	cpu.Registers[7] = 01000
+	cpu.State = CPURUN
+	for range 4 {
+		cpu.Execute()
+		if trap, ok := m.TakeTrap(); ok {
+			t.Fatalf("unexpected trap: %s", trap.Msg)
+		}
+	}
+
+	if cpu.Registers[0] != 0123 {
+		t.Errorf("immediate operand read from the D space: R0 = %06o", cpu.Registers[0])
+	}
+	if cpu.Registers[1] != 0111 {
+		t.Errorf("absolute operand not read from the D space: R1 = %06o", cpu.Registers[1])
+	}
+	if got := m.Memory[(040000+02002)>>1]; got != 0222 {
+		t.Errorf("MFPD / MTPD copied %06o, want %06o", got, 0222)
+	}
+	if cpu.Registers[6] != 0700 {
+		t.Errorf("SP = %06o", cpu.Registers[6])
+	}
+}
+
+func TestMMU22_ImmediateSharesDataAddress(t *testing.T) {
+	m := newModel(t, "11/70")
+	cpu := m.PdpCPU
+
+	// kernel I page 0 unrelocated, kernel D page 0 at 020000
+	m.WriteIO(m.IOAddress(KernelPagesAddr), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+020), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+060), 0200)
+	m.WriteIO(m.IOAddress(SR3Addr), sr3KernelD)
+	m.Mmu.SetSR0(1)
+
+	// the immediate operand is at I:1002, the destination at D:1002
+	m.Memory[01000>>1] = 052737 // BIS #4, @#1002
+	m.Memory[01002>>1] = 4
+	m.Memory[01004>>1] = 01002
+	m.Memory[(020000+01002)>>1] = 010
+	m.Psw.Set(0)
+	cpu.Registers[7] = 01000
+	cpu.State = CPURUN
+	cpu.Execute()
+	if trap, ok := m.TakeTrap(); ok {
+		t.Fatalf("unexpected trap: %s", trap.Msg)
+	}
+
+	if got := m.Memory[(020000+01002)>>1]; got != 014 {
+		t.Errorf("D:1002 = %06o, want 000014", got)
+	}
+	if got := m.Memory[01002>>1]; got != 4 {
+		t.Errorf("immediate operand at I:1002 modified to %06o", got)
+	}
+}
+
+func TestMMU22_RedStackTrap(t *testing.T) {
+	m := newModel(t, "11/70")
+	cpu := m.PdpCPU
+
+	// kernel D page 0 at 020000: the frame and the vector are in the kernel data space
+	m.WriteIO(m.IOAddress(KernelPagesAddr), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+020), 077406)
+	m.WriteIO(m.IOAddress(KernelPagesAddr+060), 0200)
+	m.WriteIO(m.IOAddress(SR3Addr), sr3KernelD)
+	m.Mmu.SetSR0(1)
+	m.Memory[(020000+04)>>1] = 03000
+	m.Memory[(020000+06)>>1] = 0340
+
+	m.Psw.Set(017)
+	cpu.Registers[7] = 01234
+	cpu.RedStackTrap(017)
+	if m.Memory[020000>>1] != 01234 || m.Memory[020002>>1] != 017 || m.Memory[0] != 0 {
+		t.Errorf("expected the frame at D:0, got PC %06o, PSW %06o", m.Memory[020000>>1], m.Memory[020002>>1])
+	}
+	if cpu.Registers[6] != 0 || cpu.Registers[7] != 03000 {
+		t.Errorf("SP = %06o, PC = %06o", cpu.Registers[6], cpu.Registers[7])
+	}
+}
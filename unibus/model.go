@@ -0,0 +1,154 @@
+package unibus
+
+import "fmt"
+
+// Model - features of the CPU model: instruction set, memory management and model specific behaviour
+type Model struct {
+	Name string
+
+	// Extended - MARK, MFPI, MTPI, SXT, XOR, SOB and RTT, missing in the 11/20
+	Extended bool
+
+	// EIS - MUL, DIV, ASH and ASHC
+	EIS bool
+
+	// FIS - KE11-F floating instruction set
+	FIS bool
+
+	// FPP - FP11 floating point processor
+	FPP bool
+
+	// AddressBits - width of the physical address: 16 without the MMU, 18 or 22
+	AddressBits int
+
+	// Supervisor - supervisor mode and its page set
+	Supervisor bool
+
+	// SplitID - separate instruction and data spaces, MFPD and MTPD
+	SplitID bool
+
+	// StackLimit - programmable stack limit register. Other models have the kernel stack limit fixed at 0400
+	StackLimit bool
+
+	// IncrementedSource - OPR R,(R)+ and OPR R,-(R) use the incremented or decremented R
+	// as the source operand, so MOV SP,-(SP) pushes the new SP. Later models use the initial R.
+	IncrementedSource bool
+
+	// KB11 - the CPU of the 11/45 and 11/70. JMP and JSR to a register trap to 010 as reserved instructions,
+	// the other models trap them to 4.
+	KB11 bool
+}
+
+// defaultModel - model of the CPU returned by NewCPU
+const defaultModel = "11/40"
+
+// Models - supported CPU models
+var Models = map[string]Model{
+	"11/20": {Name: "11/20", AddressBits: 16, IncrementedSource: true},
+	"11/40": {Name: "11/40", Extended: true, EIS: true, FIS: true, AddressBits: 18},
+	"11/45": {Name: "11/45", Extended: true, EIS: true, FPP: true, AddressBits: 18, Supervisor: true, SplitID: true, StackLimit: true, KB11: true},
+	"11/70": {Name: "11/70", Extended: true, EIS: true, FPP: true, AddressBits: 22, Supervisor: true, SplitID: true, StackLimit: true, KB11: true},
+}
+
+// SetModel configures the CPU and the MMU of the model. It has to be called before any device is attached.
+func (u *Unibus) SetModel(m Model) error {
+	switch {
+	case m.AddressBits == 16:
+		// the 11/20 has no MMU: MMU18 stays disabled, its registers are gone from the I/O page
+		for _, addr := range []Uint18{SR0Addr, SR1Addr, SR2Addr, KernelPagesAddr, UserPagesAddr} {
+			u.unregisterDevice(addr)
+		}
+	case m.Supervisor || m.SplitID:
+		if err := u.installMMU22(m.AddressBits == 22); err != nil {
+			return err
+		}
+	case m.AddressBits != 18:
+		return fmt.Errorf("model %s: %d bit addresses need the supervisor mode and I/D spaces", m.Name, m.AddressBits)
+	}
+	if m.StackLimit {
+		if err := u.installStackLimit(); err != nil {
+			return err
+		}
+	}
+
+	u.Model = m
+	u.PdpCPU.setInstructions(m)
+	return nil
+}
+
+// setInstructions builds the dispatch table of the model
+func (c *CPU) setInstructions(m Model) {
+	c.table = newDispatchTable()
+	c.table.add(basicInstructions)
+	if m.Extended {
+		c.table.add(extendedInstructions)
+	}
+	if m.EIS {
+		c.table.add(eisInstructions)
+	}
+	if m.SplitID {
+		c.table.add(splitIDInstructions)
+	}
+	if m.FIS {
+		c.InstallFIS()
+	}
+	c.fpp = nil
+	if m.FPP {
+		c.InstallFPP()
+	}
+
+	if m.IncrementedSource {
+		var wrapped []instruction
+		for _, ins := range basicInstructions {
+			if ins.mask == 0170000 {
+				ins.exec = incrementedSource(ins.exec)
+				wrapped = append(wrapped, ins)
+			}
+		}
+		c.table.add(wrapped)
+	}
+}
+
+// incrementedSource wraps the double operand instruction of the 11/20.
+// With the register source and the auto increment or decrement destination on the same register,
+// the source operand is the register after the change.
+func incrementedSource(exec func(*CPU, uint16)) func(*CPU, uint16) {
+	return func(c *CPU, instruction uint16) {
+		reg := instruction & 7
+		if (instruction>>6)&077 != reg || reg == 7 {
+			exec(c, instruction)
+			return
+		}
+
+		inc := uint16(2)
+		if instruction&0100000 != 0 && instruction&0170000 != 0160000 && reg < 6 {
+			inc = 1
+		}
+		switch instruction & 070 {
+		case 020:
+			// source is R+inc. -(R) on the incremented R addresses the original destination
+			c.stepRegister(reg, int16(inc))
+			exec(c, instruction&^070|040)
+			c.stepRegister(reg, int16(inc))
+		case 040:
+			// source is R-inc, and (R) addresses the decremented destination
+			c.stepRegister(reg, -int16(inc))
+			if reg == 6 {
+				c.checkStack(c.Registers[6])
+			}
+			exec(c, instruction&^070|010)
+		default:
+			exec(c, instruction)
+		}
+	}
+}
+
+// stepRegister changes the register like the auto increment or decrement does,
+// so the change is recorded in SR1 and rolled back on the abort. Nothing changes after the abort.
+func (c *CPU) stepRegister(reg uint16, delta int16) {
+	if c.unibus.TrapPending() {
+		return
+	}
+	c.Registers[reg] += uint16(delta)
+	c.registerChanged(reg, delta)
+}
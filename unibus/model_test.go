@@ -0,0 +1,182 @@
+package unibus
+
+import (
+	"log"
+	"os"
+	"pdp/console"
+	"pdp/interrupts"
+	"pdp/psw"
+	"testing"
+)
+
+// newModel returns the unibus of the model, separate from the shared one
+func newModel(t *testing.T, name string) *Unibus {
+	p := psw.PSW(0)
+	l := log.New(os.Stdout, "TestModel: ", log.LstdFlags)
+	var cons console.Console = console.NewSimple()
+	m := New(&p, nil, &cons, false, l)
+	if err := m.SetModel(Models[name]); err != nil {
+		t.Fatalf("SetModel(%s): %v", name, err)
+	}
+	return m
+}
+
+func TestModel_Instructions(t *testing.T) {
+	tests := []struct {
+		model       string
+		instruction uint16
+		want        bool
+	}{
+		{"11/20", 0070001, false}, // MUL
+		{"11/20", 0077001, false}, // SOB
+		{"11/20", 0000002, true},  // RTI
+		{"11/20", 0000006, false}, // RTT
+		{"11/20", 0075000, false}, // FADD
+		{"11/40", 0070001, true},
+		{"11/40", 0075000, true},
+		{"11/40", 0170000, false}, // CFCC
+		{"11/45", 0075000, false},
+		{"11/45", 0170000, true},
+		{"11/40", 0000235, false}, // SPL
+		{"11/45", 0000235, true},
+		{"11/70", 0000235, true},
+	}
+	for _, tt := range tests {
+		m := newModel(t, tt.model)
+		if got := m.PdpCPU.table[tt.instruction] != &invalidInstruction; got != tt.want {
+			t.Errorf("%s: %06o implemented = %v, want %v", tt.model, tt.instruction, got, tt.want)
+		}
+	}
+}
+
+func TestModel_IllegalInstruction(t *testing.T) {
+	tests := []struct {
+		model  string
+		vector uint16
+	}{
+		{"11/20", 04},
+		{"11/40", 04},
+		{"11/45", 010},
+		{"11/70", 010},
+	}
+	for _, tt := range tests {
+		m := newModel(t, tt.model)
+		for _, ins := range []uint16{0000101, 0004701} { // JMP R1, JSR PC,R1
+			m.PdpCPU.Decode(ins)(ins)
+			if trap, ok := m.TakeTrap(); !ok || trap.Vector != tt.vector {
+				t.Errorf("%s: %06o trapped to %o, want %o", tt.model, ins, trap.Vector, tt.vector)
+			}
+		}
+	}
+}
+
+func TestModel_MMU(t *testing.T) {
+	m := newModel(t, "11/20")
+	if d, _ := m.device(SR0Addr); d != nil {
+		t.Errorf("11/20: SR0 answers")
+	}
+	if err := m.SetMemorySize(0160002); err == nil {
+		t.Errorf("11/20: memory overlapping the I/O page accepted")
+	}
+
+	m = newModel(t, "11/45")
+	if m.ioPage != IOPageAddr {
+		t.Errorf("11/45: I/O page at %08o", m.ioPage)
+	}
+	mmu := m.Mmu.(*MMU22)
+	mmu.SetSR3(sr3Enable22 | sr3KernelD)
+	if mmu.GetSR3() != sr3KernelD {
+		t.Errorf("11/45: SR3 = %o, 22 bit mapping enabled", mmu.GetSR3())
+	}
+
+	m = newModel(t, "11/70")
+	if m.ioPage != IOPage22Addr {
+		t.Errorf("11/70: I/O page at %08o", m.ioPage)
+	}
+}
+
+func TestModel_IncrementedSource(t *testing.T) {
+	tests := []struct {
+		model      string
+		pushed     uint16
+		incPointer uint16
+	}{
+		{"11/20", 01774, 02002},
+		{"11/40", 01776, 02000},
+	}
+	for _, tt := range tests {
+		m := newModel(t, tt.model)
+		cpu := m.PdpCPU
+		m.Memory[01000>>1] = 010646 // MOV SP,-(SP)
+		m.Memory[01002>>1] = 010020 // MOV R0,(R0)+
+		cpu.Registers[0] = 02000
+		cpu.Registers[6] = 01776
+		cpu.Registers[7] = 01000
+		cpu.State = CPURUN
+		cpu.Execute()
+		cpu.Execute()
+
+		if got := m.Memory[01774>>1]; got != tt.pushed {
+			t.Errorf("%s: MOV SP,-(SP) pushed %06o, want %06o", tt.model, got, tt.pushed)
+		}
+		if got := m.Memory[02000>>1]; got != tt.incPointer {
+			t.Errorf("%s: MOV R0,(R0)+ stored %06o, want %06o", tt.model, got, tt.incPointer)
+		}
+		if cpu.Registers[0] != 02002 || cpu.Registers[6] != 01774 {
+			t.Errorf("%s: R0 = %06o, SP = %06o", tt.model, cpu.Registers[0], cpu.Registers[6])
+		}
+	}
+}
+
+func TestModel_IncrementedSourceAbort(t *testing.T) {
+	m := newModel(t, "11/20")
+	cpu := m.PdpCPU
+	cpu.State = CPURUN
+
+	// MOV R0,(R0)+ to the non existent address is rolled back
+	m.Memory[01000>>1] = 010020
+	cpu.Registers[0] = 0170000
+	cpu.Registers[7] = 01000
+	cpu.Execute()
+	if trap, ok := m.TakeTrap(); !ok || trap.Vector != interrupts.IntBUS || cpu.Registers[0] != 0170000 {
+		t.Errorf("expected bus error with R0 %06o restored, got %v, R0 = %06o", 0170000, trap, cpu.Registers[0])
+	}
+
+	// MOV SP,-(SP) in the yellow zone completes, and traps to 4
+	m.Memory[04>>1] = 03000
+	m.Memory[06>>1] = 0340
+	m.Memory[01000>>1] = 010646
+	cpu.Registers[6] = 0400
+	cpu.Registers[7] = 01000
+	cpu.Execute()
+	if cpu.Registers[7] != 03000 || m.Memory[0376>>1] != 0376 {
+		t.Errorf("expected yellow zone trap after the push, PC = %06o, pushed %06o", cpu.Registers[7], m.Memory[0376>>1])
+	}
+}
+
+func TestModel_StackLimit(t *testing.T) {
+	m := newModel(t, "11/70")
+	m.WriteIO(m.IOAddress(StackLimitAddr), 01377)
+	if got := m.ReadIO(m.IOAddress(StackLimitAddr)); got != 01000 {
+		t.Errorf("stack limit = %06o, want %06o", got, 01000)
+	}
+
+	cpu := m.PdpCPU
+	cpu.Registers[6] = 01402
+	cpu.checkStack(01400)
+	if cpu.stackWarning || m.TrapPending() {
+		t.Errorf("stack reference above the yellow zone")
+	}
+	cpu.checkStack(01376)
+	if !cpu.stackWarning || m.TrapPending() {
+		t.Errorf("expected yellow zone warning")
+	}
+	cpu.checkStack(01336)
+	if trap, ok := m.TakeTrap(); !ok || !cpu.TakeRedStack() {
+		t.Errorf("expected red stack trap, got %v", trap)
+	}
+
+	if d, _ := newModel(t, "11/40").device(StackLimitAddr); d != nil {
+		t.Errorf("11/40: stack limit register answers")
+	}
+}
@@ -0,0 +1,196 @@
+package unibus
+
+// instruction describes a single PDP-11 instruction, both for the CPU and the disassembler.
+// Instruction word matches, if instr & mask == match.
+type instruction struct {
+	mask, match uint16
+	name        string
+
+	// operand format, used by the disassembler
+	flag uint
+
+	exec func(*CPU, uint16)
+}
+
+// basicInstructions - instruction set of the 11/20.
+// Entries must not overlap, every instruction word matches at most one of them.
+var basicInstructions = []instruction{
+	// single operand:
+	{0177700, 0000100, "JMP", flagD, (*CPU).jmpOp},
+	{0177700, 0000300, "SWAB", flagD, (*CPU).swabOp},
+	{0177700, 0005000, "CLR", flagD, (*CPU).clrOp},
+	{0177700, 0105000, "CLRB", flagD, (*CPU).clrOp},
+	{0177700, 0005100, "COM", flagD, (*CPU).comOp},
+	{0177700, 0105100, "COMB", flagD, (*CPU).combOp},
+	{0177700, 0005200, "INC", flagD, (*CPU).incOp},
+	{0177700, 0105200, "INCB", flagD, (*CPU).incbOp},
+	{0177700, 0005300, "DEC", flagD, (*CPU).decOp},
+	{0177700, 0105300, "DECB", flagD, (*CPU).decbOp},
+	{0177700, 0005400, "NEG", flagD, (*CPU).negOp},
+	{0177700, 0105400, "NEGB", flagD, (*CPU).negbOp},
+	{0177700, 0005500, "ADC", flagD, (*CPU).adcOp},
+	{0177700, 0105500, "ADCB", flagD, (*CPU).adcOp},
+	{0177700, 0005600, "SBC", flagD, (*CPU).sbcOp},
+	{0177700, 0105600, "SBCB", flagD, (*CPU).sbcbOp},
+	{0177700, 0005700, "TST", flagD, (*CPU).tstOp},
+	{0177700, 0105700, "TSTB", flagD, (*CPU).tstbOp},
+	{0177700, 0006000, "ROR", flagD, (*CPU).rorOp},
+	{0177700, 0106000, "RORB", flagD, (*CPU).rorbOp},
+	{0177700, 0006100, "ROL", flagD, (*CPU).rolOp},
+	{0177700, 0106100, "ROLB", flagD, (*CPU).rolbOp},
+	{0177700, 0006200, "ASR", flagD, (*CPU).asrOp},
+	{0177700, 0106200, "ASRB", flagD, (*CPU).asrbOp},
+	{0177700, 0006300, "ASL", flagD, (*CPU).aslOp},
+	{0177700, 0106300, "ASLB", flagD, (*CPU).aslbOp},
+
+	// dual operand:
+	{0170000, 0010000, "MOV", flagS | flagD, (*CPU).movOp},
+	{0170000, 0110000, "MOVB", flagS | flagD, (*CPU).movbOp},
+	{0170000, 0020000, "CMP", flagS | flagD, (*CPU).cmpOp},
+	{0170000, 0120000, "CMPB", flagS | flagD, (*CPU).cmpOp},
+	{0170000, 0030000, "BIT", flagS | flagD, (*CPU).bitOp},
+	{0170000, 0130000, "BITB", flagS | flagD, (*CPU).bitbOp},
+	{0170000, 0040000, "BIC", flagS | flagD, (*CPU).bicOp},
+	{0170000, 0140000, "BICB", flagS | flagD, (*CPU).bicbOp},
+	{0170000, 0050000, "BIS", flagS | flagD, (*CPU).bisOp},
+	{0170000, 0150000, "BISB", flagS | flagD, (*CPU).bisbOp},
+	{0170000, 0060000, "ADD", flagS | flagD, (*CPU).addOp},
+	{0170000, 0160000, "SUB", flagS | flagD, (*CPU).subOp},
+
+	// RDD:
+	{0177000, 0004000, "JSR", flagR | flagD, (*CPU).jsrOp},
+
+	// control instructions & traps:
+	{0177400, 0000400, "BR", flagO, (*CPU).brOp},
+	{0177400, 0001000, "BNE", flagO, (*CPU).bneOp},
+	{0177400, 0001400, "BEQ", flagO, (*CPU).beqOp},
+	{0177400, 0100000, "BPL", flagO, (*CPU).bplOp},
+	{0177400, 0100400, "BMI", flagO, (*CPU).bmiOp},
+	{0177400, 0102000, "BVC", flagO, (*CPU).bvcOp},
+	{0177400, 0102400, "BVS", flagO, (*CPU).bvsOp},
+	{0177400, 0103000, "BCC", flagO, (*CPU).bccOp},
+	{0177400, 0103400, "BCS", flagO, (*CPU).bcsOp},
+	{0177400, 0104000, "EMT", flagNone, (*CPU).emtOp},
+	{0177400, 0104400, "TRAP", flagNone, (*CPU).trapOp},
+
+	// conditional branching - signed int
+	{0177400, 0002000, "BGE", flagO, (*CPU).bgeOp},
+	{0177400, 0002400, "BLT", flagO, (*CPU).bltOp},
+	{0177400, 0003000, "BGT", flagO, (*CPU).bgtOp},
+	{0177400, 0003400, "BLE", flagO, (*CPU).bleOp},
+
+	// conditional branching - unsigned int
+	{0177400, 0101000, "BHI", flagO, (*CPU).bhiOp},
+	{0177400, 0101400, "BLOS", flagO, (*CPU).blosOp},
+
+	// single register and condition code opcodes
+	{0177770, 0000200, "RTS", flagR, (*CPU).rtsOp},
+	{0177760, 0000240, "CC", flagCC, (*CPU).clearFlagOp},
+	{0177760, 0000260, "CC", flagCC, (*CPU).setFlagOp},
+
+	// no operand:
+	{0177777, 0000000, "HALT", 0, (*CPU).haltOp},
+	{0177777, 0000001, "WAIT", 0, (*CPU).waitOp},
+	{0177777, 0000002, "RTI", 0, (*CPU).rtiOp},
+	{0177777, 0000003, "BPT", 0, (*CPU).bptOp},
+	{0177777, 0000004, "IOT", 0, (*CPU).iotOp},
+	{0177777, 0000005, "RESET", 0, (*CPU).resetOp},
+}
+
+// extendedInstructions - instructions added by the 11/35 and 11/40
+var extendedInstructions = []instruction{
+	{0177700, 0006400, "MARK", 0, (*CPU).markOp},
+	{0177700, 0006500, "MFPI", flagD, (*CPU).mfpiOp},
+	{0177700, 0006600, "MTPI", flagD, (*CPU).mtpiOp},
+	{0177700, 0006700, "SXT", flagD, (*CPU).sxtOp},
+	{0177000, 0074000, "XOR", flagR | flagD, (*CPU).xorOp},
+	{0177000, 0077000, "SOB", flagR | flagO, (*CPU).sobOp},
+	{0177777, 0000006, "RTT", 0, (*CPU).rttOp},
+}
+
+// splitIDInstructions - previous data space access and SPL of the 11/45 and 11/70
+var splitIDInstructions = []instruction{
+	{0177700, 0106500, "MFPD", flagD, (*CPU).mfpdOp},
+	{0177700, 0106600, "MTPD", flagD, (*CPU).mtpdOp},
+	{0177770, 0000230, "SPL", flagN, (*CPU).splOp},
+}
+
+// eisInstructions - extended instruction set, optional on the 11/40, standard on the 11/45 and 11/70
+var eisInstructions = []instruction{
+	{0177000, 0070000, "MUL", flagR | flagD, (*CPU).mulOp},
+	{0177000, 0071000, "DIV", flagR | flagD, (*CPU).divOp},
+	{0177000, 0072000, "ASH", flagR | flagD, (*CPU).ashOp},
+	{0177000, 0073000, "ASHC", flagR | flagD, (*CPU).ashcOp},
+}
+
+// fppInstructions - FP11 floating point processor of the 11/45 and 11/70.
+// The first entry makes the undefined FP11 opcodes an FP11 error, the following entries replace it.
+var fppInstructions = []instruction{
+	{0177700, 0170000, "??", 0, (*CPU).fppOp},
+	{0177777, 0170000, "CFCC", 0, (*CPU).fppOp},
+	{0177777, 0170001, "SETF", 0, (*CPU).fppOp},
+	{0177777, 0170002, "SETI", 0, (*CPU).fppOp},
+	{0177777, 0170011, "SETD", 0, (*CPU).fppOp},
+	{0177777, 0170012, "SETL", 0, (*CPU).fppOp},
+	{0177700, 0170100, "LDFPS", flagD, (*CPU).fppOp},
+	{0177700, 0170200, "STFPS", flagD, (*CPU).fppOp},
+	{0177700, 0170300, "STST", flagD, (*CPU).fppOp},
+	{0177700, 0170400, "CLRF", flagF, (*CPU).fppOp},
+	{0177700, 0170500, "TSTF", flagF, (*CPU).fppOp},
+	{0177700, 0170600, "ABSF", flagF, (*CPU).fppOp},
+	{0177700, 0170700, "NEGF", flagF, (*CPU).fppOp},
+	{0177400, 0171000, "MULF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0171400, "MODF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0172000, "ADDF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0172400, "LDF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0173000, "SUBF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0173400, "CMPF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0174000, "STF", flagF | flagAD, (*CPU).fppOp},
+	{0177400, 0174400, "DIVF", flagF | flagAS, (*CPU).fppOp},
+	{0177400, 0175000, "STEXP", flagD | flagAD, (*CPU).fppOp},
+	{0177400, 0175400, "STCFI", flagD | flagAD, (*CPU).fppOp},
+	{0177400, 0176000, "STCFD", flagF | flagAD, (*CPU).fppOp},
+	{0177400, 0176400, "LDEXP", flagD | flagAS, (*CPU).fppOp},
+	{0177400, 0177000, "LDCIF", flagD | flagAS, (*CPU).fppOp},
+	{0177400, 0177400, "LDCDF", flagF | flagAS, (*CPU).fppOp},
+}
+
+// fisInstructions - KE11-F floating instruction set option of the 11/40
+var fisInstructions = []instruction{
+	{0177770, 0075000, "FADD", flagR, (*CPU).fisOp},
+	{0177770, 0075010, "FSUB", flagR, (*CPU).fisOp},
+	{0177770, 0075020, "FMUL", flagR, (*CPU).fisOp},
+	{0177770, 0075030, "FDIV", flagR, (*CPU).fisOp},
+}
+
+// invalidInstruction is dispatched for every instruction word not matching the instruction set
+var invalidInstruction = instruction{name: "??", exec: (*CPU).invalidOp}
+
+// dispatchTable - instruction for every instruction word, shared by the CPU and the disassembler
+type dispatchTable [1 << 16]*instruction
+
+// newDispatchTable returns the table with all instruction words invalid
+func newDispatchTable() *dispatchTable {
+	table := new(dispatchTable)
+	for i := range table {
+		table[i] = &invalidInstruction
+	}
+	return table
+}
+
+// add expands the instruction set into the table indexed by the instruction word.
+// Entries replace the ones added before them.
+func (table *dispatchTable) add(set []instruction) {
+	for i := range set {
+		ins := &set[i]
+		free := ^ins.mask
+
+		// enumerate all combinations of the bits not covered by the mask
+		for x := uint16(0); ; {
+			table[ins.match|x] = ins
+			if x = (x - free) & free; x == 0 {
+				break
+			}
+		}
+	}
+}
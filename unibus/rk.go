@@ -3,7 +3,6 @@ package unibus
 import (
 	"errors"
 	"fmt"
-	"os"
 	"pdp/interrupts"
 )
 
@@ -24,6 +23,33 @@ const (
 	rkNxd = 1 << 7
 	rkNxc = 1 << 6
 	rkNxs = 1 << 5
+	rkNxm = 1 << 10
+	rkWlo = 1 << 13
+	rkWce = 1 << 0
+
+	// RKCS bits
+	rkIde = 1 << 6
+	rkRdy = 1 << 7
+	rkSse = 1 << 8
+	rkScp = 1 << 13
+	rkHe  = 1 << 14
+	rkErr = 1 << 15
+
+	// RKDS write protect status
+	rkWps = 1 << 5
+
+	// RK11 functions, RKCS bits 1-3
+	rkControlReset = 0
+	rkWrite        = 1
+	rkRead         = 2
+	rkWriteCheck   = 3
+	rkSeek         = 4
+	rkReadCheck    = 5
+	rkDriveReset   = 6
+	rkWriteLock    = 7
+
+	// size of a single sector in bytes
+	rkSectorSize = 512
 )
 
 // RK11 disk controller
@@ -52,12 +78,18 @@ type RK11 struct {
 
 	running bool
 
+	// seek or drive reset in progress on seekDrive, search complete is reported in the next step
+	seeking   bool
+	seekDrive int
+
 	unibus *Unibus
 }
 
 // RK05 disk cartridge
 type RK05 struct {
-	rdisk  []byte
+	*diskImage
+
+	// write lock set by the guest with the "write lock" function
 	locked bool
 }
 
@@ -77,24 +109,83 @@ func NewRK(u *Unibus) *RK11 {
 	return &r
 }
 
-// Attach reads disk image file and loads it to memory
+// Attach reads disk image file and loads it to memory.
 func (r *RK11) Attach(drive int, path string) error {
-	buf, err := os.ReadFile(path)
+	return r.attach(drive, path, false)
+}
+
+// AttachReadOnly attaches disk image in the write protected mode.
+// The image file is never modified, and the guest sees the drive as write locked.
+func (r *RK11) AttachReadOnly(drive int, path string) error {
+	return r.attach(drive, path, true)
+}
+
+func (r *RK11) attach(drive int, path string, readOnly bool) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to mount disk to unit > 7")
+	}
+
+	image, err := openImage(path, readOnly)
 	if err != nil {
 		return err
 	}
-	unit := &RK05{
-		rdisk: buf,
-	}
 
-	if drive >= len(r.unit) {
-		return errors.New("tried to mount disk to unit > 7")
+	if err := r.Detach(drive); err != nil {
+		image.close()
+		return err
 	}
+	r.unit[drive] = &RK05{diskImage: image}
+	r.updateDriveStatus()
+	return nil
+}
 
-	r.unit[drive] = unit
+// SetDriveType checks the type of the drive attached to the unit. RK11 supports only RK05.
+func (r *RK11) SetDriveType(drive int, driveType string) error {
+	if driveType != "" && driveType != "rk05" {
+		return fmt.Errorf("unsupported drive type %s, expected rk05", driveType)
+	}
 	return nil
 }
 
+// Detach closes the image file attached to the drive
+func (r *RK11) Detach(drive int) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to detach disk from unit > 7")
+	}
+	unit := r.unit[drive]
+	if unit == nil {
+		return nil
+	}
+	r.unit[drive] = nil
+	r.updateDriveStatus()
+	return unit.close()
+}
+
+// DetachAll closes all attached image files
+func (r *RK11) DetachAll() error {
+	var err error
+	for i := range r.unit {
+		if e := r.Detach(i); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// write protected returns true if the drive can't be written to
+func (u *RK05) writeProtected() bool {
+	return u.locked || u.readOnly
+}
+
+// updateDriveStatus sets the write protect bit in RKDS for the currently selected drive
+func (r *RK11) updateDriveStatus() {
+	if unit := r.unit[r.drive]; unit != nil && unit.writeProtected() {
+		r.RKDS |= rkWps
+	} else {
+		r.RKDS &^= rkWps
+	}
+}
+
 // rkReady - set Drive Ready bit in RKDS and Control Ready bit in RKCS registers to 1
 func (r *RK11) rkReady() {
 	r.RKDS |= 1 << 6
@@ -107,31 +198,46 @@ func (r *RK11) rkNotReady() {
 	r.RKCS = r.RKCS &^ (1 << 7)
 }
 
-// read and return drive register value
-func (r *RK11) read(address Uint18) uint16 {
+func (r *RK11) Name() string {
+	return "RK11"
+}
+
+// AddressRange - RK11 registers occupy 0777400 - 0777416
+func (r *RK11) AddressRange() (Uint18, Uint18) {
+	return RK11Addr, RK11Addr + 016
+}
+
+// Vector returns RK11 interrupt vector and priority
+func (r *RK11) Vector() (uint16, uint16) {
+	return interrupts.IntRK, 5
+}
+
+// Read16 reads and returns drive register value
+func (r *RK11) Read16(address Uint18) (uint16, error) {
 	if RKDEBUG {
 		fmt.Printf("RK: Reading from address %o\n", address)
 	}
 	switch address {
 	case rkdsAddress:
-		return r.RKDS
+		return r.RKDS, nil
 	case rkerAddress:
-		return r.RKER
+		return r.RKER, nil
 	case rkcsAddress:
 		// because rkba overflows to RKCS, every time RKCS is returned, those bits should be updated
-		return uint16(uint32(r.RKCS) | (r.RKBA&0x30000)>>12)
+		return uint16(uint32(r.RKCS) | (r.RKBA&0x30000)>>12), nil
 	case rkwcAddress:
-		return uint16(r.RKWC)
+		return uint16(r.RKWC), nil
 	case rkbaAddress:
-		return uint16(r.RKBA & 0xFFFF)
+		return uint16(r.RKBA & 0xFFFF), nil
 	case rkdaAddress:
-		return uint16(r.sector | (r.surface << 4) | (r.cylinder << 5) | (r.drive << 13))
+		return uint16(r.sector | (r.surface << 4) | (r.cylinder << 5) | (r.drive << 13)), nil
 	default:
-		panic("invalid RK11 read")
+		return 0, fmt.Errorf("invalid RK11 read from %06o", address)
 	}
 }
 
-func (r *RK11) write(address uint32, value uint16) {
+// Write16 writes to the drive register
+func (r *RK11) Write16(address Uint18, value uint16) error {
 	switch address {
 	case rkdsAddress:
 		break
@@ -139,17 +245,20 @@ func (r *RK11) write(address uint32, value uint16) {
 		break
 	case rkcsAddress:
 		// set bus address:
-		r.RKBA = (r.RKBA & 0xFFFF) | uint32((value&060)<<12)
+		r.RKBA = (r.RKBA & 0xFFFF) | uint32(value&060)<<12
 		const bits uint16 = 017517
 
 		// set only the writeable bits:
 		value &= bits
+		ide := r.RKCS & rkIde
 		r.RKCS &= ^bits
 
 		// don't set the GO bit
 		r.RKCS |= value & ^uint16(1)
 		if value&1 == 1 {
 			r.rkgo()
+		} else if ide == 0 && r.RKCS&(rkIde|rkRdy) == rkIde|rkRdy {
+			r.interrupt()
 		}
 	case rkwcAddress:
 		r.RKWC = int(int(^value+1) * -1)
@@ -160,31 +269,71 @@ func (r *RK11) write(address uint32, value uint16) {
 		r.cylinder = int(value>>5) & 0377
 		r.surface = int(value>>4) & 1
 		r.sector = int(value & 15)
+		r.updateDriveStatus()
 	default:
-		panic("RK5: Invalid write")
+		return fmt.Errorf("invalid RK11 write to %06o", address)
 	}
+	return nil
+}
+
+// Read8 - byte access to the RK11 registers
+func (r *RK11) Read8(address Uint18) (uint16, error) {
+	return readByteFromWord(r, address)
+}
+
+// Write8 - byte access to the RK11 registers
+func (r *RK11) Write8(address Uint18, value uint16) error {
+	return writeByteToWord(r, address, value)
 }
 
-// Respond to GO bit set in RKCS - start operations
+// Respond to GO bit set in RKCS - start operations.
+// Seek and drive reset free the controller immediately, the drive reports search complete when it's done.
 func (r *RK11) rkgo() {
 	if RKDEBUG {
 		fmt.Printf("RK: It's a go, all engines running!\n")
 		fmt.Printf("RKWC: %o\n", r.RKWC)
 	}
+	r.RKER = 0
+	r.RKCS &^= rkErr | rkHe | rkScp
+
 	switch (r.RKCS & 017) >> 1 {
-	case 0: // Control reset
+	case rkControlReset:
 		r.Reset()
-	case 1, 2: // R/W
-		r.running = true
-		r.rkNotReady()
-	case 7: // write lock
+	case rkSeek:
+		if r.unit[r.drive] == nil {
+			r.rkError(rkNxd)
+			return
+		}
+		if r.cylinder > 0312 {
+			r.rkError(rkNxc)
+			return
+		}
+		r.search()
+	case rkDriveReset:
+		// drive reset clears the errors and the write lock set by the guest, and returns the heads to cylinder 0.
+		// The heads position is kept in RKDA.
+		unit := r.unit[r.drive]
+		if unit == nil {
+			r.rkError(rkNxd)
+			return
+		}
+		unit.locked = false
+		r.updateDriveStatus()
+		r.cylinder = 0
+		r.search()
+	default:
 		r.running = true
 		r.rkNotReady()
-	default:
-		panic(fmt.Sprintf("unimplemented RK5 operation %#o", (r.RKCS&017)>>1))
 	}
 }
 
+// search starts the seek on the selected drive, search complete is reported in the next step
+func (r *RK11) search() {
+	r.seeking = true
+	r.seekDrive = r.drive
+	r.rkDone()
+}
+
 // Reset sets the drive to it's default values.
 // check bits meaning in attached documentation
 func (r *RK11) Reset() {
@@ -193,15 +342,42 @@ func (r *RK11) Reset() {
 	r.RKCS = 1 << 7
 	r.RKWC = 0
 	r.RKBA = 0
+	r.running = false
+	r.seeking = false
+	r.updateDriveStatus()
+}
+
+// interrupt sends the interrupt, if enabled in RKCS
+func (r *RK11) interrupt() {
+	if r.RKCS&rkIde != 0 {
+		vector, priority := r.Vector()
+		r.unibus.SendInterrupt(priority, vector)
+	}
+}
+
+// rkDone ends the function: the controller is ready, and interrupts if enabled
+func (r *RK11) rkDone() {
+	r.running = false
+	r.rkReady()
+	r.interrupt()
+}
+
+// rkWriteLockout is called on attempt to write to the write protected drive.
+// unlike the other errors it is completely normal for the guest to hit it.
+func (r *RK11) rkWriteLockout() {
+	r.RKER |= rkWlo
+	r.RKCS |= rkHe | rkErr
+	r.rkDone()
 }
 
-// rkerror is being called in response to specific RK11 error
+// rkError is being called in response to specific RK11 hard error.
+// The function ends, and the guest learns about the error from RKER and the interrupt.
 func (r *RK11) rkError(code uint16) {
 	var msg string
 
-	r.rkReady()
 	r.RKER |= code
-	r.RKCS |= (1 << 14) | (1 << 15)
+	r.RKCS |= rkHe | rkErr
+	r.rkDone()
 
 	switch code {
 	case rkOvr:
@@ -212,36 +388,46 @@ func (r *RK11) rkError(code uint16) {
 		msg = "invalid cylinder accessed"
 	case rkNxs:
 		msg = "invalid sector accessed"
+	case rkNxm:
+		msg = fmt.Sprintf("non existent memory %06o accessed", r.RKBA)
 	}
-	panic(msg)
+	r.unibus.log.Printf("RK: %s, drive %d, cylinder %o, surface %o, sector %o\n",
+		msg, r.drive, r.cylinder, r.surface, r.sector)
 }
 
-// Step - single operation step
+// Step - single operation step. Every step transfers one sector.
 func (r *RK11) Step() {
+	if r.seeking {
+		// search complete, RKDS identifies the drive
+		r.seeking = false
+		r.RKCS |= rkScp
+		r.RKDS = r.RKDS&^(7<<13) | uint16(r.seekDrive)<<13
+		r.interrupt()
+	}
 	if !r.running {
 		return
 	}
 
 	if r.unit[r.drive] == nil {
 		r.rkError(rkNxd)
+		return
 	}
 
-	var isWrite bool
 	unit := r.unit[r.drive]
 
 	// check the "function" fields in RKCS register
-	switch (r.RKCS & 017) >> 1 {
-	case 01:
-		isWrite = true
-	case 02:
-		isWrite = false
-	case 07:
+	function := (r.RKCS & 017) >> 1
+	switch function {
+	case rkWrite:
+		if unit.writeProtected() {
+			r.rkWriteLockout()
+			return
+		}
+	case rkWriteLock:
 		unit.locked = true
-		r.running = false
-		r.rkReady()
+		r.updateDriveStatus()
+		r.rkDone()
 		return
-	default:
-		panic(fmt.Sprintf("unimplemented RK05 operation: %#o", (r.RKCS&017)>>1))
 	}
 
 	if RKDEBUG {
@@ -249,16 +435,15 @@ func (r *RK11) Step() {
 			r.cylinder, r.sector, r.surface)
 	}
 
-	// set the head location:
-	if r.cylinder > 0312 {
-		r.rkError(rkNxc)
-	}
+	// set the head location. Cylinders beyond the end of the shorter image don't exist either.
 	if r.sector > 013 {
-		r.rkError(rkNxc)
+		r.rkError(rkNxs)
+		return
 	}
-	pos := (r.cylinder*24 + r.surface*12 + r.sector) * 512
-	if pos >= len(unit.rdisk) {
-		panic(fmt.Sprintf("pos outside rkdisk length, pos: %v, len %v", pos, len(r.unit[r.drive].rdisk)))
+	pos := (r.cylinder*24 + r.surface*12 + r.sector) * rkSectorSize
+	if r.cylinder > 0312 || pos+rkSectorSize > len(unit.rdisk) {
+		r.rkError(rkNxc)
+		return
 	}
 
 	if RKDEBUG {
@@ -266,28 +451,49 @@ func (r *RK11) Step() {
 	}
 
 	// read / write complete sector:
+	start := pos
+	nxm := false
 	for i := 0; i < 256 && r.RKWC != 0; i++ {
-		if isWrite {
+		if Uint18(r.RKBA) >= r.unibus.memoryTop() {
+			nxm = true
+			break
+		}
+		disk := uint16(unit.rdisk[pos]) | uint16(unit.rdisk[pos+1])<<8
+		switch function {
+		case rkWrite:
 			if RKDEBUG {
 				fmt.Printf("RK WRITE: RKBA: %o, RKWC: %o \n", r.RKBA, r.RKWC)
 			}
 			val := r.unibus.ReadIO(Uint18(r.RKBA))
 			unit.rdisk[pos] = byte(val & 0xFF)
 			unit.rdisk[pos+1] = byte((val >> 8) & 0xFF)
-		} else {
+		case rkRead:
 			if RKDEBUG {
 				fmt.Printf("RK read: RKBA: %o, RKWC: %d, Position: %o\n", r.RKBA, r.RKWC, pos)
 			}
-			// TODO: monitor if it's fine. this implementation does not take care of
-			// bits 4 and 5 of rkcs, which should be used on systems with extended memory
-			r.unibus.WriteIO(
-				Uint18(r.RKBA),
-				uint16(unit.rdisk[pos])|uint16(unit.rdisk[pos+1])<<8)
+			r.unibus.WriteIO(Uint18(r.RKBA), disk)
+		case rkWriteCheck:
+			// compare the memory with the disk, the difference is a soft error
+			if r.unibus.ReadIO(Uint18(r.RKBA)) != disk {
+				r.RKER |= rkWce
+				r.RKCS |= rkErr
+			}
+		case rkReadCheck:
+			// the sector is read, but nothing is transferred to the memory
 		}
 		r.RKBA += 2
 		pos += 2
 		r.RKWC = (r.RKWC + 1) & 0xffff
 	}
+	if function == rkWrite {
+		if err := unit.flush(start, pos); err != nil {
+			r.unibus.log.Printf("RK: can't write sector to the disk image: %v\n", err)
+		}
+	}
+	if nxm {
+		r.rkError(rkNxm)
+		return
+	}
 	r.sector++
 	if RKDEBUG {
 		fmt.Printf("increasing sector to %o \n", r.sector)
@@ -299,21 +505,19 @@ func (r *RK11) Step() {
 		if r.surface > 1 {
 			r.surface = 0
 			r.cylinder++
-			if r.cylinder > 0312 {
+			if r.cylinder > 0312 && r.RKWC != 0 {
 				r.rkError(rkOvr)
+				return
 			}
 		}
 	}
 
 	// RKWC == 0 -> transfer is completed. if bit 6 set in RKCS, interrupt should be sent.
-	if r.RKWC == 0 {
+	// With the stop on soft error set, the write check error ends the transfer after the sector.
+	if r.RKWC == 0 || r.RKER&rkWce != 0 && r.RKCS&rkSse != 0 {
 		if RKDEBUG {
-			fmt.Printf("RKWC: 0, transfer complete, RKCS: %o\n", r.RKCS)
-		}
-		r.running = false
-		r.rkReady()
-		if r.RKCS&(1<<6) != 0 {
-			r.unibus.SendInterrupt(5, interrupts.IntRK)
+			fmt.Printf("RKWC: %o, transfer complete, RKCS: %o\n", r.RKWC, r.RKCS)
 		}
+		r.rkDone()
 	}
 }
@@ -3,6 +3,8 @@ package unibus
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"pdp/interrupts"
 	"testing"
 )
 
@@ -45,3 +47,193 @@ func TestRK11_Attach(t *testing.T) {
 func TestRK11_Initialize(t *testing.T) {
 
 }
+
+// newImage creates the disk or tape image file with the data
+func newImage(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("can't create image: %v", err)
+	}
+	return path
+}
+
+// rkWriteSector programs the controller to write the first sector of drive 0 from memory address 01000
+func rkWriteSector(r *RK11) {
+	_ = r.Write16(rkdaAddress, 0)
+	_ = r.Write16(rkbaAddress, 01000)
+	_ = r.Write16(rkwcAddress, 0177400)
+	_ = r.Write16(rkcsAddress, 3) // write + go
+	r.Step()
+}
+
+func TestRK11_WriteThrough(t *testing.T) {
+	path := newImage(t, "rk.img", make([]byte, 24*rkSectorSize))
+	r := NewRK(u)
+	if err := r.Attach(0, path); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	for i := 0; i < 256; i++ {
+		u.Memory[(01000>>1)+i] = uint16(i) | 0100000
+	}
+	rkWriteSector(r)
+
+	if r.RKCS&(1<<15) != 0 {
+		t.Fatalf("unexpected RK11 error, RKER = %06o", r.RKER)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("can't read disk image: %v", err)
+	}
+	if buf[0] != 0 || buf[1] != 0200 || buf[2] != 1 || buf[511] != 0200 {
+		t.Errorf("sector not written through to the image file: % o", buf[:4])
+	}
+}
+
+func TestRK11_ReadOnly(t *testing.T) {
+	path := newImage(t, "rk.img", make([]byte, 24*rkSectorSize))
+	r := NewRK(u)
+	if err := r.AttachReadOnly(0, path); err != nil {
+		t.Fatalf("AttachReadOnly() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	if r.RKDS&rkWps == 0 {
+		t.Errorf("expected write protect status in RKDS, got %06o", r.RKDS)
+	}
+
+	u.Memory[01000>>1] = 0177777
+	rkWriteSector(r)
+
+	if r.RKER&rkWlo == 0 || r.RKCS&(1<<15) == 0 {
+		t.Errorf("expected write lockout error, RKER = %06o, RKCS = %06o", r.RKER, r.RKCS)
+	}
+	if r.RKCS&(1<<7) == 0 {
+		t.Errorf("expected controller to be ready after the error")
+	}
+	buf, _ := os.ReadFile(path)
+	if buf[0] != 0 {
+		t.Errorf("read only image has been modified")
+	}
+}
+
+func TestRK11_Seek(t *testing.T) {
+	r := NewRK(u)
+	if err := r.Attach(1, newImage(t, "rk.img", make([]byte, 24*rkSectorSize))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(1)
+	r.Reset()
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	_ = r.Write16(rkdaAddress, 1<<13|5<<5)
+	_ = r.Write16(rkcsAddress, rkIde|rkSeek<<1|1)
+	if r.RKCS&rkRdy == 0 || u.InterruptQueue[0].Vector != interrupts.IntRK {
+		t.Errorf("expected the ready controller and the interrupt, RKCS = %06o", r.RKCS)
+	}
+	if r.RKCS&rkScp != 0 {
+		t.Errorf("search complete before the seek is done")
+	}
+
+	u.InterruptQueue = interrupts.InterruptQueue{}
+	r.Step()
+	if r.RKCS&rkScp == 0 || r.RKDS>>13 != 1 || u.InterruptQueue[0].Vector != interrupts.IntRK {
+		t.Errorf("expected search complete on drive 1, RKCS = %06o, RKDS = %06o", r.RKCS, r.RKDS)
+	}
+
+	// drive reset with non existent cylinder in RKDA clears the write lock, and returns to cylinder 0
+	_ = r.Write16(rkcsAddress, rkWriteLock<<1|1)
+	r.Step()
+	_ = r.Write16(rkdaAddress, 1<<13|0377<<5)
+	_ = r.Write16(rkcsAddress, rkIde|rkDriveReset<<1|1)
+	r.Step()
+	if r.RKCS&(rkErr|rkScp) != rkScp || r.RKER != 0 || r.RKDS&rkWps != 0 || r.cylinder != 0 {
+		t.Errorf("expected drive reset, RKCS = %06o, RKER = %06o, RKDS = %06o, cylinder %o",
+			r.RKCS, r.RKER, r.RKDS, r.cylinder)
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+}
+
+func TestRK11_Check(t *testing.T) {
+	r := NewRK(u)
+	if err := r.Attach(0, newImage(t, "rk.img", make([]byte, 24*rkSectorSize))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	for i := 0; i < 256; i++ {
+		u.Memory[(01000>>1)+i] = uint16(i)
+	}
+	rkWriteSector(r)
+
+	check := func(function uint16) {
+		_ = r.Write16(rkdaAddress, 0)
+		_ = r.Write16(rkbaAddress, 01000)
+		_ = r.Write16(rkwcAddress, 0177400)
+		_ = r.Write16(rkcsAddress, function<<1|1)
+		r.Step()
+	}
+
+	check(rkWriteCheck)
+	if r.RKCS&rkErr != 0 || r.RKCS&rkRdy == 0 {
+		t.Errorf("unexpected write check error, RKER = %06o", r.RKER)
+	}
+
+	u.Memory[(01000>>1)+7] = 0177777
+	check(rkWriteCheck)
+	if r.RKER != rkWce || r.RKCS&(rkErr|rkHe) != rkErr {
+		t.Errorf("expected soft write check error, RKER = %06o, RKCS = %06o", r.RKER, r.RKCS)
+	}
+
+	check(rkReadCheck)
+	if r.RKCS&rkErr != 0 || r.RKBA != 02000 || u.Memory[(01000>>1)+7] != 0177777 {
+		t.Errorf("read check: RKCS = %06o, RKBA = %06o, memory modified", r.RKCS, r.RKBA)
+	}
+}
+
+func TestRK11_Errors(t *testing.T) {
+	r := NewRK(u)
+	if err := r.Attach(0, newImage(t, "rk.img", make([]byte, 24*rkSectorSize))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+
+	tests := []struct {
+		name     string
+		function uint16
+		rkda     uint16
+		rkba     uint16
+		mex      uint16 // bus address bits 17-16 in RKCS
+		rker     uint16
+	}{
+		{"missing drive", rkRead, 3 << 13, 01000, 0, rkNxd},
+		{"cylinder beyond the image", rkRead, 1 << 5, 01000, 0, rkNxc},
+		{"cylinder beyond the disk", rkWrite, 0313 << 5, 01000, 0, rkNxc},
+		{"invalid sector", rkRead, 014, 01000, 0, rkNxs},
+		{"seek on the missing drive", rkSeek, 2 << 13, 01000, 0, rkNxd},
+		{"non existent memory", rkRead, 0, 0170000, 060, rkNxm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.Reset()
+			u.InterruptQueue = interrupts.InterruptQueue{}
+			_ = r.Write16(rkdaAddress, tt.rkda)
+			_ = r.Write16(rkbaAddress, tt.rkba)
+			_ = r.Write16(rkwcAddress, 0177400)
+			_ = r.Write16(rkcsAddress, rkIde|tt.mex|tt.function<<1|1)
+			r.Step()
+
+			if r.RKER != tt.rker || r.RKCS&(rkErr|rkHe|rkRdy) != rkErr|rkHe|rkRdy {
+				t.Errorf("expected RKER %06o, got RKER %06o, RKCS %06o", tt.rker, r.RKER, r.RKCS)
+			}
+			if u.InterruptQueue[0].Vector != interrupts.IntRK {
+				t.Errorf("expected RK11 interrupt")
+			}
+		})
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+}
@@ -0,0 +1,414 @@
+package unibus
+
+import (
+	"errors"
+	"fmt"
+	"pdp/interrupts"
+)
+
+const (
+	// unibus Addresses:
+	rlcsAddress = 0774400
+	rlbaAddress = 0774402
+	rldaAddress = 0774404
+	rlmpAddress = 0774406
+
+	// RLCS bits
+	rlDrdy = 1 << 0
+	rlIe   = 1 << 6
+	rlCrdy = 1 << 7
+	rlDe   = 1 << 14
+	rlCe   = 1 << 15
+
+	// RLCS error codes, bits 10-13
+	rlOpi  = 1 << 10
+	rlDcrc = 2 << 10
+	rlHnf  = 5 << 10
+	rlNxm  = 8 << 10
+
+	// RL11 functions, RLCS bits 1-3
+	rlNop          = 0
+	rlWriteCheck   = 1
+	rlGetStatus    = 2
+	rlSeek         = 3
+	rlReadHeader   = 4
+	rlWrite        = 5
+	rlRead         = 6
+	rlReadNoHeader = 7
+
+	// drive status word returned by the get status function
+	rlStLockOn = 5
+	rlStBh     = 1 << 3
+	rlStHo     = 1 << 4
+	rlStDt     = 1 << 7
+	rlStWge    = 1 << 10
+	rlStWl     = 1 << 13
+
+	// geometry: RL01 has 256 cylinders, RL02 512, both with 2 heads and 40 sectors of 128 words.
+	rlHeads       = 2
+	rlSectors     = 40
+	rlSectorSize  = 256
+	rl01Cylinders = 256
+	rl02Cylinders = 512
+	rl01Size      = rl01Cylinders * rlHeads * rlSectors * rlSectorSize
+	rl02Size      = rl02Cylinders * rlHeads * rlSectors * rlSectorSize
+)
+
+// RL11 disk controller
+type RL11 struct {
+	RLCS uint16
+
+	// bus address. Bits 16 and 17 are set and shown in RLCS bits 4 and 5
+	RLBA uint32
+	RLDA uint16
+
+	// RLMP - multipurpose register: word count, drive status or the sector header.
+	// Read header fills the next two words of the header, shifted to RLMP on every read.
+	RLMP uint16
+	mp   [2]uint16
+
+	// disk units
+	unit [4]*rlDrive
+
+	// function started, executed in the next step
+	running bool
+
+	unibus *Unibus
+}
+
+// rlDrive - RL01 or RL02 drive
+type rlDrive struct {
+	*diskImage
+
+	rl02 bool
+
+	// head position. sector is the next sector passing under the heads
+	cylinder, head, sector int
+
+	// write gate error - write to the write protected drive, cleared by get status with reset
+	wge bool
+}
+
+// NewRL returns new RL11 object
+func NewRL(u *Unibus) *RL11 {
+	r := RL11{}
+	r.unibus = u
+	return &r
+}
+
+// Attach reads disk image file and loads it to memory.
+// The size of the image decides the drive type: images larger than the RL01 pack are RL02.
+func (r *RL11) Attach(drive int, path string) error {
+	return r.attach(drive, path, false)
+}
+
+// AttachReadOnly attaches disk image in the write protected mode.
+func (r *RL11) AttachReadOnly(drive int, path string) error {
+	return r.attach(drive, path, true)
+}
+
+func (r *RL11) attach(drive int, path string, readOnly bool) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to mount disk to unit > 3")
+	}
+
+	image, err := openImage(path, readOnly)
+	if err != nil {
+		return err
+	}
+	if len(image.rdisk) > rl02Size {
+		image.close()
+		return fmt.Errorf("image of %d bytes doesn't fit on the RL02", len(image.rdisk))
+	}
+
+	if err := r.Detach(drive); err != nil {
+		image.close()
+		return err
+	}
+	d := &rlDrive{diskImage: image, rl02: len(image.rdisk) > rl01Size}
+	d.grow(d.size())
+	r.unit[drive] = d
+	return nil
+}
+
+// SetDriveType sets the type of the drive attached to the unit: "rl01" or "rl02"
+func (r *RL11) SetDriveType(drive int, driveType string) error {
+	if drive < 0 || drive >= len(r.unit) || r.unit[drive] == nil {
+		return fmt.Errorf("no disk attached to unit %d", drive)
+	}
+	d := r.unit[drive]
+	switch driveType {
+	case "":
+	case "rl01":
+		if len(d.rdisk) > rl01Size {
+			return errors.New("image doesn't fit on the RL01")
+		}
+		d.rl02 = false
+	case "rl02":
+		d.rl02 = true
+		d.grow(d.size())
+	default:
+		return fmt.Errorf("unsupported drive type %s, expected rl01 or rl02", driveType)
+	}
+	return nil
+}
+
+// Detach closes the image file attached to the drive
+func (r *RL11) Detach(drive int) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to detach disk from unit > 3")
+	}
+	unit := r.unit[drive]
+	if unit == nil {
+		return nil
+	}
+	r.unit[drive] = nil
+	return unit.close()
+}
+
+// DetachAll closes all attached image files
+func (r *RL11) DetachAll() error {
+	var err error
+	for i := range r.unit {
+		if e := r.Detach(i); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *rlDrive) cylinders() int {
+	if d.rl02 {
+		return rl02Cylinders
+	}
+	return rl01Cylinders
+}
+
+func (d *rlDrive) size() int {
+	if d.rl02 {
+		return rl02Size
+	}
+	return rl01Size
+}
+
+// status returns the drive status word: heads locked on the cylinder
+func (d *rlDrive) status() uint16 {
+	s := uint16(rlStLockOn|rlStBh|rlStHo) | uint16(d.head)<<6
+	if d.rl02 {
+		s |= rlStDt
+	}
+	if d.wge {
+		s |= rlStWge
+	}
+	if d.readOnly {
+		s |= rlStWl
+	}
+	return s
+}
+
+func (r *RL11) Name() string {
+	return "RL11"
+}
+
+// AddressRange - RL11 registers occupy 0774400 - 0774406
+func (r *RL11) AddressRange() (Uint18, Uint18) {
+	return RL11Addr, RL11Addr + 06
+}
+
+// Vector returns RL11 interrupt vector and priority
+func (r *RL11) Vector() (uint16, uint16) {
+	return interrupts.IntRL, 5
+}
+
+// selected returns the drive selected in RLCS, or nil if nothing is attached to it
+func (r *RL11) selected() *rlDrive {
+	return r.unit[(r.RLCS>>8)&3]
+}
+
+// Read16 reads and returns controller register value
+func (r *RL11) Read16(address Uint18) (uint16, error) {
+	switch address {
+	case rlcsAddress:
+		// bus address bits 16 and 17, and the drive ready of the selected drive
+		cs := r.RLCS | uint16(r.RLBA>>12)&060
+		if r.selected() != nil {
+			cs |= rlDrdy
+		}
+		return cs, nil
+	case rlbaAddress:
+		return uint16(r.RLBA & 0xFFFF), nil
+	case rldaAddress:
+		return r.RLDA, nil
+	case rlmpAddress:
+		mp := r.RLMP
+		r.RLMP, r.mp[0], r.mp[1] = r.mp[0], r.mp[1], 0
+		return mp, nil
+	default:
+		return 0, fmt.Errorf("invalid RL11 read from %06o", address)
+	}
+}
+
+// Write16 writes to the controller register
+func (r *RL11) Write16(address Uint18, value uint16) error {
+	switch address {
+	case rlcsAddress:
+		r.RLBA = (r.RLBA & 0xFFFF) | uint32(value&060)<<12
+		// function, interrupt enable and drive select
+		const bits uint16 = 01516
+
+		ie := r.RLCS & rlIe
+		r.RLCS = r.RLCS&^bits | value&bits
+		if value&rlCrdy == 0 {
+			// clearing the controller ready starts the function
+			r.RLCS &^= rlCrdy | rlCe | rlDe | 017<<10
+			r.running = true
+		} else if ie == 0 && r.RLCS&(rlIe|rlCrdy) == rlIe|rlCrdy {
+			r.interrupt()
+		}
+	case rlbaAddress:
+		r.RLBA = (r.RLBA & 0x30000) | uint32(value&0177776)
+	case rldaAddress:
+		r.RLDA = value
+	case rlmpAddress:
+		r.RLMP = value
+	default:
+		return fmt.Errorf("invalid RL11 write to %06o", address)
+	}
+	return nil
+}
+
+// Read8 - byte access to the RL11 registers
+func (r *RL11) Read8(address Uint18) (uint16, error) {
+	return readByteFromWord(r, address)
+}
+
+// Write8 - byte access to the RL11 registers
+func (r *RL11) Write8(address Uint18, value uint16) error {
+	return writeByteToWord(r, address, value)
+}
+
+// Reset sets the controller to it's default values.
+// Drives keep the heads where they are.
+func (r *RL11) Reset() {
+	r.RLCS = rlCrdy
+	r.RLBA = 0
+	r.RLDA = 0
+	r.RLMP = 0
+	r.mp = [2]uint16{}
+	r.running = false
+}
+
+// interrupt sends the interrupt, if enabled in RLCS
+func (r *RL11) interrupt() {
+	if r.RLCS&rlIe != 0 {
+		vector, priority := r.Vector()
+		r.unibus.SendInterrupt(priority, vector)
+	}
+}
+
+// rlDone ends the function with the error code set in RLCS,
+// the controller is ready, and interrupts if enabled
+func (r *RL11) rlDone(code uint16) {
+	r.running = false
+	r.RLCS |= rlCrdy | code
+	if code != 0 {
+		r.RLCS |= rlCe
+	}
+	r.interrupt()
+}
+
+// Step executes the function started by the guest. The whole function is done in a single step.
+func (r *RL11) Step() {
+	if !r.running {
+		return
+	}
+
+	function := (r.RLCS >> 1) & 7
+	if function == rlNop {
+		r.rlDone(0)
+		return
+	}
+	drive := r.selected()
+	if drive == nil {
+		// operation incomplete: nothing answers on the selected drive
+		r.rlDone(rlOpi)
+		return
+	}
+
+	switch function {
+	case rlGetStatus:
+		if r.RLDA&010 != 0 {
+			drive.wge = false
+		}
+		r.RLMP = drive.status()
+	case rlSeek:
+		r.seek(drive)
+	case rlReadHeader:
+		// the second header word is always zero. Header CRC is not emulated.
+		r.RLMP = uint16(drive.cylinder<<7 | drive.head<<6 | drive.sector)
+		r.mp = [2]uint16{}
+		drive.sector = (drive.sector + 1) % rlSectors
+	default:
+		r.rlDone(r.transfer(drive, function))
+		return
+	}
+	r.rlDone(0)
+}
+
+// seek moves the heads by the difference in RLDA bits 7-15, towards the spindle if bit 2 is set,
+// and selects the head from bit 4. The heads stop at the first or the last cylinder.
+func (r *RL11) seek(d *rlDrive) {
+	diff := int(r.RLDA >> 7)
+	if r.RLDA&4 == 0 {
+		diff = -diff
+	}
+	d.cylinder = min(max(d.cylinder+diff, 0), d.cylinders()-1)
+	d.head = int(r.RLDA>>4) & 1
+}
+
+// transfer reads, writes or checks the sectors starting at RLDA, and returns the error code.
+// The transfer ends at the end of the track.
+func (r *RL11) transfer(d *rlDrive, function uint16) uint16 {
+	cylinder := int(r.RLDA >> 7)
+	head := int(r.RLDA>>6) & 1
+	sector := int(r.RLDA & 077)
+
+	// the header of the sector has to match the cylinder the heads are on
+	if sector >= rlSectors || cylinder >= d.cylinders() ||
+		function != rlReadNoHeader && cylinder != d.cylinder {
+		r.unibus.log.Printf("RL: header not found, cylinder %o, head %o, sector %o\n", cylinder, head, sector)
+		return rlHnf
+	}
+	if function == rlWrite && d.readOnly {
+		d.wge = true
+		return rlDe
+	}
+
+	words := 0200000 - int(r.RLMP)
+	words = min(words, (rlSectors-sector)*rlSectorSize/2)
+
+	mode := imageRead
+	switch function {
+	case rlWrite:
+		mode = imageWrite
+	case rlWriteCheck:
+		mode = imageWriteCheck
+	}
+	t := imageTransfer{mode: mode, addr: Uint18(r.RLBA), step: 2}
+	start := ((cylinder*rlHeads+head)*rlSectors + sector) * rlSectorSize
+	end := d.transfer(r.unibus, &t, start, words, rlSectorSize)
+	r.RLBA = uint32(t.addr)
+	r.RLMP += uint16(t.words)
+
+	var code uint16
+	switch {
+	case t.nxm:
+		code = rlNxm
+	case t.mismatch:
+		code = rlDcrc
+	}
+	sectors := (end - start) / rlSectorSize
+	r.RLDA = r.RLDA&^077 | uint16(sector+sectors)&077
+	d.sector = (sector + sectors) % rlSectors
+	return code
+}
@@ -0,0 +1,218 @@
+package unibus
+
+import (
+	"os"
+	"pdp/interrupts"
+	"testing"
+)
+
+// rlFunction starts the function on the drive 0 and executes it. Interrupt enable is kept.
+func rlFunction(r *RL11, function, rlda, rlmp uint16) {
+	_ = r.Write16(rldaAddress, rlda)
+	_ = r.Write16(rlbaAddress, 01000)
+	_ = r.Write16(rlmpAddress, rlmp)
+	_ = r.Write16(rlcsAddress, r.RLCS&rlIe|function<<1)
+	r.Step()
+}
+
+func TestRL11_Attach(t *testing.T) {
+	r := NewRL(u)
+	if err := r.Attach(4, newImage(t, "rl.img", nil)); err == nil {
+		t.Errorf("expected error attaching unit 4")
+	}
+	if err := r.Attach(0, newImage(t, "rl.img", make([]byte, rl02Size+2))); err == nil {
+		t.Errorf("expected error attaching image larger than RL02")
+	}
+
+	tests := []struct {
+		name      string
+		size      int
+		driveType string
+		rl02      bool
+	}{
+		{"empty image", 0, "", false},
+		{"RL01 image", rl01Size, "", false},
+		{"RL02 image", rl02Size, "", true},
+		{"short RL02 image", rl01Size + rlSectorSize, "", true},
+		{"empty image as RL02", 0, "rl02", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.Attach(1, newImage(t, "rl.img", make([]byte, tt.size))); err != nil {
+				t.Fatalf("Attach() error = %v", err)
+			}
+			defer r.Detach(1)
+			if err := r.SetDriveType(1, tt.driveType); err != nil {
+				t.Fatalf("SetDriveType() error = %v", err)
+			}
+			if d := r.unit[1]; d.rl02 != tt.rl02 || len(d.rdisk) != d.size() {
+				t.Errorf("expected RL02 %v, got %v with %d bytes", tt.rl02, d.rl02, len(d.rdisk))
+			}
+		})
+	}
+}
+
+func TestRL11_SeekReadHeader(t *testing.T) {
+	r := NewRL(u)
+	if err := r.Attach(0, newImage(t, "rl.img", make([]byte, rl01Size))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	tests := []struct {
+		name   string
+		rlda   uint16
+		header uint16
+	}{
+		{"seek in by 10, head 1", 10<<7 | 1<<4 | 4 | 1, 10<<7 | 1<<6},
+		{"seek out by 3, head 0", 3<<7 | 1, 7 << 7},
+		{"seek out beyond the first cylinder", 100<<7 | 1, 0},
+		{"seek in beyond the last cylinder", 0777<<7 | 4 | 1, 255 << 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rlFunction(r, rlSeek, tt.rlda, 0)
+			r.unit[0].sector = 0
+			rlFunction(r, rlReadHeader, 0, 0)
+
+			if r.RLCS&(rlCrdy|rlCe) != rlCrdy {
+				t.Errorf("expected ready controller without errors, RLCS %06o", r.RLCS)
+			}
+			if header, _ := r.Read16(rlmpAddress); header != tt.header {
+				t.Errorf("expected header %06o, got %06o", tt.header, header)
+			}
+			if crc, _ := r.Read16(rlmpAddress); crc != 0 {
+				t.Errorf("expected second header word 0, got %06o", crc)
+			}
+		})
+	}
+}
+
+func TestRL11_GetStatus(t *testing.T) {
+	r := NewRL(u)
+	if err := r.AttachReadOnly(0, newImage(t, "rl.img", make([]byte, rl02Size))); err != nil {
+		t.Fatalf("AttachReadOnly() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	rlFunction(r, rlSeek, 1<<4|1, 0)
+	rlFunction(r, rlGetStatus, 3, 0)
+	want := uint16(rlStLockOn | rlStBh | rlStHo | 1<<6 | rlStDt | rlStWl)
+	if r.RLMP != want {
+		t.Errorf("expected status %06o, got %06o", want, r.RLMP)
+	}
+
+	// write to the write protected drive is a drive error, reported until reset by get status
+	rlFunction(r, rlWrite, 0, 0177600)
+	if r.RLCS&(rlCe|rlDe|rlCrdy) != rlCe|rlDe|rlCrdy {
+		t.Errorf("expected drive error, RLCS %06o", r.RLCS)
+	}
+	rlFunction(r, rlGetStatus, 3, 0)
+	if r.RLMP&rlStWge == 0 {
+		t.Errorf("expected write gate error in status %06o", r.RLMP)
+	}
+	rlFunction(r, rlGetStatus, 013, 0)
+	if r.RLMP&rlStWge != 0 || r.RLCS&rlCe != 0 {
+		t.Errorf("expected errors reset, status %06o, RLCS %06o", r.RLMP, r.RLCS)
+	}
+}
+
+func TestRL11_ReadWrite(t *testing.T) {
+	path := newImage(t, "rl.img", make([]byte, rl01Size))
+	r := NewRL(u)
+	if err := r.Attach(0, path); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	// write 130 words to cylinder 2, head 1, sector 3
+	rlFunction(r, rlSeek, 2<<7|1<<4|4|1, 0)
+	for i := 0; i < 130; i++ {
+		u.Memory[(01000>>1)+i] = uint16(i) | 0100000
+	}
+	u.Memory[(01000>>1)+130] = 0177777
+	rlda := uint16(2<<7 | 1<<6 | 3)
+	_ = r.Write16(rlcsAddress, rlIe|rlCrdy)
+	u.InterruptQueue = interrupts.InterruptQueue{}
+	rlFunction(r, rlWrite, rlda, 0177576)
+
+	if r.RLCS&(rlCrdy|rlCe) != rlCrdy || r.RLMP != 0 || r.RLBA != 01000+260 || r.RLDA != rlda+2 {
+		t.Errorf("unexpected registers after write: RLCS %06o, RLMP %06o, RLBA %06o, RLDA %06o",
+			r.RLCS, r.RLMP, r.RLBA, r.RLDA)
+	}
+	if u.InterruptQueue[0].Vector != interrupts.IntRL {
+		t.Errorf("expected RL11 interrupt")
+	}
+	buf, _ := os.ReadFile(path)
+	pos := ((2*rlHeads+1)*rlSectors + 3) * rlSectorSize
+	if buf[pos] != 0 || buf[pos+1] != 0200 || buf[pos+2*129] != 129 || buf[pos+2*130] != 0 {
+		t.Errorf("sectors haven't been written through to the image")
+	}
+
+	// read of 65536 words without the header check stops after two sectors, at the end of the track
+	for i := 0; i < 256; i++ {
+		u.Memory[(01000>>1)+i] = 0
+	}
+	rlFunction(r, rlReadNoHeader, 2<<7|1<<6|38, 0)
+	if r.RLMP != 256 || r.RLBA != 01000+512 {
+		t.Errorf("expected the read to stop at the end of the track, RLMP %06o, RLBA %06o", r.RLMP, r.RLBA)
+	}
+	rlFunction(r, rlRead, rlda, 0177576)
+	for i := 0; i < 130; i++ {
+		if u.Memory[(01000>>1)+i] != uint16(i)|0100000 {
+			t.Fatalf("word %d: expected %06o, got %06o", i, uint16(i)|0100000, u.Memory[(01000>>1)+i])
+		}
+	}
+
+	// write check against the changed memory
+	rlFunction(r, rlWriteCheck, rlda, 0177600)
+	if r.RLCS&(rlCe|017<<10) != 0 {
+		t.Errorf("expected write check to pass, RLCS %06o", r.RLCS)
+	}
+	u.Memory[01000>>1] = 0
+	rlFunction(r, rlWriteCheck, rlda, 0177600)
+	if r.RLCS&(rlCe|017<<10) != rlCe|rlDcrc {
+		t.Errorf("expected write check error, RLCS %06o", r.RLCS)
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+}
+
+func TestRL11_Errors(t *testing.T) {
+	r := NewRL(u)
+	if err := r.Attach(0, newImage(t, "rl.img", make([]byte, rl01Size))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+
+	tests := []struct {
+		name     string
+		function uint16
+		rlcs     uint16
+		rlda     uint16
+		rlba     uint16
+		code     uint16
+	}{
+		{"missing drive", rlRead, 1 << 8, 0, 01000, rlOpi},
+		{"cylinder mismatch", rlRead, 0, 1 << 7, 01000, rlHnf},
+		{"invalid sector", rlWrite, 0, 40, 01000, rlHnf},
+		{"non existent memory", rlRead, 060, 0, 0170000, rlNxm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.Reset()
+			_ = r.Write16(rldaAddress, tt.rlda)
+			_ = r.Write16(rlbaAddress, tt.rlba)
+			_ = r.Write16(rlmpAddress, 0177600)
+			_ = r.Write16(rlcsAddress, tt.rlcs|tt.function<<1)
+			r.Step()
+
+			if r.RLCS&(rlCe|rlCrdy|017<<10) != rlCe|rlCrdy|tt.code {
+				t.Errorf("expected error code %06o, got RLCS %06o", tt.code, r.RLCS)
+			}
+		})
+	}
+}
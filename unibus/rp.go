@@ -0,0 +1,644 @@
+package unibus
+
+import (
+	"errors"
+	"fmt"
+	"pdp/interrupts"
+)
+
+const (
+	// unibus Addresses:
+	rpcs1Address = 0776700
+	rpwcAddress  = 0776702
+	rpbaAddress  = 0776704
+	rpdaAddress  = 0776706
+	rpcs2Address = 0776710
+	rpdsAddress  = 0776712
+	rper1Address = 0776714
+	rpasAddress  = 0776716
+	rplaAddress  = 0776720
+	rpdbAddress  = 0776722
+	rpmrAddress  = 0776724
+	rpdtAddress  = 0776726
+	rpsnAddress  = 0776730
+	rpofAddress  = 0776732
+	rpdcAddress  = 0776734
+	rpccAddress  = 0776736
+	rper2Address = 0776740
+	rper3Address = 0776742
+	rpec1Address = 0776744
+	rpec2Address = 0776746
+
+	// RPCS1 bits
+	rpGo  = 1 << 0
+	rpIe  = 1 << 6
+	rpRdy = 1 << 7
+	rpDva = 1 << 11
+	rpTre = 1 << 14
+	rpSc  = 1 << 15
+
+	// RPCS2 bits
+	rpBai = 1 << 3
+	rpClr = 1 << 5
+	rpIr  = 1 << 6
+	rpOr  = 1 << 7
+	rpPge = 1 << 10
+	rpNem = 1 << 11
+	rpNed = 1 << 12
+	rpWce = 1 << 14
+
+	// RPDS bits
+	rpVv  = 1 << 6
+	rpDry = 1 << 7
+	rpDpr = 1 << 8
+	rpWrl = 1 << 11
+	rpMol = 1 << 12
+	rpPip = 1 << 13
+	rpErr = 1 << 14
+	rpAta = 1 << 15
+
+	// RPER1 bits
+	rpIlf = 1 << 0
+	rpAoe = 1 << 9
+	rpIae = 1 << 10
+	rpWle = 1 << 11
+
+	// RP functions, RPCS1 bits 1-5
+	rpNop          = 0
+	rpUnload       = 01
+	rpSeek         = 02
+	rpRecalibrate  = 03
+	rpDriveClear   = 04
+	rpRelease      = 05
+	rpOffset       = 06
+	rpCenterline   = 07
+	rpPreset       = 010
+	rpPackAck      = 011
+	rpSearch       = 014
+	rpWriteCheck   = 024
+	rpWriteCheckHd = 025
+	rpWrite        = 030
+	rpWriteHeader  = 031
+	rpRead         = 034
+	rpReadHeader   = 035
+
+	// geometry: 19 tracks of 22 sectors per cylinder, 256 words in a sector
+	rpTracks     = 19
+	rpSectors    = 22
+	rpSectorSize = 512
+)
+
+// rpType - drive type: name, RPDT drive type register and the number of cylinders
+type rpType struct {
+	name      string
+	dt        uint16
+	cylinders int
+}
+
+func (t rpType) size() int {
+	return t.cylinders * rpTracks * rpSectors * rpSectorSize
+}
+
+// rpTypes - supported drives, from the smallest
+var rpTypes = []rpType{
+	{"rp04", 020020, 411},
+	{"rp05", 020021, 411},
+	{"rp06", 020022, 815},
+}
+
+// RH11 massbus controller with RP04, RP05 and RP06 drives
+type RH11 struct {
+	// controller registers. RPCS1 keeps IE, RDY, TRE and the last function,
+	// the bus address bits 16 and 17 are kept in RPBA
+	RPCS1 uint16
+	RPWC  uint16
+	RPBA  uint32
+	RPCS2 uint16
+	RPDB  uint16
+
+	// disk units
+	unit [8]*rpDrive
+
+	// data transfer started on the drive, executed in the next step
+	running bool
+	xfer    int
+
+	unibus *Unibus
+}
+
+// rpDrive - RP04, RP05 or RP06 drive, with its massbus registers
+type rpDrive struct {
+	*diskImage
+
+	rpType
+
+	// desired sector and track, desired cylinder, offset and the current cylinder
+	da, dc, of, cc uint16
+
+	er1, er2, er3 uint16
+
+	// volume valid, attention, positioning in progress
+	vv, ata, pip bool
+
+	// positioning function completed in the next step
+	pending uint16
+
+	// sector under the heads, shown in the look ahead register
+	la int
+}
+
+// NewRH returns new RH11 object
+func NewRH(u *Unibus) *RH11 {
+	r := RH11{}
+	r.unibus = u
+	return &r
+}
+
+// Attach reads disk image file and loads it to memory.
+// The drive type is the smallest drive the image fits on.
+func (r *RH11) Attach(drive int, path string) error {
+	return r.attach(drive, path, false)
+}
+
+// AttachReadOnly attaches disk image in the write protected mode.
+func (r *RH11) AttachReadOnly(drive int, path string) error {
+	return r.attach(drive, path, true)
+}
+
+func (r *RH11) attach(drive int, path string, readOnly bool) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to mount disk to unit > 7")
+	}
+
+	image, err := openImage(path, readOnly)
+	if err != nil {
+		return err
+	}
+	d := &rpDrive{diskImage: image}
+	if err := d.setType(""); err != nil {
+		image.close()
+		return err
+	}
+
+	if err := r.Detach(drive); err != nil {
+		image.close()
+		return err
+	}
+	r.unit[drive] = d
+	return nil
+}
+
+// SetDriveType sets the type of the drive attached to the unit: "rp04", "rp05" or "rp06"
+func (r *RH11) SetDriveType(drive int, driveType string) error {
+	if drive < 0 || drive >= len(r.unit) || r.unit[drive] == nil {
+		return fmt.Errorf("no disk attached to unit %d", drive)
+	}
+	return r.unit[drive].setType(driveType)
+}
+
+// setType sets the drive type, or picks the smallest drive the image fits on if driveType is empty
+func (d *rpDrive) setType(driveType string) error {
+	for _, t := range rpTypes {
+		if driveType == t.name || driveType == "" && len(d.rdisk) <= t.size() {
+			if len(d.rdisk) > t.size() {
+				return fmt.Errorf("image doesn't fit on the %s", t.name)
+			}
+			d.rpType = t
+			d.grow(t.size())
+			return nil
+		}
+	}
+	if driveType == "" {
+		return fmt.Errorf("image of %d bytes doesn't fit on the RP06", len(d.rdisk))
+	}
+	return fmt.Errorf("unsupported drive type %s, expected rp04, rp05 or rp06", driveType)
+}
+
+// Detach closes the image file attached to the drive
+func (r *RH11) Detach(drive int) error {
+	if drive < 0 || drive >= len(r.unit) {
+		return errors.New("tried to detach disk from unit > 7")
+	}
+	unit := r.unit[drive]
+	if unit == nil {
+		return nil
+	}
+	r.unit[drive] = nil
+	return unit.close()
+}
+
+// DetachAll closes all attached image files
+func (r *RH11) DetachAll() error {
+	var err error
+	for i := range r.unit {
+		if e := r.Detach(i); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// status returns the drive status register
+func (d *rpDrive) status() uint16 {
+	ds := uint16(rpMol | rpDpr)
+	if d.pip {
+		ds |= rpPip
+	} else {
+		ds |= rpDry
+	}
+	if d.vv {
+		ds |= rpVv
+	}
+	if d.readOnly {
+		ds |= rpWrl
+	}
+	if d.er1|d.er2|d.er3 != 0 {
+		ds |= rpErr
+	}
+	if d.ata {
+		ds |= rpAta
+	}
+	return ds
+}
+
+// clear - drive clear: errors and attention are gone, positioning stops
+func (d *rpDrive) clear() {
+	d.er1, d.er2, d.er3 = 0, 0, 0
+	d.ata = false
+	d.pip = false
+	d.pending = rpNop
+}
+
+// attention ends the positioning function, or reports the drive error
+func (d *rpDrive) attention() {
+	d.pip = false
+	d.ata = true
+}
+
+func (r *RH11) Name() string {
+	return "RH11"
+}
+
+// AddressRange - RH11 and the massbus registers occupy 0776700 - 0776746
+func (r *RH11) AddressRange() (Uint18, Uint18) {
+	return RH11Addr, RH11Addr + 046
+}
+
+// Vector returns RH11 interrupt vector and priority
+func (r *RH11) Vector() (uint16, uint16) {
+	return interrupts.IntRP, 5
+}
+
+// selected returns the drive selected in RPCS2, or nil if nothing is attached to it
+func (r *RH11) selected() *rpDrive {
+	return r.unit[r.RPCS2&7]
+}
+
+// attentionSummary returns the RPAS register: attention bits of all drives
+func (r *RH11) attentionSummary() uint16 {
+	var as uint16
+	for i, d := range r.unit {
+		if d != nil && d.ata {
+			as |= 1 << i
+		}
+	}
+	return as
+}
+
+// Read16 reads and returns controller or the selected drive register value
+func (r *RH11) Read16(address Uint18) (uint16, error) {
+	switch address {
+	case rpcs1Address:
+		cs := r.RPCS1 | uint16(r.RPBA>>8)&01400 | rpDva
+		if r.RPCS1&rpTre != 0 || r.attentionSummary() != 0 {
+			cs |= rpSc
+		}
+		if r.running {
+			cs |= rpGo
+		}
+		return cs, nil
+	case rpwcAddress:
+		return r.RPWC, nil
+	case rpbaAddress:
+		return uint16(r.RPBA & 0xFFFF), nil
+	case rpcs2Address:
+		return r.RPCS2 | rpIr | rpOr, nil
+	case rpasAddress:
+		return r.attentionSummary(), nil
+	case rpdbAddress:
+		return r.RPDB, nil
+	}
+
+	// massbus registers of the selected drive
+	d := r.selected()
+	if d == nil {
+		r.nonExistentDrive()
+		return 0, nil
+	}
+	switch address {
+	case rpdaAddress:
+		return d.da, nil
+	case rpdsAddress:
+		return d.status(), nil
+	case rper1Address:
+		return d.er1, nil
+	case rplaAddress:
+		d.la = (d.la + 1) % rpSectors
+		return uint16(d.la) << 6, nil
+	case rpmrAddress:
+		return 0, nil
+	case rpdtAddress:
+		return d.dt, nil
+	case rpsnAddress:
+		return uint16(r.RPCS2&7) + 1, nil
+	case rpofAddress:
+		return d.of, nil
+	case rpdcAddress:
+		return d.dc, nil
+	case rpccAddress:
+		return d.cc, nil
+	case rper2Address:
+		return d.er2, nil
+	case rper3Address:
+		return d.er3, nil
+	case rpec1Address, rpec2Address:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid RH11 read from %06o", address)
+	}
+}
+
+// Write16 writes to the controller or the selected drive register
+func (r *RH11) Write16(address Uint18, value uint16) error {
+	switch address {
+	case rpcs1Address:
+		r.writeCS1(value)
+		return nil
+	case rpwcAddress:
+		r.RPWC = value
+		return nil
+	case rpbaAddress:
+		r.RPBA = (r.RPBA & 0x30000) | uint32(value&0177776)
+		return nil
+	case rpcs2Address:
+		if value&rpClr != 0 {
+			r.Reset()
+			return nil
+		}
+		// unit select, bus address increment inhibit and parity test
+		r.RPCS2 = r.RPCS2&^037 | value&037
+		return nil
+	case rpasAddress:
+		// writing 1 clears the attention of the drive
+		for i, d := range r.unit {
+			if d != nil && value&(1<<i) != 0 {
+				d.ata = false
+			}
+		}
+		return nil
+	case rpdbAddress:
+		r.RPDB = value
+		return nil
+	}
+
+	d := r.selected()
+	if d == nil {
+		r.nonExistentDrive()
+		return nil
+	}
+	switch address {
+	case rpdaAddress:
+		d.da = value & 017437
+	case rper1Address:
+		d.er1 = value
+	case rpofAddress:
+		d.of = value
+	case rpdcAddress:
+		d.dc = value & 01777
+	case rpdsAddress, rplaAddress, rpmrAddress, rpdtAddress, rpsnAddress, rpccAddress,
+		rper2Address, rper3Address, rpec1Address, rpec2Address:
+		// read only, or not emulated
+	default:
+		return fmt.Errorf("invalid RH11 write to %06o", address)
+	}
+	return nil
+}
+
+// Read8 - byte access to the RH11 registers
+func (r *RH11) Read8(address Uint18) (uint16, error) {
+	return readByteFromWord(r, address)
+}
+
+// Write8 - byte access to the RH11 registers
+func (r *RH11) Write8(address Uint18, value uint16) error {
+	return writeByteToWord(r, address, value)
+}
+
+// nonExistentDrive - access to the massbus register of the drive that is not there
+func (r *RH11) nonExistentDrive() {
+	r.RPCS2 |= rpNed
+	r.RPCS1 |= rpTre
+}
+
+// writeCS1 sets the interrupt enable, the bus address extension and the function.
+// The GO bit starts the function on the selected drive.
+func (r *RH11) writeCS1(value uint16) {
+	r.RPBA = (r.RPBA & 0xFFFF) | uint32(value&01400)<<8
+	if value&rpTre != 0 {
+		// writing 1 clears the transfer error
+		r.RPCS1 &^= rpTre
+		r.RPCS2 &^= 0177400
+	}
+	ie := r.RPCS1 & rpIe
+	r.RPCS1 = r.RPCS1&^(rpIe|076) | value&(rpIe|076)
+
+	if value&rpGo == 0 {
+		if ie == 0 && r.RPCS1&(rpIe|rpRdy) == rpIe|rpRdy {
+			r.interrupt()
+		}
+		return
+	}
+
+	d := r.selected()
+	if d == nil {
+		r.nonExistentDrive()
+		return
+	}
+	function := (value >> 1) & 037
+	if function >= rpWriteCheck {
+		if r.running {
+			r.RPCS2 |= rpPge
+			r.RPCS1 |= rpTre
+			return
+		}
+		r.RPCS1 &^= rpRdy | rpTre
+		r.RPCS2 &^= 0177400
+		r.running = true
+		r.xfer = int(r.RPCS2 & 7)
+		return
+	}
+	r.driveFunction(d, function)
+}
+
+// driveFunction executes the function that doesn't transfer data.
+// Positioning functions set the positioning in progress, and end with the attention in the next step.
+func (r *RH11) driveFunction(d *rpDrive, function uint16) {
+	switch function {
+	case rpNop, rpRelease:
+	case rpDriveClear:
+		d.clear()
+	case rpPackAck:
+		d.vv = true
+	case rpPreset:
+		d.vv = true
+		d.da, d.dc, d.of = 0, 0, 0
+	case rpSeek, rpSearch:
+		if int(d.dc) >= d.cylinders || int(d.da>>8) >= rpTracks || int(d.da&037) >= rpSectors {
+			r.driveError(d, rpIae)
+			return
+		}
+		d.pip = true
+		d.pending = function
+	case rpRecalibrate, rpUnload, rpOffset, rpCenterline:
+		// unload is not emulated, the pack stays on line
+		d.pip = true
+		d.pending = function
+	default:
+		r.driveError(d, rpIlf)
+	}
+}
+
+// driveError sets the error in RPER1, and raises the attention
+func (r *RH11) driveError(d *rpDrive, code uint16) {
+	d.er1 |= code
+	d.attention()
+	r.attentionInterrupt()
+}
+
+// attentionInterrupt interrupts if the controller is ready, and interrupts are enabled
+func (r *RH11) attentionInterrupt() {
+	if r.RPCS1&rpRdy != 0 {
+		r.interrupt()
+	}
+}
+
+// interrupt sends the interrupt, if enabled in RPCS1.
+// RH11 clears the interrupt enable when the interrupt is taken.
+func (r *RH11) interrupt() {
+	if r.RPCS1&rpIe != 0 {
+		r.RPCS1 &^= rpIe
+		vector, priority := r.Vector()
+		r.unibus.SendInterrupt(priority, vector)
+	}
+}
+
+// Reset - controller clear and the massbus init.
+// Drives keep the volume valid and the heads where they are.
+func (r *RH11) Reset() {
+	r.RPCS1 = rpRdy
+	r.RPCS2 = 0
+	r.RPWC = 0
+	r.RPBA = 0
+	r.RPDB = 0
+	r.running = false
+	for _, d := range r.unit {
+		if d != nil {
+			d.clear()
+			d.da, d.of = 0, 0
+		}
+	}
+}
+
+// Step completes the positioning functions, and executes the data transfer
+func (r *RH11) Step() {
+	for _, d := range r.unit {
+		if d == nil || d.pending == rpNop {
+			continue
+		}
+		switch d.pending {
+		case rpSeek, rpSearch:
+			d.cc = d.dc
+		case rpRecalibrate:
+			d.cc = 0
+		}
+		d.pending = rpNop
+		d.attention()
+		r.attentionInterrupt()
+	}
+
+	if !r.running {
+		return
+	}
+	r.running = false
+	if d := r.unit[r.xfer]; d != nil {
+		r.transfer(d, (r.RPCS1>>1)&037)
+	} else {
+		r.RPCS2 |= rpNed
+	}
+	if r.RPCS2&0177400 != 0 {
+		r.RPCS1 |= rpTre
+	}
+	r.RPCS1 |= rpRdy
+	r.interrupt()
+}
+
+// transfer reads, writes or checks the sectors starting at the desired address.
+// The transfer goes on over the track and cylinder boundaries, up to the end of the disk.
+func (r *RH11) transfer(d *rpDrive, function uint16) {
+	cylinder := int(d.dc)
+	track := int(d.da>>8) & 037
+	sector := int(d.da & 037)
+
+	switch {
+	case function == rpWriteCheckHd || function == rpWriteHeader || function == rpReadHeader:
+		// header functions are not emulated
+		d.er1 |= rpIlf
+	case cylinder >= d.cylinders || track >= rpTracks || sector >= rpSectors:
+		d.er1 |= rpIae
+	case function == rpWrite && d.readOnly:
+		d.er1 |= rpWle
+	}
+	if d.er1 != 0 {
+		d.attention()
+		r.RPCS1 |= rpTre
+		return
+	}
+
+	mode := imageRead
+	switch function {
+	case rpWrite:
+		mode = imageWrite
+	case rpWriteCheck:
+		mode = imageWriteCheck
+	}
+	t := imageTransfer{mode: mode, addr: Uint18(r.RPBA), step: 2}
+	if r.RPCS2&rpBai != 0 {
+		t.step = 0
+	}
+	start := ((cylinder*rpTracks+track)*rpSectors + sector) * rpSectorSize
+	words := 0200000 - int(r.RPWC)
+	end := d.transfer(r.unibus, &t, start, min(words, (len(d.rdisk)-start)/2), rpSectorSize)
+	r.RPBA = uint32(t.addr)
+	r.RPWC += uint16(t.words)
+	if t.nxm {
+		r.RPCS2 |= rpNem
+	} else if t.words < words {
+		// the transfer ran off the end of the disk
+		d.er1 |= rpAoe
+		d.attention()
+		r.RPCS1 |= rpTre
+	}
+	if t.mismatch {
+		r.RPCS2 |= rpWce
+	}
+
+	// the desired address points to the sector after the transfer
+	next := end / rpSectorSize
+	sector = next % rpSectors
+	track = next / rpSectors % rpTracks
+	cylinder = next / (rpSectors * rpTracks)
+	d.da = uint16(track<<8 | sector)
+	d.dc = uint16(cylinder)
+	d.cc = d.dc
+	d.la = sector
+}
@@ -0,0 +1,193 @@
+package unibus
+
+import (
+	"os"
+	"pdp/interrupts"
+	"testing"
+)
+
+// rpFunction selects the drive, and starts the function with the interrupts enabled
+func rpFunction(r *RH11, drive, function uint16) {
+	_ = r.Write16(rpcs2Address, drive)
+	_ = r.Write16(rpcs1Address, rpIe|function<<1|rpGo)
+}
+
+// rpTransfer transfers words from or to memory address 01000, starting at the cylinder, track and sector of the drive
+func rpTransfer(r *RH11, drive, function, cylinder, track, sector uint16, words int) {
+	_ = r.Write16(rpcs2Address, drive)
+	_ = r.Write16(rpdcAddress, cylinder)
+	_ = r.Write16(rpdaAddress, track<<8|sector)
+	_ = r.Write16(rpbaAddress, 01000)
+	_ = r.Write16(rpwcAddress, uint16(0200000-words))
+	_ = r.Write16(rpcs1Address, function<<1|rpGo)
+	r.Step()
+}
+
+// rpInterrupts counts the RH11 interrupts in the queue
+func rpInterrupts() int {
+	n := 0
+	for _, i := range u.InterruptQueue {
+		if i.Vector == interrupts.IntRP {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRH11_DriveType(t *testing.T) {
+	path := newImage(t, "rp.img", nil)
+	r := NewRH(u)
+	if err := r.Attach(0, path); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	// the empty image is the RP04, the transfer stops at its end
+	rpTransfer(r, 0, rpRead, 410, 18, 21, 512)
+	if dt, _ := r.Read16(rpdtAddress); dt != 020020 || r.unit[0].er1 != rpAoe || r.RPWC != 0177400 {
+		t.Errorf("expected the RP04 end of the disk, RPDT %06o, RPER1 %06o, RPWC %06o", dt, r.unit[0].er1, r.RPWC)
+	}
+
+	// the RP06 grows the image, the file grows with the write past the RP04 end
+	if err := r.SetDriveType(0, "rp06"); err != nil {
+		t.Fatalf("SetDriveType() error = %v", err)
+	}
+	if dt, _ := r.Read16(rpdtAddress); dt != 020022 || len(r.unit[0].rdisk) != rpTypes[2].size() {
+		t.Errorf("expected the RP06, RPDT %06o with %d bytes", dt, len(r.unit[0].rdisk))
+	}
+	for i := 0; i < 256; i++ {
+		u.Memory[(01000>>1)+i] = 0123456
+	}
+	rpFunction(r, 0, rpDriveClear)
+	rpTransfer(r, 0, rpWrite, 814, 18, 21, 256)
+	if r.RPCS1&rpTre != 0 || r.unit[0].er1 != 0 {
+		t.Errorf("unexpected error writing the last RP06 sector, RPCS1 %06o, RPER1 %06o", r.RPCS1, r.unit[0].er1)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(rpTypes[2].size()) {
+		t.Errorf("expected the image grown to the RP06, got %v", info.Size())
+	}
+
+	// the image doesn't fit on the RP04 any more
+	if err := r.SetDriveType(0, "rp04"); err == nil {
+		t.Errorf("expected error setting RP06 image to RP04")
+	}
+	if err := r.Attach(1, path); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(1)
+	_ = r.Write16(rpcs2Address, 1)
+	if dt, _ := r.Read16(rpdtAddress); dt != 020022 {
+		t.Errorf("expected the grown image attached as RP06, RPDT %06o", dt)
+	}
+}
+
+func TestRH11_Attention(t *testing.T) {
+	r := NewRH(u)
+	for _, drive := range []int{0, 3} {
+		if err := r.Attach(drive, newImage(t, "rp.img", nil)); err != nil {
+			t.Fatalf("Attach() error = %v", err)
+		}
+		defer r.Detach(drive)
+	}
+	r.Reset()
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	// seeks on both drives overlap, and end together with a single interrupt
+	for _, drive := range []uint16{0, 3} {
+		_ = r.Write16(rpcs2Address, drive)
+		_ = r.Write16(rpdcAddress, 100+drive)
+		rpFunction(r, drive, rpSeek)
+	}
+	if as, _ := r.Read16(rpasAddress); as != 0 {
+		t.Errorf("expected no attention during the seek, RPAS %06o", as)
+	}
+	r.Step()
+	cs1, _ := r.Read16(rpcs1Address)
+	if as, _ := r.Read16(rpasAddress); as != 011 || cs1&rpSc == 0 {
+		t.Errorf("expected attention of drives 0 and 3, RPAS %06o, RPCS1 %06o", as, cs1)
+	}
+	if rpInterrupts() != 1 {
+		t.Errorf("expected one RH11 interrupt, got %d", rpInterrupts())
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	// RPAS is cleared drive by drive, the special condition stays on while any drive needs attention
+	_ = r.Write16(rpcs2Address, 5)
+	_ = r.Write16(rpasAddress, 1)
+	cs1, _ = r.Read16(rpcs1Address)
+	if as, _ := r.Read16(rpasAddress); as != 010 || cs1&rpSc == 0 || r.RPCS2&rpNed != 0 {
+		t.Errorf("expected attention of drive 3, RPAS %06o, RPCS1 %06o, RPCS2 %06o", as, cs1, r.RPCS2)
+	}
+	_ = r.Write16(rpasAddress, 010)
+	if cs1, _ = r.Read16(rpcs1Address); cs1&rpSc != 0 {
+		t.Errorf("expected special condition cleared, RPCS1 %06o", cs1)
+	}
+
+	// the seek ending during the transfer doesn't interrupt, the transfer does
+	_ = r.Write16(rpcs2Address, 3)
+	_ = r.Write16(rpdcAddress, 200)
+	_ = r.Write16(rpcs1Address, rpSeek<<1|rpGo)
+	_ = r.Write16(rpcs2Address, 0)
+	_ = r.Write16(rpwcAddress, 0177400)
+	_ = r.Write16(rpcs1Address, rpIe|rpRead<<1|rpGo)
+	r.Step()
+	cs1, _ = r.Read16(rpcs1Address)
+	if as, _ := r.Read16(rpasAddress); as != 010 || cs1&(rpRdy|rpSc) != rpRdy|rpSc || rpInterrupts() != 1 {
+		t.Errorf("expected attention of drive 3 and the transfer interrupt, RPAS %06o, RPCS1 %06o, %d interrupts",
+			as, cs1, rpInterrupts())
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	// the drive error raises the attention right away
+	_ = r.Write16(rpasAddress, 010)
+	rpFunction(r, 3, 013)
+	if as, _ := r.Read16(rpasAddress); as != 010 || r.unit[3].er1 != rpIlf || rpInterrupts() != 1 {
+		t.Errorf("expected attention of drive 3 with illegal function, RPAS %06o, RPER1 %06o", as, r.unit[3].er1)
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+}
+
+func TestRH11_Transfer(t *testing.T) {
+	r := NewRH(u)
+	if err := r.Attach(0, newImage(t, "rp.img", nil)); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer r.Detach(0)
+	r.Reset()
+
+	// the transfer from the last sector of cylinder 5 goes on to cylinder 6
+	for i := 0; i < 300; i++ {
+		u.Memory[(01000>>1)+i] = uint16(i) | 0100000
+	}
+	rpTransfer(r, 0, rpWrite, 5, 18, 21, 300)
+	da, _ := r.Read16(rpdaAddress)
+	dc, _ := r.Read16(rpdcAddress)
+	cc, _ := r.Read16(rpccAddress)
+	if r.RPCS1&(rpRdy|rpTre) != rpRdy || r.RPBA != 01000+600 || da != 1 || dc != 6 || cc != 6 {
+		t.Errorf("unexpected registers after write: RPCS1 %06o, RPBA %06o, RPDA %06o, RPDC %o, RPCC %o",
+			r.RPCS1, r.RPBA, da, dc, cc)
+	}
+
+	// the bus address increment inhibit reads all words to the same address
+	u.Memory[01000>>1] = 0
+	_ = r.Write16(rpcs2Address, rpBai)
+	_ = r.Write16(rpdcAddress, 6)
+	_ = r.Write16(rpdaAddress, 0)
+	_ = r.Write16(rpbaAddress, 01000)
+	_ = r.Write16(rpwcAddress, uint16(0200000-44))
+	_ = r.Write16(rpcs1Address, rpRead<<1|rpGo)
+	r.Step()
+	if r.RPBA != 01000 || u.Memory[01000>>1] != 299|0100000 {
+		t.Errorf("expected the last word of the sector at 01000, got %06o, RPBA %06o", u.Memory[01000>>1], r.RPBA)
+	}
+
+	// the second transfer started on the busy controller is a program error
+	_ = r.Write16(rpcs2Address, 0)
+	_ = r.Write16(rpcs1Address, rpRead<<1|rpGo)
+	_ = r.Write16(rpcs1Address, rpRead<<1|rpGo)
+	if r.RPCS2&rpPge == 0 || r.RPCS1&rpTre == 0 {
+		t.Errorf("expected program error, RPCS1 %06o, RPCS2 %06o", r.RPCS1, r.RPCS2)
+	}
+	r.Reset()
+}
@@ -0,0 +1,346 @@
+package unibus
+
+import (
+	"fmt"
+	"pdp/interrupts"
+	"pdp/teletype"
+)
+
+// MachineState is a serializable copy of the unibus, the CPU
+// and the state of all attached devices.
+// Disk and tape images are not part of the state. Restored machine expects
+// the same images attached, in the state they were in when the snapshot was taken.
+type MachineState struct {
+	Memory []uint16
+
+	// CPU
+	Registers                                                    [8]uint16
+	State                                                        CpuState
+	KernelStackPointer, SupervisorStackPointer, UserStackPointer uint16
+	PSW                                                          uint16
+	StackLimit                                                   uint16
+
+	MMU            MMUState
+	FPP            *FPPState
+	InterruptQueue interrupts.InterruptQueue
+
+	// devices
+	Clock    KW11State
+	Teletype teletype.State
+	RK       *RKState
+	RL       *RLState
+	RP       *RPState
+	TM       *TMState
+}
+
+// MMUState - MMU status and page registers.
+// SR3 is used only by the 22 bit MMU.
+type MMUState struct {
+	SR0, SR1, SR2, SR3 uint16
+	Pages              []PageRegisters
+}
+
+// FPPState - floating point accumulators and status, nil without the FP11
+type FPPState struct {
+	AC            [6][4]uint16
+	FPS, FEC, FEA uint16
+}
+
+// PageRegisters - single MMU page
+type PageRegisters struct {
+	PAR, PDR uint16
+}
+
+// KW11State - line clock registers
+type KW11State struct {
+	LKS     uint16
+	Counter uint16
+}
+
+// RKState - RK11 registers, selected drive and the head position
+type RKState struct {
+	RKDS, RKER, RKCS, DKDA uint16
+	RKWC                   int
+	RKBA                   uint32
+
+	Drive, Sector, Surface, Cylinder int
+	Running                          bool
+
+	// seek in progress
+	Seeking   bool
+	SeekDrive int
+
+	// write lock set by the guest, per unit
+	Locked [8]bool
+}
+
+// RLState - RL11 registers and the head position of every drive
+type RLState struct {
+	RLCS, RLDA, RLMP uint16
+	RLBA             uint32
+	MP               [2]uint16
+	Running          bool
+
+	Cylinder, Head, Sector [4]int
+	WriteGateError         [4]bool
+}
+
+// RPState - RH11 registers and the massbus registers of every drive
+type RPState struct {
+	RPCS1, RPWC, RPCS2, RPDB uint16
+	RPBA                     uint32
+	Running                  bool
+	Transfer                 int
+
+	Drives [8]RPDriveState
+}
+
+// RPDriveState - massbus registers and the head position of the RP drive
+type RPDriveState struct {
+	DA, DC, OF, CC, ER1, ER2, ER3 uint16
+	VolumeValid, Attention, PIP   bool
+	Pending                       uint16
+	LookAhead                     int
+}
+
+// TMState - TM11 registers, and the tape position of every drive
+type TMState struct {
+	MTS, MTC, MTBRC, MTCMA, MTD uint16
+	Running                     bool
+
+	Position  [8]int64
+	Rewinding [8]bool
+}
+
+// SaveState returns the copy of the machine state
+func (u *Unibus) SaveState() *MachineState {
+	s := &MachineState{
+		Memory:                 append([]uint16(nil), u.Memory...),
+		Registers:              u.PdpCPU.Registers,
+		State:                  u.PdpCPU.State,
+		KernelStackPointer:     u.PdpCPU.KernelStackPointer,
+		SupervisorStackPointer: u.PdpCPU.SupervisorStackPointer,
+		UserStackPointer:       u.PdpCPU.UserStackPointer,
+		PSW:                    u.Psw.Get(),
+		StackLimit:             u.PdpCPU.StackLimit,
+		MMU:                    u.Mmu.SaveState(),
+		InterruptQueue:         u.InterruptQueue,
+		Clock:                  KW11State{LKS: u.Clock.LKS, Counter: u.Clock.counter},
+		Teletype:               u.TermEmulator.State(),
+	}
+	if p := u.PdpCPU.fpp; p != nil {
+		s.FPP = &FPPState{FPS: p.FPS, FEC: p.FEC, FEA: p.FEA}
+		for i, ac := range p.AC {
+			s.FPP.AC[i] = ac
+		}
+	}
+	if u.Rk01 != nil {
+		s.RK = u.Rk01.saveState()
+	}
+	if u.Rl != nil {
+		s.RL = u.Rl.saveState()
+	}
+	if u.Rh != nil {
+		s.RP = u.Rh.saveState()
+	}
+	if u.Tm != nil {
+		s.TM = u.Tm.saveState()
+	}
+	return s
+}
+
+// RestoreState sets the machine to the saved state.
+// The machine configuration has to match the one the state was saved on.
+func (u *Unibus) RestoreState(s *MachineState) error {
+	if len(s.Memory) == 0 || len(s.Memory) > int(u.ioPage>>1) {
+		return fmt.Errorf("invalid memory size %d words", len(s.Memory))
+	}
+	if (s.RK != nil) != (u.Rk01 != nil) {
+		return fmt.Errorf("RK11 controller presence doesn't match the configuration")
+	}
+	if (s.RL != nil) != (u.Rl != nil) {
+		return fmt.Errorf("RL11 controller presence doesn't match the configuration")
+	}
+	if (s.RP != nil) != (u.Rh != nil) {
+		return fmt.Errorf("RH11 controller presence doesn't match the configuration")
+	}
+	if (s.TM != nil) != (u.Tm != nil) {
+		return fmt.Errorf("TM11 controller presence doesn't match the configuration")
+	}
+	if (s.FPP != nil) != (u.PdpCPU.fpp != nil) {
+		return fmt.Errorf("floating point processor presence doesn't match the configuration")
+	}
+	if err := u.Mmu.RestoreState(s.MMU); err != nil {
+		return err
+	}
+
+	u.Memory = append([]uint16(nil), s.Memory...)
+	u.PdpCPU.Registers = s.Registers
+	u.PdpCPU.State = s.State
+	u.PdpCPU.KernelStackPointer = s.KernelStackPointer
+	u.PdpCPU.SupervisorStackPointer = s.SupervisorStackPointer
+	u.PdpCPU.UserStackPointer = s.UserStackPointer
+	u.Psw.Set(s.PSW)
+	u.PdpCPU.StackLimit = s.StackLimit
+	u.InterruptQueue = s.InterruptQueue
+	u.Clock.LKS = s.Clock.LKS
+	u.Clock.counter = s.Clock.Counter
+	u.TermEmulator.SetState(s.Teletype)
+	if s.FPP != nil {
+		p := u.PdpCPU.fpp
+		p.FPS, p.FEC, p.FEA = s.FPP.FPS, s.FPP.FEC, s.FPP.FEA
+		for i, ac := range s.FPP.AC {
+			p.AC[i] = ac
+		}
+	}
+	if s.RK != nil {
+		u.Rk01.restoreState(s.RK)
+	}
+	if s.RL != nil {
+		u.Rl.restoreState(s.RL)
+	}
+	if s.RP != nil {
+		u.Rh.restoreState(s.RP)
+	}
+	if s.TM != nil {
+		u.Tm.restoreState(s.TM)
+	}
+	return nil
+}
+
+func (r *RK11) saveState() *RKState {
+	s := &RKState{
+		RKDS: r.RKDS, RKER: r.RKER, RKCS: r.RKCS, DKDA: r.DKDA,
+		RKWC: r.RKWC, RKBA: r.RKBA,
+		Drive: r.drive, Sector: r.sector, Surface: r.surface, Cylinder: r.cylinder,
+		Running: r.running, Seeking: r.seeking, SeekDrive: r.seekDrive,
+	}
+	for i, unit := range r.unit {
+		s.Locked[i] = unit != nil && unit.locked
+	}
+	return s
+}
+
+func (r *RK11) restoreState(s *RKState) {
+	r.RKDS, r.RKER, r.RKCS, r.DKDA = s.RKDS, s.RKER, s.RKCS, s.DKDA
+	r.RKWC, r.RKBA = s.RKWC, s.RKBA
+	r.drive, r.sector, r.surface, r.cylinder = s.Drive, s.Sector, s.Surface, s.Cylinder
+	r.running = s.Running
+	r.seeking, r.seekDrive = s.Seeking, s.SeekDrive
+	for i, unit := range r.unit {
+		if unit != nil {
+			unit.locked = s.Locked[i]
+		}
+	}
+	r.updateDriveStatus()
+}
+
+func (r *RL11) saveState() *RLState {
+	s := &RLState{RLCS: r.RLCS, RLDA: r.RLDA, RLMP: r.RLMP, RLBA: r.RLBA, MP: r.mp, Running: r.running}
+	for i, d := range r.unit {
+		if d != nil {
+			s.Cylinder[i], s.Head[i], s.Sector[i] = d.cylinder, d.head, d.sector
+			s.WriteGateError[i] = d.wge
+		}
+	}
+	return s
+}
+
+func (r *RL11) restoreState(s *RLState) {
+	r.RLCS, r.RLDA, r.RLMP, r.RLBA, r.mp, r.running = s.RLCS, s.RLDA, s.RLMP, s.RLBA, s.MP, s.Running
+	for i, d := range r.unit {
+		if d != nil {
+			d.cylinder, d.head, d.sector = s.Cylinder[i], s.Head[i], s.Sector[i]
+			d.wge = s.WriteGateError[i]
+		}
+	}
+}
+
+func (r *RH11) saveState() *RPState {
+	s := &RPState{RPCS1: r.RPCS1, RPWC: r.RPWC, RPCS2: r.RPCS2, RPDB: r.RPDB, RPBA: r.RPBA,
+		Running: r.running, Transfer: r.xfer}
+	for i, d := range r.unit {
+		if d != nil {
+			s.Drives[i] = RPDriveState{DA: d.da, DC: d.dc, OF: d.of, CC: d.cc, ER1: d.er1, ER2: d.er2, ER3: d.er3,
+				VolumeValid: d.vv, Attention: d.ata, PIP: d.pip, Pending: d.pending, LookAhead: d.la}
+		}
+	}
+	return s
+}
+
+func (r *RH11) restoreState(s *RPState) {
+	r.RPCS1, r.RPWC, r.RPCS2, r.RPDB, r.RPBA = s.RPCS1, s.RPWC, s.RPCS2, s.RPDB, s.RPBA
+	r.running, r.xfer = s.Running, s.Transfer
+	for i, d := range r.unit {
+		if d != nil {
+			ds := s.Drives[i]
+			d.da, d.dc, d.of, d.cc, d.er1, d.er2, d.er3 = ds.DA, ds.DC, ds.OF, ds.CC, ds.ER1, ds.ER2, ds.ER3
+			d.vv, d.ata, d.pip, d.pending, d.la = ds.VolumeValid, ds.Attention, ds.PIP, ds.Pending, ds.LookAhead
+		}
+	}
+}
+
+func (t *TM11) saveState() *TMState {
+	s := &TMState{MTS: t.MTS, MTC: t.MTC, MTBRC: t.MTBRC, MTCMA: t.MTCMA, MTD: t.MTD, Running: t.running}
+	for i, d := range t.unit {
+		if d != nil {
+			s.Position[i], s.Rewinding[i] = d.pos, d.rewinding
+		}
+	}
+	return s
+}
+
+func (t *TM11) restoreState(s *TMState) {
+	t.MTS, t.MTC, t.MTBRC, t.MTCMA, t.MTD, t.running = s.MTS, s.MTC, s.MTBRC, s.MTCMA, s.MTD, s.Running
+	for i, d := range t.unit {
+		if d != nil {
+			d.pos, d.rewinding = s.Position[i], s.Rewinding[i]
+		}
+	}
+}
+
+// SaveState returns the status registers and all page registers
+func (m *MMU18) SaveState() MMUState {
+	s := MMUState{SR0: m.SR0, SR1: m.SR1, SR2: m.SR2, Pages: make([]PageRegisters, len(m.pages))}
+	for i, p := range m.pages {
+		s.Pages[i] = PageRegisters{PAR: p.par, PDR: p.pdr}
+	}
+	return s
+}
+
+// RestoreState restores the MMU registers saved by SaveState
+func (m *MMU18) RestoreState(s MMUState) error {
+	if len(s.Pages) != len(m.pages) {
+		return fmt.Errorf("MMU state has %d pages, expected %d", len(s.Pages), len(m.pages))
+	}
+	m.SR0, m.SR1, m.SR2 = s.SR0, s.SR1, s.SR2
+	for i, p := range s.Pages {
+		m.pages[i] = page{par: p.PAR, pdr: p.PDR}
+	}
+	return nil
+}
+
+// SaveState returns the status registers and all page registers, ordered by mode, I/D space and page
+func (m *MMU22) SaveState() MMUState {
+	s := MMUState{SR0: m.SR0, SR1: m.SR1, SR2: m.SR2, SR3: m.SR3}
+	for mode := range m.pages {
+		for space := range m.pages[mode] {
+			for _, p := range m.pages[mode][space] {
+				s.Pages = append(s.Pages, PageRegisters{PAR: p.par, PDR: p.pdr})
+			}
+		}
+	}
+	return s
+}
+
+// RestoreState restores the MMU registers saved by SaveState
+func (m *MMU22) RestoreState(s MMUState) error {
+	if len(s.Pages) != 4*2*8 {
+		return fmt.Errorf("MMU state has %d pages, expected %d", len(s.Pages), 4*2*8)
+	}
+	m.SR0, m.SR1, m.SR2, m.SR3 = s.SR0, s.SR1, s.SR2, s.SR3
+	for i, p := range s.Pages {
+		m.pages[i>>4][(i>>3)&1][i&7] = page{par: p.PAR, pdr: p.PDR}
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package unibus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pdp/interrupts"
+)
+
+const (
+	// unibus Addresses:
+	mtsAddress   = 0772520
+	mtcAddress   = 0772522
+	mtbrcAddress = 0772524
+	mtcmaAddress = 0772526
+	mtdAddress   = 0772530
+	mtrdAddress  = 0772532
+
+	// MTS bits
+	mtTur = 1 << 0
+	mtRew = 1 << 1
+	mtWrl = 1 << 2
+	mtBot = 1 << 5
+	mtOnl = 1 << 6
+	mtNxm = 1 << 7
+	mtBte = 1 << 8
+	mtRle = 1 << 9
+	mtEot = 1 << 10
+	mtDlt = 1 << 11
+	mtPae = 1 << 12
+	mtCre = 1 << 13
+	mtEof = 1 << 14
+	mtIlc = 1 << 15
+
+	// MTS errors, any of them sets the error bit in MTC
+	mtErrors = mtIlc | mtEof | mtCre | mtPae | mtDlt | mtEot | mtRle | mtBte | mtNxm
+
+	// MTC bits
+	mtGo  = 1 << 0
+	mtIe  = 1 << 6
+	mtRdy = 1 << 7
+	mtPcl = 1 << 12
+	mtErr = 1 << 15
+
+	// MTC bits written by the guest: density, parity, unit, interrupt enable, address extension and function
+	mtcBits = 067576
+
+	// TM11 functions, MTC bits 1-3
+	mtOffLine      = 0
+	mtRead         = 1
+	mtWrite        = 2
+	mtWriteEOF     = 3
+	mtSpaceForward = 4
+	mtSpaceReverse = 5
+	mtWriteIRG     = 6
+	mtRewind       = 7
+
+	// SIMH tape image: every record is prefixed and followed by its 32 bit little endian length,
+	// and padded to the even length. Zero length is the tape mark, tapeEOM the end of medium.
+	tapeEOM      = 0xFFFFFFFF
+	tapeBadFlag  = 0x80000000
+	tapeLenBytes = 4
+)
+
+// tapeEvent - what the tape drive found moving over the next record
+type tapeEvent int
+
+const (
+	tapeRecord tapeEvent = iota
+	tapeMark
+	tapeBOT
+	tapeEnd
+	tapeBad
+)
+
+// TM11 magnetic tape controller with TU10 drives
+type TM11 struct {
+	// MTS error bits. The drive status bits are taken from the selected drive.
+	MTS   uint16
+	MTC   uint16
+	MTBRC uint16
+	MTCMA uint16
+	MTD   uint16
+
+	// tape units
+	unit [8]*tapeDrive
+
+	// function started, executed in the next step
+	running bool
+
+	unibus *Unibus
+}
+
+// tapeDrive - TU10 drive with the tape image file
+type tapeDrive struct {
+	file     *os.File
+	readOnly bool
+
+	// position in the image file
+	pos int64
+
+	// rewind in progress, completed in the next step
+	rewinding bool
+}
+
+// NewTM returns new TM11 object
+func NewTM(u *Unibus) *TM11 {
+	t := TM11{}
+	t.unibus = u
+	return &t
+}
+
+// Attach opens the tape image file, the tape is at the load point.
+// Records written by the guest go directly to the image file.
+func (t *TM11) Attach(drive int, path string) error {
+	return t.attach(drive, path, false)
+}
+
+// AttachReadOnly attaches the tape image without the write ring: the guest can't write to it.
+func (t *TM11) AttachReadOnly(drive int, path string) error {
+	return t.attach(drive, path, true)
+}
+
+func (t *TM11) attach(drive int, path string, readOnly bool) error {
+	if drive < 0 || drive >= len(t.unit) {
+		return errors.New("tried to mount tape to unit > 7")
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if err := t.Detach(drive); err != nil {
+		file.Close()
+		return err
+	}
+	t.unit[drive] = &tapeDrive{file: file, readOnly: readOnly}
+	return nil
+}
+
+// SetDriveType checks the type of the drive attached to the unit. TM11 supports only TU10.
+func (t *TM11) SetDriveType(drive int, driveType string) error {
+	if driveType != "" && driveType != "tu10" {
+		return fmt.Errorf("unsupported drive type %s, expected tu10", driveType)
+	}
+	return nil
+}
+
+// Detach closes the tape image file
+func (t *TM11) Detach(drive int) error {
+	if drive < 0 || drive >= len(t.unit) {
+		return errors.New("tried to detach tape from unit > 7")
+	}
+	unit := t.unit[drive]
+	if unit == nil {
+		return nil
+	}
+	t.unit[drive] = nil
+	return unit.file.Close()
+}
+
+// DetachAll closes all attached image files
+func (t *TM11) DetachAll() error {
+	var err error
+	for i := range t.unit {
+		if e := t.Detach(i); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Rewind moves the tape on the drive to the load point, i.e. before the bootstrap
+func (t *TM11) Rewind(drive int) error {
+	if drive < 0 || drive >= len(t.unit) || t.unit[drive] == nil {
+		return fmt.Errorf("no tape attached to unit %d", drive)
+	}
+	t.unit[drive].pos = 0
+	t.unit[drive].rewinding = false
+	return nil
+}
+
+// readLength reads the record length at the position
+func (d *tapeDrive) readLength(at int64) (uint32, error) {
+	var buf [tapeLenBytes]byte
+	if _, err := d.file.ReadAt(buf[:], at); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// recordSize returns the size of the record with the lengths around it in the image
+func recordSize(length uint32) int64 {
+	return int64(length+length&1) + 2*tapeLenBytes
+}
+
+// forward moves the tape over the next record, and returns its data if read is set.
+// bad is set for the record marked as bad in the image.
+func (d *tapeDrive) forward(read bool) (data []byte, event tapeEvent, bad bool) {
+	length, err := d.readLength(d.pos)
+	switch {
+	case err == io.EOF || err == nil && length == tapeEOM:
+		return nil, tapeEnd, false
+	case err != nil:
+		return nil, tapeBad, false
+	case length == 0:
+		d.pos += tapeLenBytes
+		return nil, tapeMark, false
+	}
+
+	bad = length&tapeBadFlag != 0
+	length &^= tapeBadFlag
+	if read {
+		data = make([]byte, length)
+		if _, err := d.file.ReadAt(data, d.pos+tapeLenBytes); err != nil {
+			return nil, tapeBad, false
+		}
+	}
+	d.pos += recordSize(length)
+	return data, tapeRecord, bad
+}
+
+// reverse moves the tape back over the previous record
+func (d *tapeDrive) reverse() tapeEvent {
+	if d.pos < tapeLenBytes {
+		d.pos = 0
+		return tapeBOT
+	}
+	length, err := d.readLength(d.pos - tapeLenBytes)
+	switch {
+	case err != nil:
+		return tapeBad
+	case length == 0:
+		d.pos -= tapeLenBytes
+		return tapeMark
+	}
+	size := recordSize(length &^ tapeBadFlag)
+	if size > d.pos {
+		return tapeBad
+	}
+	d.pos -= size
+	return tapeRecord
+}
+
+// write writes the record, or the tape mark for the empty data, at the position.
+// Everything recorded after it is gone.
+func (d *tapeDrive) write(data []byte) error {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	if len(data) > 0 {
+		buf = append(buf, data...)
+		if len(data)&1 != 0 {
+			buf = append(buf, 0)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	}
+	if _, err := d.file.WriteAt(buf, d.pos); err != nil {
+		return err
+	}
+	d.pos += int64(len(buf))
+	return d.file.Truncate(d.pos)
+}
+
+func (t *TM11) Name() string {
+	return "TM11"
+}
+
+// AddressRange - TM11 registers occupy 0772520 - 0772532
+func (t *TM11) AddressRange() (Uint18, Uint18) {
+	return TM11Addr, TM11Addr + 012
+}
+
+// Vector returns TM11 interrupt vector and priority
+func (t *TM11) Vector() (uint16, uint16) {
+	return interrupts.IntTM, 5
+}
+
+// selected returns the drive selected in MTC, or nil if nothing is attached to it
+func (t *TM11) selected() *tapeDrive {
+	return t.unit[(t.MTC>>8)&7]
+}
+
+// status returns MTS: the errors, and the status of the selected drive
+func (t *TM11) status() uint16 {
+	s := t.MTS
+	d := t.selected()
+	if d == nil {
+		return s
+	}
+	s |= mtOnl
+	if d.rewinding {
+		s |= mtRew
+	} else {
+		s |= mtTur
+	}
+	if d.readOnly {
+		s |= mtWrl
+	}
+	if d.pos == 0 {
+		s |= mtBot
+	}
+	return s
+}
+
+// Read16 reads and returns controller register value
+func (t *TM11) Read16(address Uint18) (uint16, error) {
+	switch address {
+	case mtsAddress:
+		return t.status(), nil
+	case mtcAddress:
+		c := t.MTC
+		if t.MTS&mtErrors != 0 {
+			c |= mtErr
+		}
+		return c, nil
+	case mtbrcAddress:
+		return t.MTBRC, nil
+	case mtcmaAddress:
+		return t.MTCMA, nil
+	case mtdAddress:
+		return t.MTD, nil
+	case mtrdAddress:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid TM11 read from %06o", address)
+	}
+}
+
+// Write16 writes to the controller register
+func (t *TM11) Write16(address Uint18, value uint16) error {
+	switch address {
+	case mtsAddress, mtrdAddress:
+		break
+	case mtcAddress:
+		if value&mtPcl != 0 {
+			t.Reset()
+			return nil
+		}
+		ie := t.MTC & mtIe
+		t.MTC = t.MTC&^mtcBits | value&mtcBits
+		if value&mtGo != 0 {
+			t.MTS &^= mtErrors
+			t.MTC &^= mtRdy
+			t.running = true
+		} else if ie == 0 && t.MTC&(mtIe|mtRdy) == mtIe|mtRdy {
+			t.interrupt()
+		}
+	case mtbrcAddress:
+		t.MTBRC = value
+	case mtcmaAddress:
+		t.MTCMA = value &^ 1
+	case mtdAddress:
+		t.MTD = value
+	default:
+		return fmt.Errorf("invalid TM11 write to %06o", address)
+	}
+	return nil
+}
+
+// Read8 - byte access to the TM11 registers
+func (t *TM11) Read8(address Uint18) (uint16, error) {
+	return readByteFromWord(t, address)
+}
+
+// Write8 - byte access to the TM11 registers
+func (t *TM11) Write8(address Uint18, value uint16) error {
+	return writeByteToWord(t, address, value)
+}
+
+// Reset sets the controller to it's default values. Tapes stay where they are.
+func (t *TM11) Reset() {
+	t.MTS = 0
+	t.MTC = mtRdy
+	t.MTBRC = 0
+	t.MTCMA = 0
+	t.MTD = 0
+	t.running = false
+}
+
+// interrupt sends the interrupt, if enabled in MTC
+func (t *TM11) interrupt() {
+	if t.MTC&mtIe != 0 {
+		vector, priority := t.Vector()
+		t.unibus.SendInterrupt(priority, vector)
+	}
+}
+
+// mtDone ends the function with the status bits set in MTS
+func (t *TM11) mtDone(status uint16) {
+	t.running = false
+	t.MTS |= status
+	t.MTC |= mtRdy
+	t.interrupt()
+}
+
+// busAddress returns the 18 bit memory address from MTCMA and the address extension bits of MTC
+func (t *TM11) busAddress() Uint18 {
+	return Uint18(t.MTC&060)<<12 | Uint18(t.MTCMA)
+}
+
+// advance increments the memory address, with the carry to the address extension bits,
+// and the byte record counter
+func (t *TM11) advance() {
+	addr := (t.busAddress() + 1) & 0777777
+	t.MTCMA = uint16(addr)
+	t.MTC = t.MTC&^060 | uint16(addr>>12)&060
+	t.MTBRC++
+}
+
+// Step executes the function started by the guest, and completes the rewind.
+// The whole function is done in a single step.
+func (t *TM11) Step() {
+	for _, d := range t.unit {
+		if d != nil && d.rewinding {
+			d.rewinding = false
+		}
+	}
+	if !t.running {
+		return
+	}
+
+	d := t.selected()
+	if d == nil {
+		t.mtDone(mtIlc)
+		return
+	}
+
+	switch (t.MTC >> 1) & 7 {
+	case mtRead:
+		t.mtDone(t.read(d))
+	case mtWrite, mtWriteIRG:
+		t.mtDone(t.write(d))
+	case mtWriteEOF:
+		if d.readOnly {
+			t.mtDone(mtIlc)
+			return
+		}
+		if err := d.write(nil); err != nil {
+			t.unibus.log.Printf("TM: can't write tape mark to the image: %v\n", err)
+			t.mtDone(mtBte)
+			return
+		}
+		t.mtDone(0)
+	case mtSpaceForward, mtSpaceReverse:
+		t.mtDone(t.space(d, (t.MTC>>1)&7 == mtSpaceForward))
+	case mtRewind, mtOffLine:
+		// off-line rewinds the tape, the image stays attached.
+		// The controller is ready right away, the drive when the rewind is done.
+		d.pos = 0
+		d.rewinding = true
+		t.mtDone(0)
+	}
+}
+
+// eventStatus returns the MTS bits for the event ending the function
+func eventStatus(event tapeEvent) uint16 {
+	switch event {
+	case tapeMark:
+		return mtEof
+	case tapeEnd, tapeBad:
+		// reading beyond the recorded data is the bad tape error
+		return mtBte
+	}
+	return 0
+}
+
+// read reads the next record to the memory. Record longer than the byte count is the record length error.
+func (t *TM11) read(d *tapeDrive) uint16 {
+	data, event, bad := d.forward(true)
+	if event != tapeRecord {
+		return eventStatus(event)
+	}
+
+	var status uint16
+	count := 0200000 - int(t.MTBRC)
+	if len(data) > count {
+		status |= mtRle
+		data = data[:count]
+	}
+	if bad {
+		status |= mtPae
+	}
+	for _, b := range data {
+		addr := t.busAddress()
+		if addr >= t.unibus.memoryTop() {
+			return status | mtNxm
+		}
+		t.unibus.WriteIOByte(addr, uint16(b))
+		t.advance()
+	}
+	return status
+}
+
+// write writes the record of MTBRC bytes from the memory
+func (t *TM11) write(d *tapeDrive) uint16 {
+	if d.readOnly {
+		return mtIlc
+	}
+
+	data := make([]byte, 0200000-int(t.MTBRC))
+	for i := range data {
+		addr := t.busAddress()
+		if addr >= t.unibus.memoryTop() {
+			return mtNxm
+		}
+		data[i] = byte(t.unibus.ReadIOByte(addr))
+		t.advance()
+	}
+	if err := d.write(data); err != nil {
+		t.unibus.log.Printf("TM: can't write record to the image: %v\n", err)
+		return mtBte
+	}
+	return 0
+}
+
+// space moves the tape over MTBRC records. The tape mark ends the function, after the tape passed it.
+func (t *TM11) space(d *tapeDrive, forward bool) uint16 {
+	for {
+		var event tapeEvent
+		if forward {
+			_, event, _ = d.forward(false)
+		} else {
+			event = d.reverse()
+		}
+		switch event {
+		case tapeRecord, tapeMark:
+			t.MTBRC++
+		case tapeBOT:
+			return 0
+		}
+		if event != tapeRecord {
+			return eventStatus(event)
+		}
+		if t.MTBRC == 0 {
+			return 0
+		}
+	}
+}
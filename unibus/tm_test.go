@@ -0,0 +1,155 @@
+package unibus
+
+import (
+	"bytes"
+	"os"
+	"pdp/interrupts"
+	"pdp/testutil"
+	"testing"
+)
+
+// mtFunction starts the function on the drive 0 and executes it
+func mtFunction(tm *TM11, function, count uint16) {
+	_ = tm.Write16(mtbrcAddress, count)
+	_ = tm.Write16(mtcmaAddress, 01000)
+	_ = tm.Write16(mtcAddress, tm.MTC&mtIe|function<<1|mtGo)
+	tm.Step()
+}
+
+func TestTM11_WriteRead(t *testing.T) {
+	path := newImage(t, "mt.tap", nil)
+	tm := NewTM(u)
+	if err := tm.Attach(0, path); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer tm.Detach(0)
+	tm.Reset()
+	u.InterruptQueue = interrupts.InterruptQueue{}
+
+	for i := 0; i < 4; i++ {
+		u.Memory[(01000>>1)+i] = uint16(i*2+1)<<8 | uint16(i*2)
+	}
+	_ = tm.Write16(mtcAddress, mtIe|mtRdy)
+	u.InterruptQueue = interrupts.InterruptQueue{}
+	mtFunction(tm, mtWrite, 0177771)
+	mtFunction(tm, mtWriteEOF, 0)
+	mtFunction(tm, mtWrite, 0177776)
+
+	if tm.MTS&mtErrors != 0 || tm.MTC&mtRdy == 0 || tm.MTCMA != 01002 || tm.MTBRC != 0 {
+		t.Errorf("unexpected registers after write: MTS %06o, MTC %06o, MTCMA %06o, MTBRC %06o",
+			tm.MTS, tm.MTC, tm.MTCMA, tm.MTBRC)
+	}
+	if u.InterruptQueue[0].Vector != interrupts.IntTM {
+		t.Errorf("expected TM11 interrupt")
+	}
+	want := testutil.TapeImage([]byte{0, 1, 2, 3, 4, 5, 6}, nil, []byte{0, 1})
+	if buf, _ := os.ReadFile(path); !bytes.Equal(buf, want) {
+		t.Errorf("expected tape image %v, got %v", want, buf)
+	}
+
+	// rewind, and read the records back
+	mtFunction(tm, mtRewind, 0)
+	if mts, _ := tm.Read16(mtsAddress); mts&(mtRew|mtTur|mtBot) != mtRew|mtBot {
+		t.Errorf("expected rewind in progress, MTS %06o", mts)
+	}
+	tm.Step()
+	if mts, _ := tm.Read16(mtsAddress); mts&(mtRew|mtTur|mtBot|mtOnl) != mtTur|mtBot|mtOnl {
+		t.Errorf("expected drive ready at the load point, MTS %06o", mts)
+	}
+
+	for i := 0; i < 4; i++ {
+		u.Memory[(01000>>1)+i] = 0
+	}
+	mtFunction(tm, mtRead, 0177770)
+	if tm.MTS&mtErrors != 0 || tm.MTBRC != 0177777 || tm.MTCMA != 01007 || u.Memory[(01000>>1)+3] != 6 {
+		t.Errorf("unexpected read: MTS %06o, MTBRC %06o, MTCMA %06o, last word %06o",
+			tm.MTS, tm.MTBRC, tm.MTCMA, u.Memory[(01000>>1)+3])
+	}
+	mtFunction(tm, mtRead, 0177770)
+	if c, _ := tm.Read16(mtcAddress); tm.MTS&mtErrors != mtEof || c&mtErr == 0 {
+		t.Errorf("expected end of file, MTS %06o, MTC %06o", tm.MTS, c)
+	}
+	mtFunction(tm, mtRead, 0177777)
+	if tm.MTS&mtErrors != mtRle || tm.MTBRC != 0 {
+		t.Errorf("expected record length error, MTS %06o, MTBRC %06o", tm.MTS, tm.MTBRC)
+	}
+	mtFunction(tm, mtRead, 0177770)
+	if tm.MTS&mtErrors != mtBte {
+		t.Errorf("expected bad tape at the end of the recorded data, MTS %06o", tm.MTS)
+	}
+	u.InterruptQueue = interrupts.InterruptQueue{}
+}
+
+func TestTM11_Space(t *testing.T) {
+	rec := []byte{1, 2, 3, 4}
+	tm := NewTM(u)
+	if err := tm.Attach(0, newImage(t, "mt.tap", testutil.TapeImage(rec, rec, rec, nil, rec))); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	defer tm.Detach(0)
+	tm.Reset()
+
+	tests := []struct {
+		name     string
+		function uint16
+		count    uint16
+		mts      uint16
+		mtbrc    uint16
+		pos      int64
+	}{
+		{"forward 2 records", mtSpaceForward, 0177776, 0, 0, 24},
+		{"forward up to the tape mark", mtSpaceForward, 0177770, mtEof, 0177772, 40},
+		{"forward over the last record", mtSpaceForward, 0177776, mtBte, 0177777, 52},
+		{"reverse over the last record", mtSpaceReverse, 0177777, 0, 0, 40},
+		{"reverse over the tape mark", mtSpaceReverse, 0177770, mtEof, 0177771, 36},
+		{"reverse to the load point", mtSpaceReverse, 0177770, 0, 0177773, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mtFunction(tm, tt.function, tt.count)
+			if tm.MTS&mtErrors != tt.mts || tm.MTBRC != tt.mtbrc || tm.unit[0].pos != tt.pos {
+				t.Errorf("expected MTS %06o, MTBRC %06o at %d, got MTS %06o, MTBRC %06o at %d",
+					tt.mts, tt.mtbrc, tt.pos, tm.MTS, tm.MTBRC, tm.unit[0].pos)
+			}
+		})
+	}
+}
+
+func TestTM11_Errors(t *testing.T) {
+	image := testutil.TapeImage([]byte{1, 2})
+	path := newImage(t, "mt.tap", image)
+	tm := NewTM(u)
+	if err := tm.AttachReadOnly(0, path); err != nil {
+		t.Fatalf("AttachReadOnly() error = %v", err)
+	}
+	defer tm.Detach(0)
+
+	tests := []struct {
+		name     string
+		function uint16
+		mtc      uint16
+		mts      uint16
+	}{
+		{"missing drive", mtRead, 1 << 8, mtIlc},
+		{"write to the write locked tape", mtWrite, 0, mtIlc},
+		{"tape mark on the write locked tape", mtWriteEOF, 0, mtIlc},
+		{"non existent memory", mtRead, 060, mtNxm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm.Reset()
+			_ = tm.Rewind(0)
+			_ = tm.Write16(mtbrcAddress, 0177776)
+			_ = tm.Write16(mtcmaAddress, 0177776)
+			_ = tm.Write16(mtcAddress, tt.mtc|tt.function<<1|mtGo)
+			tm.Step()
+
+			if tm.MTS&mtErrors != tt.mts || tm.MTC&mtRdy == 0 {
+				t.Errorf("expected MTS errors %06o, got MTS %06o, MTC %06o", tt.mts, tm.MTS, tm.MTC)
+			}
+		})
+	}
+	if buf, _ := os.ReadFile(path); !bytes.Equal(buf, image) {
+		t.Errorf("read only tape image has been modified")
+	}
+}
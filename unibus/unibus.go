@@ -13,23 +13,33 @@ import (
 
 // Unibus address mappings for attached devices.
 const (
-	LKSAddr     = 0777546
-	ConsoleAddr = 0777560
-	RK11Addr    = 0777400
-	PSWAddr     = 0777776
-	PSWVirtAddr = 0177776
-	SR0Addr     = 0777572
-	SR2Addr     = 0777576
-	RegAddr     = 0777700
-	MEMSIZE     = 0760000 // useful memory. everything above 248K is unibus reserved
+	LKSAddr             = 0777546
+	ConsoleAddr         = 0777560
+	RK11Addr            = 0777400
+	RL11Addr            = 0774400
+	RH11Addr            = 0776700
+	TM11Addr            = 0772520
+	PSWAddr             = 0777776
+	PSWVirtAddr         = 0177776
+	SR0Addr             = 0777572
+	SR1Addr             = 0777574
+	SR2Addr             = 0777576
+	SR3Addr             = 0772516
+	SwitchRegAddr       = 0777570
+	StackLimitAddr      = 0777774
+	RegAddr             = 0777700
+	KernelPagesAddr     = 0772300
+	SupervisorPagesAddr = 0772200
+	UserPagesAddr       = 0777600
+	MEMSIZE             = 0760000 // useful memory. everything above 248K is unibus reserved
 )
 
 // Unibus definition
 type Unibus struct {
-	Memory [MEMSIZE >> 1]uint16
+	Memory []uint16
 
-	// LKS - KW11-L Clock status
-	LKS uint16
+	// KW11-L line clock
+	Clock *KW11
 
 	// Memory management Unit
 	Mmu MMU
@@ -44,8 +54,8 @@ type Unibus struct {
 	// InterruptQueue queue to keep incoming interrupts before processing them
 	InterruptQueue interrupts.InterruptQueue
 
-	// ActiveTrap keeps the active trap in case the trap is being throw
-	// or nil otherwise
+	// ActiveTrap keeps the trap raised by the current instruction,
+	// or the zero value otherwise (vector 0 is never a trap vector)
 	ActiveTrap interrupts.Trap
 
 	Psw *psw.PSW
@@ -53,9 +63,23 @@ type Unibus struct {
 	PdpCPU *CPU
 
 	Rk01 *RK11
+	Rl   *RL11
+	Rh   *RH11
+	Tm   *TM11
 
 	InterruptStack InterruptStack
 
+	// attached devices and the I/O page address map
+	devices  []Device
+	steppers []stepper
+	ioMap    [ioPageWords]Device
+
+	// physical address of the I/O page: 0760000 on 18 bit, 017760000 on 22 bit machine
+	ioPage Uint18
+
+	// Model - CPU model profile
+	Model Model
+
 	log *log.Logger
 }
 
@@ -66,6 +90,9 @@ func New(psw *psw.PSW, gui *gocui.Gui, controlConsole *console.Console, debugMod
 	unibus.controlConsole = *controlConsole
 	unibus.Psw = psw
 	unibus.log = log
+	unibus.Memory = make([]uint16, MEMSIZE>>1)
+	unibus.ioPage = IOPageAddr
+	unibus.Model = Models[defaultModel]
 
 	// initialize attached devices:
 	unibus.Mmu = NewMMU18(&unibus)
@@ -77,10 +104,182 @@ func New(psw *psw.PSW, gui *gocui.Gui, controlConsole *console.Console, debugMod
 	if err := unibus.TermEmulator.Run(); err != nil {
 		panic("Can't initialize terminal emulator")
 	}
-	unibus.Rk01 = NewRK(&unibus)
+	unibus.Clock = NewKW11(&unibus)
+
+	if err := unibus.registerDevices(); err != nil {
+		panic(fmt.Sprintf("Can't attach devices to unibus: %v", err))
+	}
 	return &unibus
 }
 
+// registerDevices maps the processor registers and the standard peripherals in the I/O page
+func (u *Unibus) registerDevices() error {
+	devices := []Device{
+		// processor status word:
+		&ioRegisters{
+			name:  "PSW",
+			begin: PSWAddr, end: PSWAddr,
+			read: func(_ Uint18) (uint16, error) { return u.Psw.Get(), nil },
+			// T bit can't be set by writing the PSW, only by RTI, RTT and the trap vectors
+			write: func(_ Uint18, data uint16) error {
+				u.PdpCPU.SwitchMode(data >> 14)
+				u.Psw.Set(data&^020 | u.Psw.Get()&020)
+				return nil
+			}},
+		// general purpose registers:
+		&ioRegisters{
+			name:  "CPU registers",
+			begin: RegAddr, end: RegAddr + 016,
+			read: func(addr Uint18) (uint16, error) { return u.getRegisterValue(addr), nil },
+			write: func(addr Uint18, data uint16) error {
+				u.setRegisterValue(uint32(addr), data)
+				return nil
+			}},
+		// physical front console switch register. Magic number that seems to do the job:
+		&ioRegisters{
+			name:  "switch register",
+			begin: SwitchRegAddr, end: SwitchRegAddr,
+			read: func(_ Uint18) (uint16, error) { return 0173030, nil }},
+		// memory management status registers:
+		&ioRegisters{
+			name:  "MMU SR0",
+			begin: SR0Addr, end: SR0Addr,
+			read: func(_ Uint18) (uint16, error) { return u.Mmu.GetSR0(), nil },
+			write: func(_ Uint18, data uint16) error {
+				u.Mmu.SetSR0(data)
+				return nil
+			}},
+		// SR1 is read only
+		&ioRegisters{
+			name:  "MMU SR1",
+			begin: SR1Addr, end: SR1Addr,
+			read: func(_ Uint18) (uint16, error) { return u.Mmu.GetSR1(), nil }},
+		&ioRegisters{
+			name:  "MMU SR2",
+			begin: SR2Addr, end: SR2Addr,
+			read: func(_ Uint18) (uint16, error) { return u.Mmu.GetSR2(), nil },
+			write: func(_ Uint18, data uint16) error {
+				u.Mmu.SetSR2(data)
+				return nil
+			}},
+		// kernel and user page registers:
+		u.mmuPages("kernel pages", KernelPagesAddr, KernelPagesAddr+077),
+		u.mmuPages("user pages", UserPagesAddr, UserPagesAddr+077),
+		u.Clock,
+		&consoleDevice{tty: u.TermEmulator},
+	}
+
+	for _, d := range devices {
+		if err := u.RegisterDevice(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mmuPages maps a block of MMU page registers
+func (u *Unibus) mmuPages(name string, begin, end Uint18) Device {
+	return &ioRegisters{
+		name:  name,
+		begin: begin, end: end,
+		read: func(addr Uint18) (uint16, error) { return u.Mmu.Read16(addr), nil },
+		write: func(addr Uint18, data uint16) error {
+			u.Mmu.Write16(addr, data)
+			return nil
+		}}
+}
+
+// InstallMMU22 replaces the 18 bit MMU of the 11/40 with the 22 bit MMU of the 11/70.
+// The I/O page moves to the top of the 22 bit physical address space,
+// and the supervisor page registers and SR3 are mapped.
+func (u *Unibus) InstallMMU22() error {
+	return u.installMMU22(true)
+}
+
+// installMMU22 installs the MMU with the supervisor mode and I/D spaces.
+// Without addr22 the MMU is the one of the 11/45, and the physical address space stays 18 bit wide.
+func (u *Unibus) installMMU22(addr22 bool) error {
+	m := NewMMU22(u)
+	m.addr22 = addr22
+	u.Mmu = m
+	u.PdpCPU.mmunit = m
+	if addr22 {
+		u.ioPage = IOPage22Addr
+	}
+
+	devices := []Device{
+		&ioRegisters{
+			name:  "MMU SR3",
+			begin: SR3Addr, end: SR3Addr,
+			read: func(_ Uint18) (uint16, error) { return m.GetSR3(), nil },
+			write: func(_ Uint18, data uint16) error {
+				m.SetSR3(data)
+				return nil
+			}},
+		u.mmuPages("supervisor pages", SupervisorPagesAddr, SupervisorPagesAddr+077),
+	}
+	for _, d := range devices {
+		if err := u.RegisterDevice(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installStackLimit maps the stack limit register. Only the upper byte is writable.
+func (u *Unibus) installStackLimit() error {
+	return u.RegisterDevice(&ioRegisters{
+		name:  "stack limit",
+		begin: StackLimitAddr, end: StackLimitAddr,
+		read: func(_ Uint18) (uint16, error) { return u.PdpCPU.StackLimit, nil },
+		write: func(_ Uint18, data uint16) error {
+			u.PdpCPU.StackLimit = data & 0177400
+			return nil
+		}})
+}
+
+// SetMemorySize sets the size of installed memory in bytes.
+// Accessing addresses above the installed memory ends with the bus error.
+func (u *Unibus) SetMemorySize(size int) error {
+	limit := int(u.ioPage)
+	if u.Model.AddressBits == 16 {
+		// without the MMU, the I/O page takes the top 8K of the 16 bit address space
+		limit = 0160000
+	}
+	if size <= 0 || size > limit || size%2 != 0 {
+		return fmt.Errorf("invalid memory size %d, it has to be an even number up to %d bytes", size, limit)
+	}
+	u.Memory = make([]uint16, size>>1)
+	return nil
+}
+
+// memoryTop returns the first physical address above the installed memory
+func (u *Unibus) memoryTop() Uint18 {
+	return Uint18(len(u.Memory) << 1)
+}
+
+// Trap raises the trap. The CPU aborts the instruction in progress, all following bus accesses
+// of the instruction are ignored, and the system delivers the trap before the next instruction.
+// Only the first trap of the instruction counts.
+func (u *Unibus) Trap(t interrupts.Trap) {
+	if u.ActiveTrap.Vector == 0 {
+		u.ActiveTrap = t
+		u.PdpCPU.start.abortPC = u.PdpCPU.Registers[7]
+	}
+}
+
+// TrapPending returns true if the trap was raised and not delivered yet
+func (u *Unibus) TrapPending() bool {
+	return u.ActiveTrap.Vector != 0
+}
+
+// TakeTrap returns and clears the pending trap
+func (u *Unibus) TakeTrap() (interrupts.Trap, bool) {
+	t := u.ActiveTrap
+	u.ActiveTrap = interrupts.Trap{}
+	return t, t.Vector != 0
+}
+
 // SendInterrupt : save incoming interrupt in interrupt table
 func (u *Unibus) SendInterrupt(priority uint16, vector uint16) {
 	u.InterruptQueue.SendInterrupt(priority, vector)
@@ -95,92 +294,114 @@ func (u *Unibus) setRegisterValue(addr uint32, data uint16) {
 	u.PdpCPU.Registers[addr&07] = data
 }
 
-// ReadIO reads from unibus devices.
+// ReadIO reads from the memory or from the unibus devices.
+// Failed read raises the bus error trap and returns 0.
 func (u *Unibus) ReadIO(physicalAddress Uint18) uint16 {
-	switch {
-	case physicalAddress&1 == 1:
-		panic(interrupts.Trap{
-			Vector: interrupts.IntBUS,
-			Msg:    fmt.Sprintf("Read from the odd address %06o", physicalAddress)})
-	case physicalAddress < MEMSIZE:
+	if u.TrapPending() {
+		return 0
+	}
+	if physicalAddress&1 == 1 {
+		u.busError("Read from the odd address %06o", physicalAddress)
+		return 0
+	}
+	if physicalAddress < u.memoryTop() {
 		return u.Memory[physicalAddress>>1]
-	case physicalAddress == PSWAddr:
-		return u.Psw.Get()
-	case physicalAddress&RegAddr == RegAddr:
-		return u.getRegisterValue(physicalAddress)
-	// physical front console. Magic number that seems to do the job:
-	case physicalAddress == 0777570:
-		return 0173030
-	case physicalAddress == LKSAddr:
-		return u.LKS
-	case physicalAddress&0777770 == ConsoleAddr:
-		return u.TermEmulator.ReadTerm(uint32(physicalAddress))
-	case physicalAddress == SR0Addr:
-		return u.Mmu.GetSR0()
-	case physicalAddress == SR2Addr:
-		return u.Mmu.GetSR2()
-	case physicalAddress&0777760 == RK11Addr:
-		v := u.Rk01.read(physicalAddress)
-		return v
-	case (physicalAddress&0777600 == 0772200) || (physicalAddress&0777600 == 0777600):
-		return u.Mmu.Read16(physicalAddress)
-	default:
-		panic(interrupts.Trap{
-			Vector: interrupts.IntBUS,
-			Msg:    fmt.Sprintf("Read from invalid address %06o", physicalAddress)})
 	}
+
+	d, addr := u.device(physicalAddress)
+	if d == nil {
+		u.busError("Read from invalid address %06o", physicalAddress)
+		return 0
+	}
+	val, err := d.Read16(addr)
+	if err != nil {
+		u.busError("%v", err)
+		return 0
+	}
+	return val
 }
 
+// ReadIOByte reads a single byte from the memory or from the unibus device.
 func (u *Unibus) ReadIOByte(physicalAddress Uint18) uint16 {
-	val := u.ReadIO(physicalAddress & ^Uint18(1))
-	if physicalAddress&1 != 0 {
-		return val >> 8
+	if u.TrapPending() {
+		return 0
+	}
+	if physicalAddress < u.memoryTop() {
+		val := u.Memory[physicalAddress>>1]
+		if physicalAddress&1 != 0 {
+			return val >> 8
+		}
+		return val & 0xFF
 	}
-	return val & 0xFF
+
+	d, addr := u.device(physicalAddress)
+	if d == nil {
+		u.busError("Read from invalid address %06o", physicalAddress)
+		return 0
+	}
+	val, err := d.Read8(addr)
+	if err != nil {
+		u.busError("%v", err)
+		return 0
+	}
+	return val
 }
 
-// WriteIO writes to the unibus connected device
+// WriteIO writes to the memory or to the unibus connected device
 func (u *Unibus) WriteIO(physicalAddress Uint18, data uint16) {
-	switch {
-	case physicalAddress&1 == 1:
-		panic(interrupts.Trap{
-			Vector: interrupts.IntBUS,
-			Msg:    fmt.Sprintf("Write the odd address %06o", physicalAddress)})
-	case physicalAddress < MEMSIZE:
+	if u.TrapPending() {
+		return
+	}
+	if physicalAddress&1 == 1 {
+		u.busError("Write the odd address %06o", physicalAddress)
+		return
+	}
+	if physicalAddress < u.memoryTop() {
 		u.Memory[physicalAddress>>1] = data
-	case physicalAddress == PSWAddr:
-		u.PdpCPU.SwitchMode(data >> 14)
-		u.Psw.Set(data)
-	case physicalAddress&RegAddr == RegAddr:
-		u.setRegisterValue(uint32(physicalAddress), data)
-	case physicalAddress == LKSAddr:
-		u.LKS = data
-	case physicalAddress&0777770 == ConsoleAddr:
-		_ = u.TermEmulator.WriteTerm(uint32(physicalAddress), data)
-	case physicalAddress == SR0Addr:
-		u.Mmu.SetSR0(data)
-	case physicalAddress == SR2Addr:
-		u.Mmu.SetSR2(data)
-	case physicalAddress&0777760 == RK11Addr:
-		u.Rk01.write(uint32(physicalAddress), data)
-	case (physicalAddress&0777600 == 0772200) || (physicalAddress&0777600 == 0777600):
-		u.Mmu.Write16(physicalAddress, data)
-	default:
-		panic(interrupts.Trap{
-			Vector: interrupts.IntBUS,
-			Msg:    fmt.Sprintf("Write to invalid address %06o", physicalAddress)})
+		return
+	}
+
+	d, addr := u.device(physicalAddress)
+	if d == nil {
+		u.busError("Write to invalid address %06o", physicalAddress)
+		return
+	}
+	if err := d.Write16(addr, data); err != nil {
+		u.busError("%v", err)
+		return
 	}
 }
 
+// WriteIOByte writes a single byte to the memory or to the unibus device.
 func (u *Unibus) WriteIOByte(physicalAddress Uint18, data uint16) {
-	memoryWordContent := u.ReadIO(physicalAddress & ^Uint18(1))
+	if u.TrapPending() {
+		return
+	}
+	if physicalAddress < u.memoryTop() {
+		memoryWordContent := u.Memory[physicalAddress>>1]
+
+		// modify the correct byte
+		if physicalAddress&1 == 0 {
+			memoryWordContent = (memoryWordContent & 0xff00) | (data & 0xff)
+		} else {
+			memoryWordContent = (memoryWordContent & 0xff) | (data << 8)
+		}
+		u.Memory[physicalAddress>>1] = memoryWordContent
+		return
+	}
 
-	// modify the correct byte
-	if physicalAddress&1 == 0 {
-		memoryWordContent = (memoryWordContent & 0xff00) | data
-	} else {
-		memoryWordContent = (memoryWordContent & 0xff) | (data << 8)
+	d, addr := u.device(physicalAddress)
+	if d == nil {
+		u.busError("Write to invalid address %06o", physicalAddress)
+		return
+	}
+	if err := d.Write8(addr, data); err != nil {
+		u.busError("%v", err)
+		return
 	}
+}
 
-	u.WriteIO(physicalAddress & ^Uint18(1), memoryWordContent)
+// busError raises the bus error trap, i.e. on the odd address or the bus time-out
+func (u *Unibus) busError(format string, a ...any) {
+	u.Trap(interrupts.Trap{Vector: interrupts.IntBUS, Msg: fmt.Sprintf(format, a...)})
 }
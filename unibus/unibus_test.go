@@ -41,6 +41,9 @@ func TestUnibus_PSWStatus(t *testing.T) {
 		{"user=>user", 0140000, UserMode, UserMode},
 		{"kernel=>user", 0, KernelMode, UserMode},
 		{"user=>kernel", 0140000, UserMode, KernelMode},
+		{"kernel=>supervisor", 0, KernelMode, SupervisorMode},
+		{"supervisor=>user", 0040000, SupervisorMode, UserMode},
+		{"user=>supervisor", 0140000, UserMode, SupervisorMode},
 	}
 
 	for _, tt := range tests {
@@ -65,3 +68,32 @@ func TestUnibus_PSWStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestUnibus_RegisterDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		begin, end Uint18
+		wantErr    bool
+	}{
+		{"free address range", 0770000, 0770006, false},
+		{"overlapping with the console", 0777550, 0777562, true},
+		{"below the I/O page", 0700000, 0700002, true},
+		{"odd address", 0770011, 0770012, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &ioRegisters{
+				name:  "test",
+				begin: tt.begin, end: tt.end,
+				read: func(_ Uint18) (uint16, error) { return 0123, nil }}
+			if err := u.RegisterDevice(d); (err != nil) != tt.wantErr {
+				t.Errorf("RegisterDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if v := u.ReadIO(0770004); v != 0123 {
+		t.Errorf("expected read to be dispatched to the registered device, got %06o", v)
+	}
+}